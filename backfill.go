@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"stravafy/internal/database"
+	"stravafy/internal/worker"
+	"syscall"
+	"time"
+)
+
+// runBackfill is the backfill subcommand:
+//
+//	stravafy backfill -athlete <strava id> -after 2024-01-01 [-before 2024-07-01] [-record-only]
+func runBackfill(queries *database.Queries, args []string) {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	athlete := flags.Int64("athlete", 0, "strava id of the athlete")
+	after := flags.String("after", "", "first day to backfill (YYYY-MM-DD)")
+	before := flags.String("before", time.Now().Format(time.DateOnly), "day after the last day to backfill (YYYY-MM-DD)")
+	recordOnly := flags.Bool("record-only", false, "only record matches, don't update descriptions on strava")
+	_ = flags.Parse(args)
+
+	if *athlete == 0 || *after == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	opts := worker.BackfillOptions{RecordOnly: *recordOnly}
+	var err error
+	opts.After, err = time.Parse(time.DateOnly, *after)
+	if err != nil {
+		log.Fatalf("invalid -after: %v", err)
+	}
+	opts.Before, err = time.Parse(time.DateOnly, *before)
+	if err != nil {
+		log.Fatalf("invalid -before: %v", err)
+	}
+	user, err := queries.GetUserByStravaId(context.Background(), *athlete)
+	if err != nil {
+		log.Fatalf("unknown athlete %d: %v", *athlete, err)
+	}
+
+	stop := make(chan struct{})
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-quit
+		close(stop)
+	}()
+
+	log.Printf("Backfilling activities of %s %s ...", user.FirstName, user.LastName)
+	var status worker.BackfillStatus
+	err = worker.Backfill(queries, user.ID, opts, &status, stop)
+	log.Printf("processed %d activities, %d failed", status.Processed, status.Failed)
+	if err != nil {
+		log.Fatalf("backfill: %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"stravafy/internal/database"
+	"stravafy/internal/worker"
+)
+
+// runImport is the import subcommand:
+//
+//	stravafy import -athlete <strava id> my_spotify_data.zip | Streaming_History_Audio_*.json ...
+func runImport(queries *database.Queries, args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	athlete := flags.Int64("athlete", 0, "strava id of the athlete")
+	_ = flags.Parse(args)
+
+	if *athlete == 0 || flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	user, err := queries.GetUserByStravaId(context.Background(), *athlete)
+	if err != nil {
+		log.Fatalf("unknown athlete %d: %v", *athlete, err)
+	}
+	var plays []worker.StreamingHistoryPlay
+	var h worker.StreamingHistoryReader
+	for _, name := range flags.Args() {
+		filePlays, err := readStreamingHistory(&h, name)
+		if err != nil {
+			log.Fatalf("reading %s: %v", name, err)
+		}
+		log.Printf("%s: %d plays", name, len(filePlays))
+		plays = append(plays, filePlays...)
+	}
+	var result worker.ImportResult
+	err = worker.ImportStreamingHistory(queries, user.ID, plays, nil, func(progress worker.ImportResult) {
+		result = progress
+	})
+	if err != nil {
+		log.Fatalf("import: %v", err)
+	}
+	log.Printf("imported %d of %d plays, %d duplicates, %d skipped", result.Imported, result.Plays, result.Duplicates, result.Skipped)
+}
+
+func readStreamingHistory(h *worker.StreamingHistoryReader, name string) ([]worker.StreamingHistoryPlay, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return h.Read(name, f, info.Size())
+}
@@ -12,6 +12,7 @@ import (
 	"stravafy/internal/config"
 	"stravafy/internal/database"
 	"stravafy/internal/sessions"
+	"stravafy/internal/tokens"
 	"stravafy/internal/worker"
 	"strconv"
 	"strings"
@@ -83,6 +84,14 @@ func (s *Service) spotifyCallback(c *gin.Context) {
 		_ = c.Error(err)
 		return
 	}
+	err = s.queries.UpsertSpotifyScope(c, database.UpsertSpotifyScopeParams{
+		UserID: userId,
+		Scope:  scopes.(string),
+	})
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
 	_, err = s.queries.GetSpotifyAccessToken(c, userId)
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		_ = c.Error(err)
@@ -126,6 +135,8 @@ func (s *Service) spotifyCallback(c *gin.Context) {
 			return
 		}
 	}
+	// the cached token source still has the token with the old scope
+	tokens.Forget(userId)
 	client := s.spotifyOauthConfig.Client(c, token)
 	resp, err := client.Get("https://api.spotify.com/v1/me")
 	if err != nil {
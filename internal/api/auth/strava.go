@@ -10,6 +10,7 @@ import (
 	"stravafy/internal/config"
 	"stravafy/internal/database"
 	"stravafy/internal/sessions"
+	"stravafy/internal/worker"
 	"strings"
 )
 
@@ -95,7 +96,8 @@ func (s *Service) stravaCallback(c *gin.Context) {
 			return
 		}
 	} else {
-		err = s.queries.UpdateStravaAccessToken(c, database.UpdateStravaAccessTokenParams{
+		// the tokens are gone if the athlete deauthorized us before
+		err = s.queries.UpsertStravaAccessToken(c, database.UpsertStravaAccessTokenParams{
 			UserID:      userId,
 			AccessToken: token.AccessToken,
 			ExpiresAt:   token.Expiry.Unix(),
@@ -104,7 +106,7 @@ func (s *Service) stravaCallback(c *gin.Context) {
 			_ = c.Error(err)
 			return
 		}
-		err = s.queries.UpdateStravaRefreshToken(c, database.UpdateStravaRefreshTokenParams{
+		err = s.queries.UpsertStravaRefreshToken(c, database.UpsertStravaRefreshTokenParams{
 			UserID:       userId,
 			RefreshToken: token.RefreshToken,
 		})
@@ -112,6 +114,10 @@ func (s *Service) stravaCallback(c *gin.Context) {
 			_ = c.Error(err)
 			return
 		}
+		_, err = s.queries.GetSpotifyUserInfo(c, userId)
+		if err == nil {
+			worker.LaunchSyncForUser(userId)
+		}
 	}
 	session, err := sessions.GetSession(c)
 	if err != nil {
@@ -0,0 +1,170 @@
+package listens
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"os"
+	"stravafy/internal/database"
+	"stravafy/internal/music"
+	"stravafy/internal/worker"
+	"strings"
+)
+
+const (
+	ListenTypeSingle     = "single"
+	ListenTypePlayingNow = "playing_now"
+	ListenTypeImport     = "import"
+)
+
+// maxListens is the most listens accepted in one import, as on ListenBrainz.
+const maxListens = 1000
+
+var logger *log.Logger
+
+func init() {
+	logfile, err := os.OpenFile("listens.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		log.Fatalf("error opening listens.log: %v", err)
+	}
+	logger = log.New(logfile, "", log.LstdFlags)
+}
+
+// Service implements the part of the ListenBrainz API scrobblers need, so
+// they can submit listens to Stravafy instead.
+type Service struct {
+	q *database.Queries
+}
+
+func New(q *database.Queries) *Service {
+	return &Service{q}
+}
+
+func (s *Service) Mount(group *gin.RouterGroup) {
+	group.GET("/validate-token", s.validateToken)
+	group.POST("/submit-listens", s.submitListens)
+}
+
+type submission struct {
+	ListenType string                     `json:"listen_type"`
+	Payload    []music.ListenBrainzListen `json:"payload"`
+}
+
+func (s *Service) validateToken(c *gin.Context) {
+	token, err := s.token(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"code": http.StatusOK, "message": "Token invalid.", "valid": false})
+		return
+	}
+	user, err := s.q.GetUserById(c, token.UserID)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"code":      http.StatusOK,
+		"message":   "Token valid.",
+		"valid":     true,
+		"user_name": user.FirstName + " " + user.LastName,
+	})
+}
+
+func (s *Service) submitListens(c *gin.Context) {
+	token, err := s.token(c)
+	if err != nil {
+		apiError(c, http.StatusUnauthorized, "Invalid authorization token.")
+		return
+	}
+	var body submission
+	if err := c.ShouldBindJSON(&body); err != nil {
+		apiError(c, http.StatusBadRequest, "Invalid JSON document submitted.")
+		return
+	}
+	if msg := body.validate(); msg != "" {
+		apiError(c, http.StatusBadRequest, msg)
+		return
+	}
+	plays := make([]music.Play, 0, len(body.Payload))
+	for _, listen := range body.Payload {
+		plays = append(plays, listen.Play())
+	}
+	if body.ListenType == ListenTypePlayingNow {
+		err = worker.SubmitPlayingNow(s.q, token.UserID, plays[0])
+	} else {
+		err = worker.SubmitListens(s.q, token.UserID, plays)
+	}
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+	err = s.q.TouchApiToken(c, token.ID)
+	if err != nil {
+		logger.Printf("touching token %d: %v", token.ID, err)
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// validate checks the submission like ListenBrainz does and returns what
+// is wrong with it.
+func (b submission) validate() string {
+	switch b.ListenType {
+	case ListenTypeSingle, ListenTypePlayingNow:
+		if len(b.Payload) != 1 {
+			return "JSON document should contain exactly one listen."
+		}
+	case ListenTypeImport:
+		if len(b.Payload) == 0 || len(b.Payload) > maxListens {
+			return "JSON document should contain between 1 and 1000 listens."
+		}
+	default:
+		return "JSON document must contain a valid listen_type key."
+	}
+	for _, listen := range b.Payload {
+		if listen.TrackMetadata.ArtistName == "" || listen.TrackMetadata.TrackName == "" {
+			return "JSON document does not contain required fields artist_name and track_name."
+		}
+		if b.ListenType != ListenTypePlayingNow && listen.ListenedAt <= 0 {
+			return "JSON document does not contain required field listened_at."
+		}
+	}
+	return ""
+}
+
+// token looks up the api token in the Authorization header.
+func (s *Service) token(c *gin.Context) (database.ApiToken, error) {
+	header := c.GetHeader("Authorization")
+	value, ok := strings.CutPrefix(header, "Token ")
+	if !ok || value == "" {
+		return database.ApiToken{}, sql.ErrNoRows
+	}
+	return s.q.GetApiTokenByHash(c, HashToken(strings.TrimSpace(value)))
+}
+
+func apiError(c *gin.Context, code int, msg string) {
+	c.JSON(code, gin.H{"code": code, "error": msg})
+}
+
+func internalError(c *gin.Context, err error) {
+	logger.Printf("%s %s: %v", c.Request.Method, c.Request.URL.Path, err)
+	apiError(c, http.StatusInternalServerError, "Something went wrong.")
+}
+
+// NewToken generates an api token. Only its hash is meant to be stored.
+func NewToken() (token string, hash string, err error) {
+	k := make([]byte, 32)
+	if _, err := rand.Read(k); err != nil {
+		return "", "", fmt.Errorf("generating token: %w", err)
+	}
+	token = hex.EncodeToString(k)
+	return token, HashToken(token), nil
+}
+
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
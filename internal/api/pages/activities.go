@@ -0,0 +1,283 @@
+package pages
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"stravafy/internal/database"
+	"stravafy/internal/templates"
+	"stravafy/internal/worker"
+	"strconv"
+)
+
+const activitiesPageSize = 20
+
+func (s *Service) activities(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	page, _ := strconv.Atoi(c.Query("page"))
+	props := templates.ActivitiesProps{Page: max(page, 0)}
+	activities, err := s.q.ListActivitiesForUser(c, database.ListActivitiesForUserParams{
+		UserID: userID,
+		Limit:  activitiesPageSize + 1,
+		Offset: int64(props.Page * activitiesPageSize),
+	})
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	if len(activities) > activitiesPageSize {
+		props.HasMore = true
+		activities = activities[:activitiesPageSize]
+	}
+	for _, activity := range activities {
+		tracks, err := s.q.GetActivityTracks(c, activity.ID)
+		if err != nil {
+			_ = c.Error(err)
+			return
+		}
+		props.Activities = append(props.Activities, templates.ActivitySummary{
+			Activity: activity,
+			Tracks:   tracks,
+			Contexts: activityContexts(tracks),
+		})
+	}
+	c.HTML(http.StatusOK, "", templates.Activities(props))
+}
+
+// activityContexts lists the playlists, albums and artists tracks were
+// played from, in the order they first came up.
+func activityContexts(tracks []database.GetActivityTracksRow) []templates.ActivityContext {
+	var contexts []templates.ActivityContext
+	seen := make(map[string]bool)
+	for _, track := range tracks {
+		if !track.CtxUri.Valid || seen[track.CtxUri.String] {
+			continue
+		}
+		seen[track.CtxUri.String] = true
+		contexts = append(contexts, templates.ActivityContext{
+			Type: track.CtxType.String,
+			Url:  track.CtxExternalUrl.String,
+		})
+	}
+	return contexts
+}
+
+func (s *Service) activity(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	activityID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.HTML(http.StatusNotFound, "", templates.Error(http.StatusNotFound, "activity not found", true))
+		return
+	}
+	activity, err := s.q.GetActivity(c, database.GetActivityParams{ID: activityID, UserID: userID})
+	if errors.Is(err, sql.ErrNoRows) {
+		c.HTML(http.StatusNotFound, "", templates.Error(http.StatusNotFound, "activity not found", true))
+		return
+	}
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	tracks, err := s.q.GetActivityTracks(c, activity.ID)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	props := templates.ActivityProps{
+		Summary: templates.ActivitySummary{
+			Activity: activity,
+			Tracks:   tracks,
+			Contexts: activityContexts(tracks),
+		},
+	}
+	playlist, err := s.q.GetActivityPlaylist(c, database.GetActivityPlaylistParams{ActivityID: activity.ID, UserID: userID})
+	if err == nil {
+		props.PlaylistUrl = playlist.Url
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		_ = c.Error(err)
+		return
+	}
+	share, err := s.q.GetActivityShare(c, database.GetActivityShareParams{ActivityID: activity.ID, UserID: userID})
+	if err == nil {
+		props.ShareUrl = worker.ShareUrl(share.Token)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		_ = c.Error(err)
+		return
+	}
+	c.HTML(http.StatusOK, "", templates.Activity(props))
+}
+
+func (s *Service) activitySegments(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	activityID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.HTML(http.StatusNotFound, "", templates.Error(http.StatusNotFound, "activity not found", true))
+		return
+	}
+	activity, err := s.q.GetActivity(c, database.GetActivityParams{ID: activityID, UserID: userID})
+	if errors.Is(err, sql.ErrNoRows) {
+		c.HTML(http.StatusNotFound, "", templates.Error(http.StatusNotFound, "activity not found", true))
+		return
+	}
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	data, err := worker.StoredSoundtrack(s.q, userID, activity)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	props := templates.ActivitySegmentsProps{
+		ActivityID: activity.ID,
+		Name:       activity.Name,
+		Laps:       data.Laps,
+		Splits:     data.Splits,
+	}
+	playlist, err := s.q.GetActivityPlaylist(c, database.GetActivityPlaylistParams{ActivityID: activity.ID, UserID: userID})
+	if err == nil {
+		props.PlaylistUrl = playlist.Url
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		_ = c.Error(err)
+		return
+	}
+	props.CanCreatePlaylist, err = worker.CanCreatePlaylists(s.q, userID)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.HTML(http.StatusOK, "", templates.ActivitySegments(props))
+}
+
+func (s *Service) createActivityPlaylist(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	activityID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.HTML(http.StatusNotFound, "", templates.Error(http.StatusNotFound, "activity not found", true))
+		return
+	}
+	_, err = worker.CreateActivityPlaylist(s.q, userID, activityID)
+	if errors.Is(err, worker.ErrActivityNotStored) {
+		c.HTML(http.StatusNotFound, "", templates.Error(http.StatusNotFound, "activity not found", true))
+		return
+	}
+	if errors.Is(err, worker.ErrNoSpotifyItems) || errors.Is(err, worker.ErrPlaylistScope) {
+		c.HTML(http.StatusBadRequest, "", templates.Error(http.StatusBadRequest, err.Error(), true))
+		return
+	}
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, fmt.Sprintf("/activities/%d/laps", activityID))
+}
+
+func (s *Service) exportActivity(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	activityID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.HTML(http.StatusNotFound, "", templates.Error(http.StatusNotFound, "activity not found", true))
+		return
+	}
+	format := c.DefaultQuery("format", worker.ExportFormatGPX)
+	if format != worker.ExportFormatGPX && format != worker.ExportFormatKML {
+		c.HTML(http.StatusBadRequest, "", templates.Error(http.StatusBadRequest, "unknown export format", true))
+		return
+	}
+	route, err := worker.ActivityRoute(s.q, userID, activityID)
+	if errors.Is(err, worker.ErrNoRoute) {
+		c.HTML(http.StatusNotFound, "", templates.Error(http.StatusNotFound, "this activity was recorded without GPS", true))
+		return
+	}
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"activity-%d.%s\"", activityID, format))
+	if format == worker.ExportFormatKML {
+		c.Header("Content-Type", "application/vnd.google-earth.kml+xml")
+		err = route.WriteKML(c.Writer)
+	} else {
+		c.Header("Content-Type", "application/gpx+xml")
+		err = route.WriteGPX(c.Writer)
+	}
+	if err != nil {
+		_ = c.Error(err)
+	}
+}
+
+func (s *Service) shareActivity(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	activityID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.HTML(http.StatusNotFound, "", templates.Error(http.StatusNotFound, "activity not found", true))
+		return
+	}
+	if c.PostForm("action") == "revoke" {
+		err = worker.RevokeShare(s.q, userID, activityID)
+	} else {
+		_, err = worker.ShareActivity(s.q, userID, activityID)
+	}
+	if errors.Is(err, worker.ErrPrivateActivity) {
+		c.HTML(http.StatusBadRequest, "", templates.Error(http.StatusBadRequest, err.Error(), true))
+		return
+	}
+	if errors.Is(err, worker.ErrShareNotFound) {
+		c.HTML(http.StatusNotFound, "", templates.Error(http.StatusNotFound, "activity not found", true))
+		return
+	}
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, fmt.Sprintf("/activities/%d", activityID))
+}
+
+// sharedActivity is the public page of an activity, no login needed.
+func (s *Service) sharedActivity(c *gin.Context) {
+	activity, err := worker.SharedActivity(s.q, c.Param("token"))
+	if errors.Is(err, worker.ErrShareNotFound) {
+		c.HTML(http.StatusNotFound, "", templates.Error(http.StatusNotFound, "this link does not exist or was revoked", false))
+		return
+	}
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	tracks, err := s.q.GetActivityTracks(c, activity.ID)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.HTML(http.StatusOK, "", templates.SharedActivity(templates.ActivitySummary{
+		Activity: activity,
+		Tracks:   tracks,
+		Contexts: activityContexts(tracks),
+	}))
+}
@@ -0,0 +1,64 @@
+package pages
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"stravafy/internal/templates"
+	"stravafy/internal/worker"
+	"time"
+)
+
+func (s *Service) backfill(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	props := templates.BackfillProps{
+		After:  time.Now().AddDate(0, -1, 0).Format(time.DateOnly),
+		Before: time.Now().Format(time.DateOnly),
+	}
+	props.Status, props.HasStatus = worker.GetBackfillStatus(userID)
+	c.HTML(http.StatusOK, "", templates.Backfill(props))
+}
+
+func (s *Service) startBackfill(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	props := templates.BackfillProps{
+		After:      c.PostForm("after"),
+		Before:     c.PostForm("before"),
+		RecordOnly: c.PostForm("record_only") != "",
+	}
+	props.Status, props.HasStatus = worker.GetBackfillStatus(userID)
+	opts := worker.BackfillOptions{RecordOnly: props.RecordOnly}
+	opts.After, err = time.Parse(time.DateOnly, props.After)
+	if err != nil {
+		props.Error = "invalid start date"
+		c.HTML(http.StatusBadRequest, "", templates.Backfill(props))
+		return
+	}
+	opts.Before, err = time.Parse(time.DateOnly, props.Before)
+	if err != nil || !opts.Before.After(opts.After) {
+		props.Error = "invalid end date"
+		c.HTML(http.StatusBadRequest, "", templates.Backfill(props))
+		return
+	}
+	// the end date is inclusive
+	opts.Before = opts.Before.AddDate(0, 0, 1)
+	err = worker.StartBackfill(s.q, userID, opts)
+	if errors.Is(err, worker.ErrBackfillRunning) {
+		props.Error = err.Error()
+		c.HTML(http.StatusConflict, "", templates.Backfill(props))
+		return
+	}
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/backfill")
+}
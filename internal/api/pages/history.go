@@ -0,0 +1,150 @@
+package pages
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"stravafy/internal/database"
+	"stravafy/internal/templates"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const historyPageSize = 200
+
+// sessionGap splits sessions that have no pause recorded between them, as
+// happens with scrobbles and imported history.
+const sessionGap = 30 * time.Minute
+
+// likeEscaper escapes the wildcards of LIKE patterns, the queries use \ as
+// escape character.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (s *Service) history(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	loc, err := s.userLocation(c, userID)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	props := templates.HistoryProps{
+		Filter: templates.HistoryFilter{
+			Day:        c.Query("day"),
+			Artist:     strings.TrimSpace(c.Query("artist")),
+			ContextUri: c.Query("context"),
+			ItemType:   c.Query("type"),
+		},
+	}
+	page, _ := strconv.Atoi(c.Query("page"))
+	props.Page = max(page, 0)
+	params := database.ListHistoryParams{
+		UserID:     userID,
+		After:      time.Unix(0, 0).UTC(),
+		Before:     time.Now().UTC().Add(time.Hour),
+		Artist:     likeEscaper.Replace(props.Filter.Artist),
+		ContextUri: props.Filter.ContextUri,
+		ItemType:   props.Filter.ItemType,
+		Limit:      historyPageSize + 1,
+		Offset:     int64(props.Page * historyPageSize),
+	}
+	if props.Filter.Day != "" {
+		day, err := time.ParseInLocation(time.DateOnly, props.Filter.Day, loc)
+		if err != nil {
+			props.Error = "invalid day"
+			c.HTML(http.StatusBadRequest, "", templates.History(props))
+			return
+		}
+		params.After = day.UTC()
+		params.Before = day.AddDate(0, 0, 1).UTC()
+	}
+	plays, err := s.q.ListHistory(c, params)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	if len(plays) > historyPageSize {
+		props.HasMore = true
+		plays = plays[:historyPageSize]
+	}
+	var pauses []time.Time
+	if len(plays) > 0 {
+		pauses, err = s.q.ListHistoryPauses(c, database.ListHistoryPausesParams{
+			UserID: userID,
+			After:  plays[len(plays)-1].Timestamp,
+			Before: plays[0].Timestamp,
+		})
+		if err != nil {
+			_ = c.Error(err)
+			return
+		}
+	}
+	props.Sessions = historySessions(plays, pauses, loc)
+	c.HTML(http.StatusOK, "", templates.History(props))
+}
+
+// historySessions groups plays, newest first, into listening sessions that
+// end with a pause or a long gap. pauses are the times of the pauses from
+// the oldest play on, oldest first.
+func historySessions(plays []database.ListHistoryRow, pauses []time.Time, loc *time.Location) []templates.HistorySession {
+	var sessions []templates.HistorySession
+	var current *templates.HistorySession
+	// walk from oldest to newest, so pauses end the session before them
+	for i := len(plays) - 1; i >= 0; i-- {
+		play := plays[i]
+		if current != nil {
+			if len(pauses) > 0 && !pauses[0].After(play.Timestamp) {
+				current.End = pauses[0].In(loc)
+				sessions = append(sessions, *current)
+				current = nil
+			} else if play.Timestamp.Sub(current.End) > sessionGap {
+				sessions = append(sessions, *current)
+				current = nil
+			}
+		}
+		for len(pauses) > 0 && !pauses[0].After(play.Timestamp) {
+			pauses = pauses[1:]
+		}
+		if current == nil {
+			current = &templates.HistorySession{Start: play.Timestamp.In(loc)}
+		}
+		current.End = play.Timestamp.In(loc)
+		current.Entries = append([]database.ListHistoryRow{play}, current.Entries...)
+	}
+	if current != nil {
+		if len(pauses) > 0 {
+			current.End = pauses[0].In(loc)
+		}
+		sessions = append(sessions, *current)
+	}
+	// newest session first, like the plays
+	for i, j := 0, len(sessions)-1; i < j; i, j = i+1, j-1 {
+		sessions[i], sessions[j] = sessions[j], sessions[i]
+	}
+	return sessions
+}
+
+// userLocation is the time zone of the latest activity of userID, in which
+// days are shown. Without activities it is UTC.
+func (s *Service) userLocation(c *gin.Context, userID int64) (*time.Location, error) {
+	activities, err := s.q.ListActivitiesForUser(c, database.ListActivitiesForUserParams{
+		UserID: userID,
+		Limit:  1,
+	})
+	if err != nil || len(activities) == 0 {
+		return time.UTC, err
+	}
+	// Strava formats it as "(GMT+01:00) Europe/Berlin"
+	fields := strings.Fields(activities[0].Timezone)
+	if len(fields) == 0 {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(fields[len(fields)-1])
+	if err != nil {
+		return time.UTC, nil
+	}
+	return loc, nil
+}
@@ -0,0 +1,77 @@
+package pages
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"stravafy/internal/templates"
+	"stravafy/internal/worker"
+)
+
+func (s *Service) importHistory(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	props := templates.ImportHistoryProps{}
+	props.Status, props.HasStatus = worker.GetImportStatus(userID)
+	c.HTML(http.StatusOK, "", templates.ImportHistory(props))
+}
+
+func (s *Service) uploadHistory(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	props := templates.ImportHistoryProps{}
+	props.Status, props.HasStatus = worker.GetImportStatus(userID)
+	// the compressed files can't be larger than what they decompress to
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, worker.MaxStreamingHistorySize+1<<20)
+	form, err := c.MultipartForm()
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		props.Error = worker.ErrImportTooLarge.Error()
+		c.HTML(http.StatusRequestEntityTooLarge, "", templates.ImportHistory(props))
+		return
+	}
+	if err != nil || len(form.File["files"]) == 0 {
+		props.Error = "select at least one file"
+		c.HTML(http.StatusBadRequest, "", templates.ImportHistory(props))
+		return
+	}
+	var plays []worker.StreamingHistoryPlay
+	var h worker.StreamingHistoryReader
+	for _, header := range form.File["files"] {
+		f, err := header.Open()
+		if err != nil {
+			_ = c.Error(err)
+			return
+		}
+		filePlays, err := h.Read(header.Filename, f, header.Size)
+		f.Close()
+		if errors.Is(err, worker.ErrImportTooLarge) {
+			props.Error = err.Error()
+			c.HTML(http.StatusRequestEntityTooLarge, "", templates.ImportHistory(props))
+			return
+		}
+		if err != nil {
+			props.Error = header.Filename + ": " + err.Error()
+			c.HTML(http.StatusBadRequest, "", templates.ImportHistory(props))
+			return
+		}
+		plays = append(plays, filePlays...)
+	}
+	err = worker.StartImport(s.q, userID, plays)
+	if errors.Is(err, worker.ErrImportRunning) {
+		props.Error = err.Error()
+		c.HTML(http.StatusConflict, "", templates.ImportHistory(props))
+		return
+	}
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/import")
+}
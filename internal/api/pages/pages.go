@@ -8,18 +8,76 @@ import (
 	"stravafy/internal/database"
 	"stravafy/internal/sessions"
 	"stravafy/internal/templates"
+	"stravafy/internal/worker"
 )
 
 type Service struct {
 	q *database.Queries
+	// closing is closed when the server shuts down, to end open event
+	// streams.
+	closing chan struct{}
 }
 
 func New(q *database.Queries) *Service {
-	return &Service{q}
+	return &Service{
+		q:       q,
+		closing: make(chan struct{}),
+	}
+}
+
+// CloseStreams ends the open event streams, the server waits for them
+// when shutting down.
+func (s *Service) CloseStreams() {
+	close(s.closing)
 }
 
 func (s *Service) Mount(group *gin.RouterGroup) {
 	group.GET("/", s.index)
+	group.GET("/settings/description", s.descriptionSettings)
+	group.POST("/settings/description", s.saveDescriptionSettings)
+	group.POST("/settings/playlists", s.savePlaylistSettings)
+	group.POST("/settings/review", s.saveReviewSettings)
+	group.POST("/settings/sharing", s.saveShareSettings)
+	group.GET("/settings/sources", s.sourceSettings)
+	group.POST("/settings/sources", s.saveSourceSettings)
+	group.POST("/settings/tokens", s.saveTokenSettings)
+	group.GET("/settings/rules", s.ruleSettings)
+	group.POST("/settings/rules", s.saveRuleSettings)
+	group.GET("/activities", s.activities)
+	group.GET("/activities/:id", s.activity)
+	group.GET("/activities/:id/laps", s.activitySegments)
+	group.GET("/activities/:id/export", s.exportActivity)
+	group.POST("/activities/:id/playlist", s.createActivityPlaylist)
+	group.POST("/activities/:id/share", s.shareActivity)
+	group.GET("/stats", s.stats)
+	group.GET("/history", s.history)
+	group.GET("/wrapped", s.currentWrapped)
+	group.GET("/wrapped/:year", s.wrapped)
+	group.GET("/wrapped/:year/card", s.wrappedCard)
+	group.GET("/wrapped/:year/card.png", s.wrappedCardPNG)
+	group.POST("/wrapped/:year/share", s.shareWrapped)
+	group.GET("/now-playing/events", s.nowPlayingEvents)
+	group.GET("/backfill", s.backfill)
+	group.POST("/backfill", s.startBackfill)
+	group.GET("/import", s.importHistory)
+	group.POST("/import", s.uploadHistory)
+	group.GET("/review", s.review)
+	group.POST("/review/:id", s.reviewPending)
+	group.GET("/approve/:token", s.approval)
+	group.POST("/approve/:token", s.approve)
+	group.GET("/upload", s.uploadActivity)
+	group.POST("/upload", s.matchActivityFile)
+	group.GET("/s/:token", s.sharedActivity)
+	group.GET("/w/:token", s.sharedWrapped)
+	group.GET("/w/:token/card.png", s.sharedWrappedCard)
+}
+
+func userID(c *gin.Context) (int64, error) {
+	session, err := sessions.GetSession(c)
+	if err != nil {
+		return 0, err
+	}
+	return session.GetUserId(c)
 }
 
 func (s *Service) index(c *gin.Context) {
@@ -55,6 +113,22 @@ func (s *Service) index(c *gin.Context) {
 		props.SpotifyConnected = true
 		props.SpotifyUserName = spotifyUserInfo.DisplayName
 		props.SpotifyID = spotifyUserInfo.SpotifyID
+		canReconcile, err := worker.CanReadRecentPlays(s.q, userID)
+		if err != nil {
+			_ = c.Error(err)
+			return
+		}
+		props.SpotifyReconnect = !canReconcile
+		loc, err := s.userLocation(c, userID)
+		if err != nil {
+			_ = c.Error(err)
+			return
+		}
+		props.NowPlaying, err = s.lastPlayerProps(c, userID, loc)
+		if err != nil {
+			_ = c.Error(err)
+			return
+		}
 	}
 	c.HTML(http.StatusOK, "", templates.IndexAuthenticated(props))
 
@@ -0,0 +1,137 @@
+package pages
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"stravafy/internal/database"
+	"stravafy/internal/templates"
+	"stravafy/internal/worker"
+	"strings"
+	"time"
+)
+
+// playerKeepAlive keeps proxies from closing idle event streams.
+const playerKeepAlive = 30 * time.Second
+
+func (s *Service) nowPlayingEvents(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	loc, err := s.userLocation(c, userID)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	states, unsubscribe := worker.SubscribePlayer(userID)
+	defer unsubscribe()
+	keepAlive := time.NewTicker(playerKeepAlive)
+	defer keepAlive.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case state := <-states:
+			props, err := s.playerProps(c, state, loc)
+			if err != nil {
+				_ = c.Error(err)
+				return false
+			}
+			var buf bytes.Buffer
+			if err := templates.NowPlayingPanel(props).Render(c, &buf); err != nil {
+				_ = c.Error(err)
+				return false
+			}
+			c.SSEvent("player", buf.String())
+			return true
+		case <-keepAlive.C:
+			c.SSEvent("ping", "")
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		case <-s.closing:
+			return false
+		}
+	})
+}
+
+// playerProps shows a state published by the worker.
+func (s *Service) playerProps(c *gin.Context, state worker.PlayerState, loc *time.Location) (templates.NowPlayingProps, error) {
+	props := templates.NowPlayingProps{Since: state.Updated.In(loc)}
+	if state.Play != nil {
+		play := state.Play
+		props.Playing = true
+		props.Since = play.Start.In(loc)
+		props.Name = play.Item.Name
+		props.Url = play.Item.Url
+		props.Source = state.Source
+		if play.Item.Episode != nil {
+			props.Byline = play.Item.Episode.Show
+		} else {
+			props.Byline = strings.Join(play.Item.Artists, ", ")
+		}
+		if play.Context != nil {
+			props.ContextType = play.Context.Type
+			props.ContextUrl = play.Context.Url
+		}
+	}
+	var err error
+	props.Activity, err = s.activityAt(c, state.UserID, props.Since)
+	return props, err
+}
+
+// lastPlayerProps shows the latest history entry of userID, for pages
+// rendered before the worker publishes the next change.
+func (s *Service) lastPlayerProps(c *gin.Context, userID int64, loc *time.Location) (templates.NowPlayingProps, error) {
+	var props templates.NowPlayingProps
+	last, err := s.q.GetLastHistoryEntryForUser(c, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return props, nil
+	}
+	if err != nil {
+		return props, err
+	}
+	props.Since = last.Timestamp.In(loc)
+	if last.IsPlaying {
+		entry, err := s.q.GetLastHistoryEntryComplete(c, userID)
+		if err != nil {
+			return props, err
+		}
+		props.Playing = true
+		props.Name = entry.Name
+		props.Url = entry.ItemExternalUrl
+		props.Source = entry.Source
+		props.Byline = entry.Artists.String
+		if entry.ItemType == "episode" {
+			props.Byline = entry.EpisodeShowName.String
+		}
+		props.ContextType = entry.CtxType.String
+		props.ContextUrl = entry.CtxExternalUrl.String
+	}
+	props.Activity, err = s.activityAt(c, userID, props.Since)
+	return props, err
+}
+
+// activityAt returns the stored activity of userID that t falls into, if
+// any. The player is only shown for recent plays, so only the latest
+// activity is checked.
+func (s *Service) activityAt(c *gin.Context, userID int64, t time.Time) (*database.Activity, error) {
+	activities, err := s.q.ListActivitiesForUser(c, database.ListActivitiesForUserParams{
+		UserID: userID,
+		Limit:  1,
+	})
+	if err != nil || len(activities) == 0 {
+		return nil, err
+	}
+	activity := activities[0]
+	end := activity.StartDate.Add(time.Duration(activity.ElapsedTime) * time.Second)
+	if t.Before(activity.StartDate) || t.After(end) {
+		return nil, nil
+	}
+	return &activity, nil
+}
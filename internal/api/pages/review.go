@@ -0,0 +1,156 @@
+package pages
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"stravafy/internal/database"
+	"stravafy/internal/templates"
+	"stravafy/internal/worker"
+	"strconv"
+	"strings"
+)
+
+func (s *Service) review(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	s.renderReview(c, http.StatusOK, userID, templates.ReviewProps{})
+}
+
+func (s *Service) renderReview(c *gin.Context, code int, userID int64, props templates.ReviewProps) {
+	var err error
+	props.Pending, err = s.q.ListPendingDescriptions(c, userID)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	// keep what was edited if it could not be published
+	for i := range props.Pending {
+		if props.Pending[i].ActivityID == props.ErrorActivityID {
+			props.Pending[i].Soundtrack = c.PostForm("soundtrack")
+		}
+	}
+	props.LoggedIn = true
+	c.HTML(code, "", templates.Review(props))
+}
+
+func (s *Service) reviewPending(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	activityID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.HTML(http.StatusNotFound, "", templates.Error(http.StatusNotFound, worker.ErrPendingNotFound.Error(), true))
+		return
+	}
+	err = s.decide(c, userID, activityID)
+	if errors.Is(err, worker.ErrDescriptionTooLong) {
+		s.renderReview(c, http.StatusBadRequest, userID, templates.ReviewProps{
+			ErrorActivityID: activityID,
+			Error:           err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		s.decisionError(c, err, true)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/review")
+}
+
+// approval shows the pending description an approval link is for, which
+// works without logging in.
+func (s *Service) approval(c *gin.Context) {
+	pending, err := worker.PendingByToken(s.q, c.Param("token"))
+	if err != nil {
+		s.decisionError(c, err, false)
+		return
+	}
+	c.HTML(http.StatusOK, "", templates.Review(templates.ReviewProps{
+		Pending: []database.PendingDescription{pending},
+		Token:   c.Param("token"),
+	}))
+}
+
+func (s *Service) approve(c *gin.Context) {
+	pending, err := worker.PendingByToken(s.q, c.Param("token"))
+	if err != nil {
+		s.decisionError(c, err, false)
+		return
+	}
+	err = s.decide(c, pending.UserID, pending.ActivityID)
+	if errors.Is(err, worker.ErrDescriptionTooLong) {
+		pending.Soundtrack = c.PostForm("soundtrack")
+		c.HTML(http.StatusBadRequest, "", templates.Review(templates.ReviewProps{
+			Pending:         []database.PendingDescription{pending},
+			Token:           c.Param("token"),
+			ErrorActivityID: pending.ActivityID,
+			Error:           err.Error(),
+		}))
+		return
+	}
+	if err != nil {
+		s.decisionError(c, err, false)
+		return
+	}
+	c.HTML(http.StatusOK, "", templates.Reviewed(c.PostForm("action") == "approve", pending.ActivityID))
+}
+
+// decide approves or discards the pending description of activityID as
+// the form says.
+func (s *Service) decide(c *gin.Context, userID int64, activityID int64) error {
+	if c.PostForm("action") == "discard" {
+		return worker.DiscardPending(s.q, userID, activityID)
+	}
+	return worker.ApprovePending(s.q, userID, activityID, c.PostForm("soundtrack"))
+}
+
+func (s *Service) decisionError(c *gin.Context, err error, loggedIn bool) {
+	if errors.Is(err, worker.ErrPendingNotFound) {
+		c.HTML(http.StatusNotFound, "", templates.Error(http.StatusNotFound, "this change was already approved or discarded", loggedIn))
+		return
+	}
+	if errors.Is(err, worker.ErrApprovalExpired) {
+		c.HTML(http.StatusGone, "", templates.Error(http.StatusGone, "this link expired, log in to review the change", loggedIn))
+		return
+	}
+	_ = c.Error(fmt.Errorf("reviewing description: %w", err))
+}
+
+func (s *Service) saveReviewSettings(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	settings := database.UpsertReviewSettingsParams{
+		UserID:    userID,
+		Enabled:   c.PostForm("enabled") == "on",
+		NotifyUrl: strings.TrimSpace(c.PostForm("notify_url")),
+	}
+	if settings.NotifyUrl != "" {
+		if urlErr := worker.CheckNotifyUrl(settings.NotifyUrl); urlErr != nil {
+			props, err := s.descriptionSettingsProps(c, userID)
+			if err != nil {
+				_ = c.Error(err)
+				return
+			}
+			props.Review = database.ReviewSetting(settings)
+			props.ReviewError = urlErr.Error()
+			c.HTML(http.StatusBadRequest, "", templates.DescriptionSettings(props))
+			return
+		}
+	}
+	err = s.q.UpsertReviewSettings(c, settings)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/settings/description")
+}
@@ -0,0 +1,82 @@
+package pages
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"slices"
+	"stravafy/internal/database"
+	"stravafy/internal/templates"
+	"stravafy/internal/worker"
+	"strconv"
+	"strings"
+)
+
+func (s *Service) ruleSettings(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	rules, err := worker.ActivityRules(s.q, userID)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.HTML(http.StatusOK, "", templates.RuleSettings(templates.RuleSettingsProps{
+		Rules:      rules,
+		SportTypes: worker.SportTypes,
+		Selected:   worker.RuleSportTypes(rules),
+	}))
+}
+
+func (s *Service) saveRuleSettings(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	var sportTypes []string
+	for _, sportType := range c.PostFormArray("sport_types") {
+		if slices.Contains(worker.SportTypes, sportType) {
+			sportTypes = append(sportTypes, sportType)
+		}
+	}
+	// selecting every sport type is the same as selecting none
+	if len(sportTypes) == len(worker.SportTypes) {
+		sportTypes = nil
+	}
+	params := database.UpsertActivityRulesParams{
+		UserID:      userID,
+		SportTypes:  strings.Join(sportTypes, ","),
+		SkipPrivate: c.PostForm("skip_private") == "on",
+		SkipCommute: c.PostForm("skip_commute") == "on",
+		SkipTrainer: c.PostForm("skip_trainer") == "on",
+		SkipManual:  c.PostForm("skip_manual") == "on",
+		OptOutTag:   strings.TrimSpace(c.PostForm("opt_out_tag")),
+	}
+	minutes, err := strconv.ParseInt(c.DefaultPostForm("min_duration", "0"), 10, 64)
+	if err != nil || minutes < 0 {
+		c.HTML(http.StatusBadRequest, "", templates.RuleSettings(templates.RuleSettingsProps{
+			Rules: database.ActivityRule{
+				UserID:      userID,
+				SportTypes:  params.SportTypes,
+				SkipPrivate: params.SkipPrivate,
+				SkipCommute: params.SkipCommute,
+				SkipTrainer: params.SkipTrainer,
+				SkipManual:  params.SkipManual,
+				OptOutTag:   params.OptOutTag,
+			},
+			SportTypes: worker.SportTypes,
+			Selected:   sportTypes,
+			Error:      "the minimum duration has to be a whole number of minutes",
+		}))
+		return
+	}
+	params.MinDuration = minutes * 60
+	err = s.q.UpsertActivityRules(c, params)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/settings/rules")
+}
@@ -0,0 +1,142 @@
+package pages
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"stravafy/internal/database"
+	"stravafy/internal/description"
+	"stravafy/internal/templates"
+	"stravafy/internal/worker"
+)
+
+func (s *Service) descriptionSettings(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	props, err := s.descriptionSettingsProps(c, userID)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.HTML(http.StatusOK, "", templates.DescriptionSettings(props))
+}
+
+func (s *Service) descriptionSettingsProps(c *gin.Context, userID int64) (templates.DescriptionSettingsProps, error) {
+	props := templates.DescriptionSettingsProps{}
+	var err error
+	props.Template, err = s.q.GetDescriptionTemplate(c, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		props.Template = description.Default
+		props.IsDefault = true
+	} else if err != nil {
+		return props, err
+	}
+	return props, s.loadPublishSettings(c, userID, &props)
+}
+
+func (s *Service) saveDescriptionSettings(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	props := templates.DescriptionSettingsProps{
+		Template: c.PostForm("template"),
+	}
+	err = s.loadPublishSettings(c, userID, &props)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	switch c.PostForm("action") {
+	case "reset":
+		err := s.q.DeleteDescriptionTemplate(c, userID)
+		if err != nil {
+			_ = c.Error(err)
+			return
+		}
+	case "preview":
+		props.Preview, err = description.Render(props.Template, description.Sample())
+		if err != nil {
+			props.Error = err.Error()
+		} else if props.Preview == "" {
+			props.Error = "the template renders nothing for the sample activity"
+		}
+		c.HTML(http.StatusOK, "", templates.DescriptionSettings(props))
+		return
+	default:
+		_, err := description.Render(props.Template, description.Sample())
+		if err != nil {
+			props.Error = err.Error()
+			c.HTML(http.StatusBadRequest, "", templates.DescriptionSettings(props))
+			return
+		}
+		err = s.q.UpsertDescriptionTemplate(c, database.UpsertDescriptionTemplateParams{
+			UserID:   userID,
+			Template: props.Template,
+		})
+		if err != nil {
+			_ = c.Error(err)
+			return
+		}
+	}
+	c.Redirect(http.StatusSeeOther, "/settings/description")
+}
+
+func (s *Service) savePlaylistSettings(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	err = s.q.UpsertPlaylistSettings(c, database.UpsertPlaylistSettingsParams{
+		UserID:           userID,
+		AutoCreate:       c.PostForm("auto_create") == "on",
+		AddToDescription: c.PostForm("add_to_description") == "on",
+	})
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/settings/description")
+}
+
+func (s *Service) saveShareSettings(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	err = s.q.UpsertShareSettings(c, database.UpsertShareSettingsParams{
+		UserID:           userID,
+		AutoCreate:       c.PostForm("auto_create") == "on",
+		AddToDescription: c.PostForm("add_to_description") == "on",
+	})
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/settings/description")
+}
+
+func (s *Service) loadPublishSettings(c *gin.Context, userID int64, props *templates.DescriptionSettingsProps) error {
+	var err error
+	props.Playlists, err = worker.PlaylistSettings(s.q, userID)
+	if err != nil {
+		return err
+	}
+	props.CanCreatePlaylists, err = worker.CanCreatePlaylists(s.q, userID)
+	if err != nil {
+		return err
+	}
+	props.Review, err = worker.ReviewSettings(s.q, userID)
+	if err != nil {
+		return err
+	}
+	props.Sharing, err = worker.ShareSettings(s.q, userID)
+	return err
+}
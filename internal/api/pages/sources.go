@@ -0,0 +1,148 @@
+package pages
+
+import (
+	"database/sql"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"stravafy/internal/api/listens"
+	"stravafy/internal/config"
+	"stravafy/internal/database"
+	"stravafy/internal/music"
+	"stravafy/internal/templates"
+	"strconv"
+	"strings"
+)
+
+func (s *Service) sourceSettings(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	props, err := s.sourceSettingsProps(c, userID)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.HTML(http.StatusOK, "", templates.SourceSettings(props))
+}
+
+func (s *Service) saveSourceSettings(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	params := database.UpsertMusicAccountParams{UserID: userID}
+	var linkErr error
+	switch c.PostForm("action") {
+	case "unlink":
+		err := s.q.DeleteMusicAccount(c, database.DeleteMusicAccountParams{
+			UserID: userID,
+			Source: c.PostForm("source"),
+		})
+		if err != nil {
+			_ = c.Error(err)
+			return
+		}
+		c.Redirect(http.StatusSeeOther, "/settings/sources")
+		return
+	case music.SourceLastfm:
+		params.Source = music.SourceLastfm
+		params.Username = strings.TrimSpace(c.PostForm("username"))
+		linkErr = music.CheckLastfmUser(c, params.Username)
+	case music.SourceListenBrainz:
+		params.Source = music.SourceListenBrainz
+		token := strings.TrimSpace(c.PostForm("token"))
+		params.Token = sql.NullString{String: token, Valid: true}
+		params.Username, linkErr = music.ListenBrainzUser(c, token)
+	default:
+		c.Redirect(http.StatusSeeOther, "/settings/sources")
+		return
+	}
+	if linkErr != nil {
+		props, err := s.sourceSettingsProps(c, userID)
+		if err != nil {
+			_ = c.Error(err)
+			return
+		}
+		props.Errors = map[string]string{params.Source: linkErr.Error()}
+		c.HTML(http.StatusBadRequest, "", templates.SourceSettings(props))
+		return
+	}
+	err = s.q.UpsertMusicAccount(c, params)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/settings/sources")
+}
+
+func (s *Service) saveTokenSettings(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	if c.PostForm("action") == "revoke" {
+		id, err := strconv.ParseInt(c.PostForm("id"), 10, 64)
+		if err != nil {
+			c.Redirect(http.StatusSeeOther, "/settings/sources")
+			return
+		}
+		err = s.q.DeleteApiToken(c, database.DeleteApiTokenParams{ID: id, UserID: userID})
+		if err != nil {
+			_ = c.Error(err)
+			return
+		}
+		c.Redirect(http.StatusSeeOther, "/settings/sources")
+		return
+	}
+	name := strings.TrimSpace(c.PostForm("name"))
+	if name == "" {
+		name = "Player"
+	}
+	token, hash, err := listens.NewToken()
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	err = s.q.InsertApiToken(c, database.InsertApiTokenParams{
+		UserID:    userID,
+		Name:      name,
+		TokenHash: hash,
+	})
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	props, err := s.sourceSettingsProps(c, userID)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	// the token is only shown this once
+	props.NewToken = token
+	c.HTML(http.StatusOK, "", templates.SourceSettings(props))
+}
+
+func (s *Service) sourceSettingsProps(c *gin.Context, userID int64) (templates.SourceSettingsProps, error) {
+	conf := config.GetConfig()
+	props := templates.SourceSettingsProps{
+		LastfmEnabled: conf.Scrobbles.LastfmApiKey != "",
+		Accounts:      make(map[string]database.MusicAccount),
+		ApiRoot:       strings.TrimSuffix(conf.Strava.WebhookHost, "/"),
+	}
+	accounts, err := s.q.ListMusicAccountsForUser(c, userID)
+	if err != nil {
+		return props, err
+	}
+	props.Tokens, err = s.q.ListApiTokensForUser(c, userID)
+	if err != nil {
+		return props, err
+	}
+	for _, account := range accounts {
+		props.Accounts[account.Source] = account
+	}
+	return props, nil
+}
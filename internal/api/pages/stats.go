@@ -0,0 +1,27 @@
+package pages
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"stravafy/internal/database"
+	"stravafy/internal/templates"
+	"stravafy/internal/worker"
+)
+
+func (s *Service) stats(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	powerSongs, err := s.q.GetPowerSongs(c, database.GetPowerSongsParams{
+		UserID:     userID,
+		MinSeconds: worker.PowerSongMinSeconds,
+		Limit:      25,
+	})
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.HTML(http.StatusOK, "", templates.Stats(powerSongs))
+}
@@ -0,0 +1,74 @@
+package pages
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"stravafy/internal/templates"
+	"stravafy/internal/worker"
+)
+
+func (s *Service) uploadActivity(c *gin.Context) {
+	if _, err := userID(c); err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.HTML(http.StatusOK, "", templates.UploadActivity(templates.UploadActivityProps{}))
+}
+
+func (s *Service) matchActivityFile(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	props := templates.UploadActivityProps{}
+	// leave some room for the other form fields
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, worker.MaxActivityFileSize+1<<20)
+	header, err := c.FormFile("file")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) || (err == nil && header.Size > worker.MaxActivityFileSize) {
+		props.Error = fmt.Sprintf("the file is larger than %d MB", worker.MaxActivityFileSize>>20)
+		c.HTML(http.StatusRequestEntityTooLarge, "", templates.UploadActivity(props))
+		return
+	}
+	if err != nil {
+		props.Error = "select a file"
+		c.HTML(http.StatusBadRequest, "", templates.UploadActivity(props))
+		return
+	}
+	f, err := header.Open()
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(f, worker.MaxActivityFileSize))
+	f.Close()
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	file, err := worker.ReadActivityFile(header.Filename, data)
+	if err != nil {
+		props.Error = header.Filename + ": " + err.Error()
+		c.HTML(http.StatusBadRequest, "", templates.UploadActivity(props))
+		return
+	}
+	soundtrack, desc, err := worker.MatchActivityFile(s.q, userID, file)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	props.Activity = &file.Activity
+	props.Soundtrack = soundtrack
+	props.Description = desc
+	if c.PostForm("strava") == "on" {
+		props.Upload, err = worker.UploadActivity(s.q, userID, file, desc)
+		if err != nil {
+			props.UploadError = err.Error()
+		}
+	}
+	c.HTML(http.StatusOK, "", templates.UploadActivity(props))
+}
@@ -0,0 +1,152 @@
+package pages
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"stravafy/internal/templates"
+	"stravafy/internal/worker"
+	"strconv"
+	"time"
+)
+
+func (s *Service) currentWrapped(c *gin.Context) {
+	c.Redirect(http.StatusSeeOther, fmt.Sprintf("/wrapped/%d", time.Now().Year()))
+}
+
+func (s *Service) wrapped(c *gin.Context) {
+	wrapped, ok := s.loadWrapped(c)
+	if !ok {
+		return
+	}
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	shareUrl, err := worker.WrappedShare(s.q, userID, wrapped.Year)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.HTML(http.StatusOK, "", templates.Wrapped(templates.WrappedProps{
+		Wrapped:  wrapped,
+		Next:     wrapped.Year < time.Now().Year(),
+		ShareUrl: shareUrl,
+	}))
+}
+
+func (s *Service) wrappedCard(c *gin.Context) {
+	wrapped, ok := s.loadWrapped(c)
+	if !ok {
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"stravafy-wrapped-%d.svg\"", wrapped.Year))
+	c.Header("Content-Type", "image/svg+xml")
+	if err := templates.WrappedCard(wrapped).Render(c, c.Writer); err != nil {
+		_ = c.Error(err)
+	}
+}
+
+func (s *Service) wrappedCardPNG(c *gin.Context) {
+	wrapped, ok := s.loadWrapped(c)
+	if !ok {
+		return
+	}
+	writeWrappedCardPNG(c, wrapped)
+}
+
+func (s *Service) shareWrapped(c *gin.Context) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	year, ok := wrappedYear(c)
+	if !ok {
+		return
+	}
+	if c.PostForm("action") == "revoke" {
+		err = worker.RevokeWrapped(s.q, userID, year)
+	} else {
+		_, err = worker.ShareWrapped(s.q, userID, year)
+	}
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, fmt.Sprintf("/wrapped/%d", year))
+}
+
+// sharedWrapped is the public page of a Wrapped, no login needed.
+func (s *Service) sharedWrapped(c *gin.Context) {
+	wrapped, ok := s.loadSharedWrapped(c)
+	if !ok {
+		return
+	}
+	c.HTML(http.StatusOK, "", templates.SharedWrapped(wrapped, c.Param("token")))
+}
+
+func (s *Service) sharedWrappedCard(c *gin.Context) {
+	wrapped, ok := s.loadSharedWrapped(c)
+	if !ok {
+		return
+	}
+	writeWrappedCardPNG(c, wrapped)
+}
+
+func writeWrappedCardPNG(c *gin.Context, wrapped *worker.Wrapped) {
+	var buf bytes.Buffer
+	if err := templates.WrappedCardPNG(&buf, wrapped); err != nil {
+		_ = c.Error(err)
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"stravafy-wrapped-%d.png\"", wrapped.Year))
+	c.Data(http.StatusOK, "image/png", buf.Bytes())
+}
+
+// loadWrapped sums up the year in the path. It reports false after
+// responding with an error.
+func (s *Service) loadWrapped(c *gin.Context) (*worker.Wrapped, bool) {
+	userID, err := userID(c)
+	if err != nil {
+		_ = c.Error(err)
+		return nil, false
+	}
+	year, ok := wrappedYear(c)
+	if !ok {
+		return nil, false
+	}
+	wrapped, err := worker.YearInReview(s.q, userID, year)
+	if err != nil {
+		_ = c.Error(err)
+		return nil, false
+	}
+	return wrapped, true
+}
+
+// loadSharedWrapped sums up the year of the public link in the path. It
+// reports false after responding with an error.
+func (s *Service) loadSharedWrapped(c *gin.Context) (*worker.Wrapped, bool) {
+	wrapped, err := worker.SharedWrapped(s.q, c.Param("token"))
+	if errors.Is(err, worker.ErrShareNotFound) {
+		c.HTML(http.StatusNotFound, "", templates.Error(http.StatusNotFound, "this link does not exist or was revoked", false))
+		return nil, false
+	}
+	if err != nil {
+		_ = c.Error(err)
+		return nil, false
+	}
+	return wrapped, true
+}
+
+func wrappedYear(c *gin.Context) (int, bool) {
+	year, err := strconv.Atoi(c.Param("year"))
+	if err != nil || year < 2000 || year > time.Now().Year() {
+		c.HTML(http.StatusNotFound, "", templates.Error(http.StatusNotFound, "year not found", true))
+		return 0, false
+	}
+	return year, true
+}
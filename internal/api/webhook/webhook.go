@@ -12,10 +12,14 @@ import (
 	"stravafy/internal/config"
 	"stravafy/internal/database"
 	"stravafy/internal/worker"
+	"sync/atomic"
 )
 
 var logger *log.Logger
 
+// subscriptionID is the webhook subscription found or created at startup.
+var subscriptionID atomic.Int64
+
 func init() {
 	logfile, err := os.OpenFile("webhook.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
 	if err != nil {
@@ -57,6 +61,7 @@ func RegisterWebhook() {
 		logger.Printf("[ERROR]: error while subscribing: %v", err)
 		return
 	}
+	defer resp.Body.Close()
 	logger.Printf("[INFO]: StatusCode %d: %s", resp.StatusCode, resp.Status)
 	if resp.StatusCode > 299 {
 		bytes, err := io.ReadAll(resp.Body)
@@ -64,6 +69,8 @@ func RegisterWebhook() {
 			logger.Fatalf("[FATAL]: could not read body: %v", err)
 		}
 		logger.Printf("[ERROR]: could not register webhook: %s", string(bytes))
+		// most likely the subscription exists already
+		LookupSubscription()
 		return
 	}
 	var payload SubscriptionPayload
@@ -74,6 +81,52 @@ func RegisterWebhook() {
 		return
 	}
 	logger.Printf("[INFO]: subscribed with id: %d", payload.ID)
+	subscriptionID.Store(payload.ID)
+}
+
+// LookupSubscription remembers the id of the existing subscription of this
+// application and reports whether there is one. It is called before the
+// server accepts events, so events sent during startup are not refused.
+func LookupSubscription() bool {
+	conf := config.GetConfig()
+	if conf.Strava.SubscriptionId != 0 {
+		return true
+	}
+	query := url.Values{}
+	query.Add("client_id", fmt.Sprintf("%d", conf.Strava.ClientId))
+	query.Add("client_secret", conf.Strava.ClientSecret)
+	resp, err := http.Get("https://www.strava.com/api/v3/push_subscriptions?" + query.Encode())
+	if err != nil {
+		logger.Printf("[ERROR]: error while looking up subscription: %v", err)
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode > 299 {
+		logger.Printf("[ERROR]: looking up subscription returned with HTTP %d %s", resp.StatusCode, resp.Status)
+		return false
+	}
+	var payload []SubscriptionPayload
+	err = json.NewDecoder(resp.Body).Decode(&payload)
+	if err != nil {
+		logger.Printf("[ERROR]: error while looking up subscription: %v", err)
+		return false
+	}
+	if len(payload) == 0 {
+		logger.Printf("[INFO]: no subscription found")
+		return false
+	}
+	logger.Printf("[INFO]: found subscription with id: %d", payload[0].ID)
+	subscriptionID.Store(payload[0].ID)
+	return true
+}
+
+// expectedSubscription is the subscription events have to come from, zero
+// if it is not known.
+func expectedSubscription() int64 {
+	if id := config.GetConfig().Strava.SubscriptionId; id != 0 {
+		return id
+	}
+	return subscriptionID.Load()
 }
 
 func (s *Service) webhookCallback(c *gin.Context) {
@@ -81,8 +134,21 @@ func (s *Service) webhookCallback(c *gin.Context) {
 	err := c.Bind(&args)
 	if err != nil {
 		logger.Printf("[ERROR]: could not bind callback args: %v", err)
+		return
+	}
+	// anyone can post here, only strava knows the subscription id
+	if expected := expectedSubscription(); expected == 0 || args.SubscriptionId != expected {
+		logger.Printf("[ERROR]: rejecting event of subscription %d, expected %d", args.SubscriptionId, expected)
+		c.Status(http.StatusForbidden)
+		return
+	}
+	err = worker.EnqueueStravaEvent(c, s.queries, args)
+	if err != nil {
+		// strava retries the delivery if we do not acknowledge it
+		logger.Printf("[ERROR]: could not queue event: %v", err)
+		c.Status(http.StatusInternalServerError)
+		return
 	}
-	worker.HandleStravaEvent(args)
 	c.Status(http.StatusNoContent)
 }
 
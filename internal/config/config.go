@@ -22,13 +22,42 @@ type StravaConfig struct {
 	ApprovalPrompt string
 	StateString    string
 	WebhookHost    string
+	// PurgeOnDeauthorize deletes all data of a user when they revoke
+	// access on Strava instead of only their tokens and sessions.
+	PurgeOnDeauthorize bool
+	// SubscriptionId is the webhook subscription events have to come from.
+	// If it is zero, the subscription found at startup is used.
+	SubscriptionId int64
 }
 
 type SpotifyConfig struct {
-	ClientID       string
-	ClientSecret   string
-	UpdateInterval int
-	ShowDialog     bool
+	ClientID          string
+	ClientSecret      string
+	UpdateInterval    int
+	ReconcileInterval int
+	ShowDialog        bool
+}
+
+type EventsConfig struct {
+	PollInterval   int
+	RetryBaseDelay int
+	MaxAttempts    int
+	// RetentionDays is how long finished events are kept.
+	RetentionDays int
+}
+
+type BackfillConfig struct {
+	// Interval is the pause between two activities in seconds, to stay
+	// within the rate limits of the Strava API.
+	Interval int
+}
+
+type ScrobblesConfig struct {
+	// PollInterval is the time between two syncs of the linked Last.fm
+	// and ListenBrainz accounts in seconds.
+	PollInterval int
+	// LastfmApiKey enables linking Last.fm accounts when set.
+	LastfmApiKey string
 }
 
 type ListenConfig struct {
@@ -37,10 +66,13 @@ type ListenConfig struct {
 }
 
 type Config struct {
-	Listen   ListenConfig
-	Strava   StravaConfig
-	Spotify  SpotifyConfig
-	Database DatabaseConfig
+	Listen    ListenConfig
+	Strava    StravaConfig
+	Spotify   SpotifyConfig
+	Database  DatabaseConfig
+	Events    EventsConfig
+	Backfill  BackfillConfig
+	Scrobbles ScrobblesConfig
 }
 
 type OnConfigChangeFunc func(event fsnotify.Event, config *Config, oldConfig *Config)
@@ -62,14 +94,27 @@ func DefaultConfig() *Config {
 			WebhookHost:    "https://your.service.host",
 		},
 		Spotify: SpotifyConfig{
-			ClientID:       "<client-id>",
-			ClientSecret:   "<client-secret>",
-			UpdateInterval: 60,
-			ShowDialog:     false,
+			ClientID:          "<client-id>",
+			ClientSecret:      "<client-secret>",
+			UpdateInterval:    60,
+			ReconcileInterval: 900,
+			ShowDialog:        false,
 		},
 		Database: DatabaseConfig{
 			Source: "file:stravafy.db?mode=rwc",
 		},
+		Events: EventsConfig{
+			PollInterval:   10,
+			RetryBaseDelay: 30,
+			MaxAttempts:    8,
+			RetentionDays:  30,
+		},
+		Backfill: BackfillConfig{
+			Interval: 30,
+		},
+		Scrobbles: ScrobblesConfig{
+			PollInterval: 300,
+		},
 	}
 }
 
@@ -84,6 +129,9 @@ func Setup(configPath string) error {
 
 	viper.SetDefault("listen", DefaultConfig().Listen)
 	viper.SetDefault("database", DefaultConfig().Database)
+	viper.SetDefault("events", DefaultConfig().Events)
+	viper.SetDefault("backfill", DefaultConfig().Backfill)
+	viper.SetDefault("scrobbles", DefaultConfig().Scrobbles)
 
 	if err := viper.ReadInConfig(); err != nil {
 		var configFileNotFoundError viper.ConfigFileNotFoundError
@@ -113,11 +161,19 @@ func GetConfig() *Config {
 	return conf
 }
 
+// SpotifyPlaylistScope allows creating playlists from activities. Users who
+// connected Spotify before it was requested have to connect again.
+const SpotifyPlaylistScope = "playlist-modify-private"
+
+// SpotifyRecentlyPlayedScope allows filling gaps in the history with the
+// recently played tracks. Like SpotifyPlaylistScope it was added later.
+const SpotifyRecentlyPlayedScope = "user-read-recently-played"
+
 func GetSpotifyOauthConfig() oauth2.Config {
 	return oauth2.Config{
 		ClientID:     conf.Spotify.ClientID,
 		ClientSecret: conf.Spotify.ClientSecret,
-		Scopes:       []string{"user-read-currently-playing", "user-read-playback-state"},
+		Scopes:       []string{"user-read-currently-playing", "user-read-playback-state", SpotifyRecentlyPlayedScope, SpotifyPlaylistScope},
 		Endpoint:     endpoints.Spotify,
 	}
 }
@@ -0,0 +1,126 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// migration changes tables schema.sql can't, it runs once after schema.sql
+// created the current tables.
+type migration struct {
+	name string
+	// needed reports whether the database has anything to migrate, new
+	// databases don't.
+	needed func(ctx context.Context, tx *sql.Tx) (bool, error)
+	sql    string
+}
+
+// migrations are numbered by their position, PRAGMA user_version is the
+// number of migrations applied.
+var migrations = []migration{
+	{
+		name:   "provider-neutral history",
+		needed: tableExists("spotify_user_history"),
+		sql:    historyMigration,
+	},
+}
+
+// historyMigration moves the history from the spotify_user_history* tables
+// and the source of entries from other sources from history_source into
+// the history* tables, keeping the ids. The tables referring to history
+// entries are rebuilt to point at history.
+const historyMigration = `
+CREATE TABLE IF NOT EXISTS history_source
+(
+    history_id INTEGER     NOT NULL PRIMARY KEY,
+    source     VARCHAR(20) NOT NULL
+);
+INSERT INTO history (id, user_id, source, timestamp, is_playing)
+SELECT h.id, h.user_id, COALESCE(src.source, 'spotify'), h.timestamp, h.is_playing
+FROM spotify_user_history h
+         LEFT JOIN history_source src ON h.id = src.history_id;
+INSERT INTO history_context (history_id, type, href, external_url, uri)
+SELECT history_id, type, href, external_url, uri FROM spotify_user_history_context;
+INSERT INTO history_item (history_id, type, href, external_url, uri, name, artists, album, album_uri,
+                          episode_description, episode_show_name, episode_show_description, episode_show_uri)
+SELECT history_id, type, href, external_url, uri, name, artists, album, album_uri,
+       episode_description, episode_show_name, episode_show_description, episode_show_uri
+FROM spotify_user_history_item;
+
+CREATE TABLE spotify_user_history_reconciled_new
+(
+    history_id INTEGER   NOT NULL PRIMARY KEY,
+    played_at  TIMESTAMP NOT NULL,
+    FOREIGN KEY (history_id) REFERENCES history (id)
+);
+INSERT INTO spotify_user_history_reconciled_new SELECT history_id, played_at FROM spotify_user_history_reconciled;
+DROP TABLE spotify_user_history_reconciled;
+ALTER TABLE spotify_user_history_reconciled_new RENAME TO spotify_user_history_reconciled;
+
+CREATE TABLE spotify_user_history_imported_new
+(
+    history_id INTEGER   NOT NULL PRIMARY KEY,
+    played_at  TIMESTAMP NOT NULL,
+    ms_played  INT       NOT NULL,
+    FOREIGN KEY (history_id) REFERENCES history (id)
+);
+INSERT INTO spotify_user_history_imported_new SELECT history_id, played_at, ms_played FROM spotify_user_history_imported;
+DROP TABLE spotify_user_history_imported;
+ALTER TABLE spotify_user_history_imported_new RENAME TO spotify_user_history_imported;
+
+DROP TABLE history_source;
+DROP TABLE spotify_user_history_item;
+DROP TABLE spotify_user_history_context;
+DROP TABLE spotify_user_history;
+`
+
+// Migrate applies the migrations db has not seen yet, each in its own
+// transaction.
+func Migrate(ctx context.Context, db *sql.DB) error {
+	var version int
+	err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+	for i := version; i < len(migrations); i++ {
+		err := migrate(ctx, db, i+1, migrations[i])
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", i+1, migrations[i].name, err)
+		}
+	}
+	return nil
+}
+
+func migrate(ctx context.Context, db *sql.DB, version int, m migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	needed, err := m.needed(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if needed {
+		logger.Printf("running migration %d: %s", version, m.name)
+		_, err = tx.ExecContext(ctx, m.sql)
+		if err != nil {
+			return err
+		}
+	}
+	// PRAGMA doesn't take parameters
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", version))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func tableExists(name string) func(ctx context.Context, tx *sql.Tx) (bool, error) {
+	return func(ctx context.Context, tx *sql.Tx) (bool, error) {
+		var count int
+		err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", name).Scan(&count)
+		return count > 0, err
+	}
+}
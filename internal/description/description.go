@@ -0,0 +1,458 @@
+package description
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"stravafy/internal/database"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// Marker is searched for in activity descriptions to tell whether an activity
+// has already been processed.
+const Marker = "stravafy.servebeer.com"
+
+// Footer is appended to every generated description that does not mention
+// Marker by itself, unless the activity has a public page to link instead.
+const Footer = "--" + Marker
+
+// MaxLength is the longest description written back to Strava.
+const MaxLength = 4000
+
+const (
+	// maxOutput is how much a template may write before it is stopped, the
+	// result is truncated to MaxLength characters afterwards anyway.
+	maxOutput = 16 * MaxLength
+	// maxRenderTime is how long a template may run.
+	maxRenderTime = time.Second
+)
+
+var (
+	ErrOutputTooLong = fmt.Errorf("the template writes more than %d bytes", maxOutput)
+	ErrRenderTimeout = fmt.Errorf("the template runs longer than %s", maxRenderTime)
+)
+
+// Default reproduces the original format: the playlist, if exactly one
+// playlist was played during the activity. Otherwise it falls back to the
+// track list.
+const Default = `{{if .Playlist}}{{with .Playlist}}Playlist: {{.Name}}
+By: {{.Owner}}
+{{.Url}}
+
+{{$.Footer}}{{end}}{{else if .Plays}}{{.Tracklist}}{{end}}`
+
+type Activity struct {
+	Name        string
+	SportType   string
+	StartDate   time.Time
+	ElapsedTime time.Duration
+	Distance    float64
+	Laps        []Interval
+	Splits      []Interval
+	// Streams are optional, without them all Metrics are zero.
+	Streams *Streams
+}
+
+type Track struct {
+	HistoryID int64
+	Source    string
+	Name      string
+	Artists   string
+	Album     string
+	Uri       string
+	Url       string
+	Offset    time.Duration
+	Duration  time.Duration
+	Metrics   Metrics
+}
+
+type Episode struct {
+	HistoryID int64
+	Source    string
+	Name      string
+	Show      string
+	Uri       string
+	Url       string
+	Offset    time.Duration
+	Duration  time.Duration
+}
+
+type Count struct {
+	Name     string
+	Plays    int
+	Duration time.Duration
+}
+
+type Context struct {
+	// Source is the music source the context belongs to.
+	Source   string
+	Type     string
+	Uri      string
+	Url      string
+	Href     string
+	Name     string
+	Owner    string
+	Plays    int
+	Duration time.Duration
+}
+
+// Data is what description templates are executed with.
+type Data struct {
+	Activity Activity
+	Tracks   []Track
+	Episodes []Episode
+	Artists  []Count
+	Albums   []Count
+	Contexts []Context
+	// Sources are the music sources that contributed, in order of first
+	// appearance.
+	Sources []string
+	// Playlist is set if the only context played was a playlist.
+	Playlist *Context
+	// ActivityPlaylist is the url of the Spotify playlist created from the
+	// activity, if there is one.
+	ActivityPlaylist string
+	// ShareUrl is the public page of the activity if it is linked from the
+	// description.
+	ShareUrl string
+	Laps     []Segment
+	Splits   []Segment
+	Plays    int
+	Duration time.Duration
+	// Limit is the number of characters left in the activity description,
+	// zero means no limit.
+	Limit int
+}
+
+var funcs = template.FuncMap{
+	"duration": FormatDuration,
+	"join":     strings.Join,
+	"inc":      func(i int) int { return i + 1 },
+	// checkDeadline is called at the start of every loop iteration and
+	// template call, see limitLoops. Render replaces it.
+	"checkDeadline": func() (string, error) { return "", nil },
+}
+
+// checkDeadlineNode is an action calling checkDeadline.
+var checkDeadlineNode = template.Must(template.New("").Funcs(funcs).Parse("{{checkDeadline}}")).Tree.Root.Nodes[0]
+
+// Build collects the template data for activity from the history entries
+// recorded during it. entries have to be ordered by timestamp.
+func Build(activity Activity, entries []database.GetHistoryEntriesBetweenRow) Data {
+	data := Data{Activity: activity}
+	end := activity.StartDate.Add(activity.ElapsedTime)
+	artists := newCounter()
+	albums := newCounter()
+	contexts := make(map[string]int)
+	for i, entry := range entries {
+		if !entry.IsPlaying || !entry.ItemUri.Valid {
+			continue
+		}
+		until := end
+		if i+1 < len(entries) {
+			until = entries[i+1].Timestamp
+		}
+		duration := until.Sub(entry.Timestamp)
+		offset := entry.Timestamp.Sub(activity.StartDate)
+		data.Plays++
+		data.Duration += duration
+		if !slices.Contains(data.Sources, entry.Source) {
+			data.Sources = append(data.Sources, entry.Source)
+		}
+
+		switch entry.ItemType.String {
+		case "episode":
+			data.Episodes = append(data.Episodes, Episode{
+				HistoryID: entry.ID,
+				Source:    entry.Source,
+				Name:      entry.Name.String,
+				Show:      entry.EpisodeShowName.String,
+				Uri:       entry.ItemUri.String,
+				Url:       entry.ItemExternalUrl.String,
+				Offset:    offset,
+				Duration:  duration,
+			})
+		default:
+			data.Tracks = append(data.Tracks, Track{
+				HistoryID: entry.ID,
+				Source:    entry.Source,
+				Name:      entry.Name.String,
+				Artists:   entry.Artists.String,
+				Album:     entry.Album.String,
+				Uri:       entry.ItemUri.String,
+				Url:       entry.ItemExternalUrl.String,
+				Offset:    offset,
+				Duration:  duration,
+			})
+			for _, artist := range strings.Split(entry.Artists.String, ", ") {
+				artists.add(artist, duration)
+			}
+			albums.add(entry.Album.String, duration)
+		}
+
+		if !entry.CtxUri.Valid {
+			continue
+		}
+		idx, ok := contexts[entry.CtxUri.String]
+		if !ok {
+			idx = len(data.Contexts)
+			contexts[entry.CtxUri.String] = idx
+			data.Contexts = append(data.Contexts, Context{
+				Source: entry.Source,
+				Type:   entry.CtxType.String,
+				Uri:    entry.CtxUri.String,
+				Url:    entry.CtxExternalUrl.String,
+				Href:   entry.CtxHref.String,
+			})
+		}
+		data.Contexts[idx].Plays++
+		data.Contexts[idx].Duration += duration
+	}
+	data.Artists = artists.sorted()
+	data.Albums = albums.sorted()
+	applyStreams(activity.Streams, data.Tracks)
+	data.Laps = buildSegments(activity.Laps, data.Tracks, data.Episodes)
+	data.Splits = buildSegments(activity.Splits, data.Tracks, data.Episodes)
+	data.SetPlaylist()
+	return data
+}
+
+// SetPlaylist points Playlist at the only context if that is a playlist. It
+// has to be called again after the contexts were resolved.
+func (d *Data) SetPlaylist() {
+	d.Playlist = nil
+	if len(d.Contexts) == 1 && d.Contexts[0].Type == "playlist" {
+		d.Playlist = &d.Contexts[0]
+	}
+}
+
+// Attribution names the sources other than Spotify the plays came from,
+// for example "via Last.fm". It is empty if everything came from Spotify.
+func (d Data) Attribution() string {
+	var labels []string
+	for _, source := range d.Sources {
+		if source == "spotify" {
+			continue
+		}
+		label, ok := sourceLabels[source]
+		if !ok {
+			label = source
+		}
+		labels = append(labels, label)
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	return "via " + strings.Join(labels, ", ")
+}
+
+// Parse checks that text is a valid description template.
+func Parse(text string) (*template.Template, error) {
+	tmpl, err := template.New("description").Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tmpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		limitLoops(t.Tree.Root)
+		// templates can call each other recursively
+		t.Tree.Root.Nodes = append([]parse.Node{checkDeadlineNode}, t.Tree.Root.Nodes...)
+	}
+	return tmpl, nil
+}
+
+// limitLoops makes every range loop below node call checkDeadline first.
+// Loops that write nothing would run unchecked otherwise.
+func limitLoops(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			limitLoops(child)
+		}
+	case *parse.IfNode:
+		limitLoops(n.List)
+		limitLoops(n.ElseList)
+	case *parse.WithNode:
+		limitLoops(n.List)
+		limitLoops(n.ElseList)
+	case *parse.RangeNode:
+		limitLoops(n.List)
+		limitLoops(n.ElseList)
+		n.List.Nodes = append([]parse.Node{checkDeadlineNode}, n.List.Nodes...)
+	}
+}
+
+// Render executes the template text with data. An empty result means there
+// is nothing to add to the description. Templates that write more than
+// maxOutput bytes or run longer than maxRenderTime are rejected.
+func Render(text string, data Data) (string, error) {
+	tmpl, err := Parse(text)
+	if err != nil {
+		return "", err
+	}
+	deadline := time.Now().Add(maxRenderTime)
+	tmpl.Funcs(template.FuncMap{"checkDeadline": func() (string, error) {
+		if time.Now().After(deadline) {
+			return "", ErrRenderTimeout
+		}
+		return "", nil
+	}})
+	w := &limitedWriter{deadline: deadline}
+	err = tmpl.Execute(w, data)
+	if w.err != nil {
+		return "", w.err
+	}
+	if err != nil {
+		if errors.Is(err, ErrRenderTimeout) {
+			return "", ErrRenderTimeout
+		}
+		return "", err
+	}
+	result := w.buf.String()
+	if strings.TrimSpace(result) == "" {
+		return "", nil
+	}
+	if !data.signed(result) {
+		result = strings.TrimRight(result, "\n") + "\n\n" + data.Footer()
+	}
+	if data.Limit > 0 && len([]rune(result)) > data.Limit {
+		result = truncate(result, data.Limit, data.Footer())
+	}
+	return result, nil
+}
+
+// limitedWriter fails once more than maxOutput bytes were written or the
+// deadline passed.
+type limitedWriter struct {
+	buf      bytes.Buffer
+	deadline time.Time
+	err      error
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.err == nil && w.buf.Len()+len(p) > maxOutput {
+		w.err = ErrOutputTooLong
+	}
+	if w.err == nil && time.Now().After(w.deadline) {
+		w.err = ErrRenderTimeout
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.buf.Write(p)
+}
+
+// Footer links the public page of the activity, or Stravafy if there is
+// none.
+func (d Data) Footer() string {
+	if d.ShareUrl != "" {
+		return "--" + d.ShareUrl
+	}
+	return Footer
+}
+
+// signed reports whether text already links Stravafy or the public page.
+func (d Data) signed(text string) bool {
+	return strings.Contains(text, Marker) || (d.ShareUrl != "" && strings.Contains(text, d.ShareUrl))
+}
+
+// truncate shortens text to limit runes while keeping the footer.
+func truncate(text string, limit int, footer string) string {
+	suffix := "…\n\n" + footer
+	keep := limit - len([]rune(suffix))
+	if keep <= 0 {
+		return ""
+	}
+	return string([]rune(text)[:keep]) + suffix
+}
+
+// Sample returns data to preview templates with.
+func Sample() Data {
+	start := time.Date(2024, 5, 1, 7, 30, 0, 0, time.UTC)
+	data := Data{
+		Activity: Activity{
+			Name:        "Morning Run",
+			SportType:   "Run",
+			StartDate:   start,
+			ElapsedTime: 25 * time.Minute,
+			Distance:    5123.4,
+		},
+		Tracks: []Track{
+			{Name: "Harder, Better, Faster, Stronger", Artists: "Daft Punk", Album: "Discovery", Uri: "spotify:track:5W3cjX2J3tjhG8zb6u0qHn", Url: "https://open.spotify.com/track/5W3cjX2J3tjhG8zb6u0qHn", Offset: 0, Duration: 3*time.Minute + 44*time.Second},
+			{Name: "One More Time", Artists: "Daft Punk", Album: "Discovery", Uri: "spotify:track:0DiWol3AO6WpXZgp0goxAV", Url: "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV", Offset: 3*time.Minute + 44*time.Second, Duration: 5*time.Minute + 20*time.Second},
+			{Name: "Midnight City", Artists: "M83", Album: "Hurry Up, We're Dreaming", Uri: "spotify:track:6GyFP1nfCDB8lbD2bG0Hq9", Url: "https://open.spotify.com/track/6GyFP1nfCDB8lbD2bG0Hq9", Offset: 9*time.Minute + 4*time.Second, Duration: 4*time.Minute + 3*time.Second},
+		},
+		Sources: []string{"spotify"},
+		Contexts: []Context{
+			{Source: "spotify", Type: "playlist", Uri: "spotify:playlist:37i9dQZF1DX76t638V6CA8", Url: "https://open.spotify.com/playlist/37i9dQZF1DX76t638V6CA8", Name: "Running Mix", Owner: "Spotify", Plays: 3, Duration: 13*time.Minute + 7*time.Second},
+		},
+	}
+	data.Artists = []Count{
+		{Name: "Daft Punk", Plays: 2, Duration: 9*time.Minute + 4*time.Second},
+		{Name: "M83", Plays: 1, Duration: 4*time.Minute + 3*time.Second},
+	}
+	data.Albums = []Count{
+		{Name: "Discovery", Plays: 2, Duration: 9*time.Minute + 4*time.Second},
+		{Name: "Hurry Up, We're Dreaming", Plays: 1, Duration: 4*time.Minute + 3*time.Second},
+	}
+	data.Plays = 3
+	data.Duration = 13*time.Minute + 7*time.Second
+	data.Laps = buildSegments([]Interval{
+		{Name: "Lap 1", Distance: 2000, Offset: 0, ElapsedTime: 9 * time.Minute},
+		{Name: "Lap 2", Distance: 3123.4, Offset: 9 * time.Minute, ElapsedTime: 16 * time.Minute},
+	}, data.Tracks, nil)
+	data.SetPlaylist()
+	return data
+}
+
+type counter struct {
+	index  map[string]int
+	counts []Count
+}
+
+func newCounter() *counter {
+	return &counter{index: make(map[string]int)}
+}
+
+func (c *counter) add(name string, duration time.Duration) {
+	if name == "" {
+		return
+	}
+	idx, ok := c.index[name]
+	if !ok {
+		idx = len(c.counts)
+		c.index[name] = idx
+		c.counts = append(c.counts, Count{Name: name})
+	}
+	c.counts[idx].Plays++
+	c.counts[idx].Duration += duration
+}
+
+func (c *counter) sorted() []Count {
+	sort.SliceStable(c.counts, func(i, j int) bool {
+		return c.counts[i].Plays > c.counts[j].Plays
+	})
+	return c.counts
+}
+
+// FormatDuration formats d as m:ss, or h:mm:ss for an hour and longer.
+func FormatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	h := int(d / time.Hour)
+	m := int(d % time.Hour / time.Minute)
+	s := int(d % time.Minute / time.Second)
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%d:%02d", m, s)
+}
@@ -0,0 +1,156 @@
+package description
+
+import (
+	"database/sql"
+	"errors"
+	"stravafy/internal/database"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		data     Data
+		want     string
+	}{
+		{"empty", `{{if .Plays}}played{{end}}`, Data{}, ""},
+		{"footer", `{{.Activity.Name}}`, Data{Activity: Activity{Name: "Run"}}, "Run\n\n" + Footer},
+		{"signed", `Run --` + Marker, Data{}, "Run --" + Marker},
+		{"share url", `Run`, Data{ShareUrl: "https://example.com/a/x"}, "Run\n\n--https://example.com/a/x"},
+		{"range", `{{range .Tracks}}{{.Name}} {{end}}`, Data{Tracks: []Track{{Name: "a"}, {Name: "b"}}}, "a b \n\n" + Footer},
+		{"limit", `{{.Activity.Name}}`, Data{Activity: Activity{Name: strings.Repeat("x", 100)}, Limit: 50}, strings.Repeat("x", 50-len([]rune("…\n\n"+Footer))) + "…\n\n" + Footer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Render(tt.template, tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Render() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     error
+	}{
+		{"output", `{{range 10000000000}}x{{end}}`, ErrOutputTooLong},
+		{"silent loop", `{{range 10000000000}}{{end}}`, ErrRenderTimeout},
+		{"nested loop", `{{range 100000}}{{range 100000}}{{end}}{{end}}`, ErrRenderTimeout},
+		{"recursion", `{{define "a"}}{{template "b"}}{{template "b"}}{{end}}{{define "b"}}{{template "c"}}{{template "c"}}{{end}}` +
+			`{{define "c"}}{{range 100000}}{{end}}{{end}}{{range 100000}}{{template "a"}}{{end}}`, ErrRenderTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			_, err := Render(tt.template, Sample())
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Render() error = %v, want %v", err, tt.want)
+			}
+			if elapsed := time.Since(start); elapsed > 2*maxRenderTime {
+				t.Errorf("Render() took %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestRenderInvalid(t *testing.T) {
+	if _, err := Render(`{{.Nope}}`, Sample()); err == nil {
+		t.Error("rendered a template with an unknown field")
+	}
+	if _, err := Render(`{{if}}`, Sample()); err == nil {
+		t.Error("rendered a template that does not parse")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		text  string
+		limit int
+		want  string
+	}{
+		{"abcdefghij", 8, "abcd…\n\n-"},
+		{"äöüäöüäöüä", 8, "äöüä…\n\n-"},
+		{"abcdefghij", 4, ""},
+	}
+	for _, tt := range tests {
+		got := truncate(tt.text, tt.limit, "-")
+		if got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.text, tt.limit, got, tt.want)
+		}
+		if len([]rune(got)) > tt.limit {
+			t.Errorf("truncate(%q, %d) is %d characters long", tt.text, tt.limit, len([]rune(got)))
+		}
+	}
+}
+
+func historyEntry(id int64, at time.Time, name, artists, ctxUri string) database.GetHistoryEntriesBetweenRow {
+	return database.GetHistoryEntriesBetweenRow{
+		ID:        id,
+		Timestamp: at,
+		IsPlaying: true,
+		CtxType:   sql.NullString{String: "playlist", Valid: ctxUri != ""},
+		CtxUri:    sql.NullString{String: ctxUri, Valid: ctxUri != ""},
+		ItemType:  sql.NullString{String: "track", Valid: true},
+		ItemUri:   sql.NullString{String: "spotify:track:" + name, Valid: true},
+		Name:      sql.NullString{String: name, Valid: true},
+		Artists:   sql.NullString{String: artists, Valid: true},
+		Album:     sql.NullString{String: "Album", Valid: true},
+		Source:    "spotify",
+	}
+}
+
+func TestBuild(t *testing.T) {
+	start := time.Date(2024, 5, 1, 7, 0, 0, 0, time.UTC)
+	activity := Activity{
+		StartDate:   start,
+		ElapsedTime: 20 * time.Minute,
+		Laps: []Interval{
+			{Name: "Lap 1", ElapsedTime: 10 * time.Minute},
+			{Name: "Lap 2", Offset: 10 * time.Minute, ElapsedTime: 10 * time.Minute},
+		},
+	}
+	entries := []database.GetHistoryEntriesBetweenRow{
+		historyEntry(1, start, "a", "X, Y", "spotify:playlist:p"),
+		historyEntry(2, start.Add(4*time.Minute), "b", "X", "spotify:playlist:p"),
+		{ID: 3, Timestamp: start.Add(8 * time.Minute), Source: "spotify"},
+		historyEntry(4, start.Add(12*time.Minute), "c", "Y", "spotify:playlist:p"),
+	}
+	data := Build(activity, entries)
+	if data.Plays != 3 || len(data.Tracks) != 3 {
+		t.Fatalf("%d plays, %d tracks, want 3", data.Plays, len(data.Tracks))
+	}
+	// a play lasts until the next entry, the last one until the end
+	for i, want := range []time.Duration{4 * time.Minute, 4 * time.Minute, 8 * time.Minute} {
+		if data.Tracks[i].Duration != want {
+			t.Errorf("track %d lasted %s, want %s", i, data.Tracks[i].Duration, want)
+		}
+	}
+	if data.Duration != 16*time.Minute {
+		t.Errorf("duration = %s, want 16m", data.Duration)
+	}
+	artists := make(map[string]time.Duration)
+	for _, artist := range data.Artists {
+		artists[artist.Name] = artist.Duration
+	}
+	if len(artists) != 2 || artists["X"] != 8*time.Minute || artists["Y"] != 12*time.Minute {
+		t.Errorf("artists = %+v", data.Artists)
+	}
+	if data.Playlist == nil || data.Playlist.Plays != 3 {
+		t.Errorf("playlist = %+v", data.Playlist)
+	}
+	if len(data.Laps) != 2 || len(data.Laps[0].Tracks) != 2 || len(data.Laps[1].Tracks) != 1 {
+		t.Errorf("laps = %+v", data.Laps)
+	}
+	if len(data.Sources) != 1 || data.Attribution() != "" {
+		t.Errorf("sources = %v", data.Sources)
+	}
+}
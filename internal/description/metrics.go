@@ -0,0 +1,86 @@
+package description
+
+import (
+	"time"
+)
+
+// Streams are the samples recorded during an activity. Time holds the
+// seconds since the start, the other streams may be missing.
+type Streams struct {
+	Time      []float64
+	Heartrate []float64
+	Speed     []float64
+	Watts     []float64
+	Cadence   []float64
+}
+
+// Metrics are the averages of the streams while a track was playing.
+type Metrics struct {
+	Samples   int
+	HeartRate float64
+	// Speed in meters per second.
+	Speed   float64
+	Watts   float64
+	Cadence float64
+	// Effort compares the track to the whole activity: the average power,
+	// or speed if there is no power meter, divided by the activity's.
+	Effort float64
+}
+
+// Pace formats Speed as minutes per kilometre.
+func (m Metrics) Pace() string {
+	if m.Speed <= 0 {
+		return "-"
+	}
+	pace := time.Duration(1000 / m.Speed * float64(time.Second))
+	return FormatDuration(pace) + " /km"
+}
+
+func (s *Streams) average(from, to time.Duration) Metrics {
+	var m Metrics
+	var heartrate, speed, watts, cadence float64
+	for i, t := range s.Time {
+		offset := time.Duration(t * float64(time.Second))
+		if offset < from || offset >= to {
+			continue
+		}
+		m.Samples++
+		heartrate += sample(s.Heartrate, i)
+		speed += sample(s.Speed, i)
+		watts += sample(s.Watts, i)
+		cadence += sample(s.Cadence, i)
+	}
+	if m.Samples == 0 {
+		return m
+	}
+	n := float64(m.Samples)
+	m.HeartRate = heartrate / n
+	m.Speed = speed / n
+	m.Watts = watts / n
+	m.Cadence = cadence / n
+	return m
+}
+
+func sample(stream []float64, i int) float64 {
+	if i < len(stream) {
+		return stream[i]
+	}
+	return 0
+}
+
+func applyStreams(streams *Streams, tracks []Track) {
+	if streams == nil || len(streams.Time) == 0 {
+		return
+	}
+	total := streams.average(0, time.Duration(streams.Time[len(streams.Time)-1]+1)*time.Second)
+	for i := range tracks {
+		m := streams.average(tracks[i].Offset, tracks[i].Offset+tracks[i].Duration)
+		switch {
+		case total.Watts > 0:
+			m.Effort = m.Watts / total.Watts
+		case total.Speed > 0:
+			m.Effort = m.Speed / total.Speed
+		}
+		tracks[i].Metrics = m
+	}
+}
@@ -0,0 +1,78 @@
+package description
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Interval is a part of an activity, a lap or a distance split.
+type Interval struct {
+	Name        string
+	Distance    float64
+	Offset      time.Duration
+	ElapsedTime time.Duration
+}
+
+// Segment is an Interval together with everything that played during it.
+type Segment struct {
+	Interval
+	Tracks   []Track
+	Episodes []Episode
+}
+
+func buildSegments(intervals []Interval, tracks []Track, episodes []Episode) []Segment {
+	segments := make([]Segment, 0, len(intervals))
+	for _, interval := range intervals {
+		segment := Segment{Interval: interval}
+		for _, track := range tracks {
+			if interval.overlaps(track.Offset, track.Duration) {
+				segment.Tracks = append(segment.Tracks, track)
+			}
+		}
+		for _, episode := range episodes {
+			if interval.overlaps(episode.Offset, episode.Duration) {
+				segment.Episodes = append(segment.Episodes, episode)
+			}
+		}
+		segments = append(segments, segment)
+	}
+	return segments
+}
+
+func (i Interval) overlaps(offset, duration time.Duration) bool {
+	return offset < i.Offset+i.ElapsedTime && offset+duration > i.Offset
+}
+
+// LapSoundtrack lists what played during each lap.
+func (d Data) LapSoundtrack() string {
+	return segmentList("Laps", d.Laps)
+}
+
+// SplitSoundtrack lists what played during each kilometre.
+func (d Data) SplitSoundtrack() string {
+	return segmentList("Splits", d.Splits)
+}
+
+func segmentList(title string, segments []Segment) string {
+	if len(segments) == 0 {
+		return ""
+	}
+	var list strings.Builder
+	list.WriteString(title)
+	list.WriteString(":\n")
+	for _, segment := range segments {
+		var names []string
+		for _, track := range segment.Tracks {
+			names = append(names, track.Name)
+		}
+		for _, episode := range segment.Episodes {
+			names = append(names, episode.Name)
+		}
+		if len(names) == 0 {
+			names = append(names, "-")
+		}
+		fmt.Fprintf(&list, "%s (%s): %s\n", segment.Name, FormatDuration(segment.ElapsedTime), strings.Join(names, ", "))
+	}
+	return list.String()
+}
@@ -0,0 +1,109 @@
+package description
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var sourceLabels = map[string]string{
+	"spotify":      "Spotify",
+	"lastfm":       "Last.fm",
+	"listenbrainz": "ListenBrainz",
+	"local":        "local players",
+}
+
+var contextLabels = map[string]string{
+	"playlist":   "Playlist",
+	"album":      "Album",
+	"artist":     "Artist",
+	"show":       "Show",
+	"collection": "Liked Songs",
+}
+
+// Tracklist lists everything played during the activity with its offset from
+// the start, preceded by a summary per context. Tracks at the end are left out
+// if the list would not fit into Limit.
+func (d Data) Tracklist() string {
+	var header strings.Builder
+	if attribution := d.Attribution(); attribution != "" {
+		fmt.Fprintf(&header, "Soundtrack (%d plays, %s, %s):\n", d.Plays, FormatDuration(d.Duration), attribution)
+	} else {
+		fmt.Fprintf(&header, "Soundtrack (%d plays, %s):\n", d.Plays, FormatDuration(d.Duration))
+	}
+	for _, ctx := range d.Contexts {
+		header.WriteString(ctx.summary())
+		header.WriteString("\n")
+	}
+	lines := d.lines()
+	footer := "\n" + d.Footer()
+
+	for n := len(lines); n >= 0; n-- {
+		var list strings.Builder
+		list.WriteString(header.String())
+		list.WriteString("\n")
+		for _, line := range lines[:n] {
+			list.WriteString(line)
+			list.WriteString("\n")
+		}
+		if n < len(lines) {
+			fmt.Fprintf(&list, "…and %d more\n", len(lines)-n)
+		}
+		list.WriteString(footer)
+		if d.Limit <= 0 || len([]rune(list.String())) <= d.Limit {
+			return list.String()
+		}
+	}
+	// not even the summary fits, Render cuts it down
+	return header.String() + footer
+}
+
+func (c Context) summary() string {
+	label, ok := contextLabels[c.Type]
+	if !ok {
+		label = c.Type
+	}
+	name := c.Name
+	if name == "" {
+		name = c.Url
+	}
+	if c.Owner != "" {
+		name += " by " + c.Owner
+	}
+	if c.Type == "collection" {
+		return fmt.Sprintf("%s (%d plays, %s)", label, c.Plays, FormatDuration(c.Duration))
+	}
+	return fmt.Sprintf("%s: %s (%d plays, %s)", label, name, c.Plays, FormatDuration(c.Duration))
+}
+
+type line struct {
+	offset time.Duration
+	text   string
+}
+
+func (d Data) lines() []string {
+	var items []line
+	for _, track := range d.Tracks {
+		text := track.Name
+		if track.Artists != "" {
+			text += " - " + track.Artists
+		}
+		items = append(items, line{track.Offset, text})
+	}
+	for _, episode := range d.Episodes {
+		text := episode.Name
+		if episode.Show != "" {
+			text += " - " + episode.Show
+		}
+		items = append(items, line{episode.Offset, text})
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].offset < items[j].offset
+	})
+	lines := make([]string, 0, len(items))
+	for _, item := range items {
+		lines = append(lines, fmt.Sprintf("%s %s", FormatDuration(item.offset), item.text))
+	}
+	return lines
+}
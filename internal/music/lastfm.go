@@ -0,0 +1,189 @@
+package music
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"stravafy/internal/config"
+	"strconv"
+	"time"
+)
+
+const (
+	lastfmApi      = "https://ws.audioscrobbler.com/2.0/"
+	lastfmPageSize = 200
+	lastfmMaxPages = 50
+)
+
+// Lastfm is the Source for the public scrobbles of a Last.fm user.
+type Lastfm struct {
+	username string
+	apiKey   string
+}
+
+// NewLastfm returns the Last.fm source of username.
+func NewLastfm(username string) *Lastfm {
+	return &Lastfm{username: username, apiKey: config.GetConfig().Scrobbles.LastfmApiKey}
+}
+
+func (l *Lastfm) Name() string {
+	return SourceLastfm
+}
+
+// NowPlaying always returns nil, scrobbles are only picked up once they
+// are complete.
+func (l *Lastfm) NowPlaying(ctx context.Context) (*Play, error) {
+	return nil, nil
+}
+
+// RecentPlays pages through the scrobbles since after, oldest first and at
+// most lastfmMaxPages at a time. Scrobbles carry the time a track started
+// playing but no duration.
+func (l *Lastfm) RecentPlays(ctx context.Context, after time.Time) ([]Play, error) {
+	first, err := l.recentTracks(ctx, after, 1)
+	if err != nil {
+		return nil, err
+	}
+	pages, _ := strconv.Atoi(first.Attr.TotalPages)
+	var plays []Play
+	for page := pages; page >= 1 && page > pages-lastfmMaxPages; page-- {
+		list := first
+		if page > 1 {
+			list, err = l.recentTracks(ctx, after, page)
+			if err != nil {
+				return nil, err
+			}
+		}
+		tracks, err := list.tracks()
+		if err != nil {
+			return nil, err
+		}
+		for _, track := range tracks {
+			if track.Attr.NowPlaying == "true" || track.Date.Uts == "" {
+				continue
+			}
+			uts, err := strconv.ParseInt(track.Date.Uts, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid scrobble time %q: %v", track.Date.Uts, err)
+			}
+			start := time.Unix(uts, 0).UTC()
+			plays = append(plays, Play{
+				Start:    start,
+				PlayedAt: start,
+				Item: Item{
+					Type:    "track",
+					Href:    track.Url,
+					Url:     track.Url,
+					Uri:     track.Url,
+					Name:    track.Name,
+					Artists: []string{track.Artist.Text},
+					Album:   track.Album.Text,
+				},
+			})
+		}
+	}
+	sort.SliceStable(plays, func(i, j int) bool {
+		return plays[i].Start.Before(plays[j].Start)
+	})
+	return plays, nil
+}
+
+func (l *Lastfm) recentTracks(ctx context.Context, after time.Time, page int) (lastfmTrackList, error) {
+	var resp lastfmRecentTracks
+	err := l.call(ctx, url.Values{
+		"method": {"user.getrecenttracks"},
+		"user":   {l.username},
+		"from":   {strconv.FormatInt(after.Unix()+1, 10)},
+		"limit":  {strconv.Itoa(lastfmPageSize)},
+		"page":   {strconv.Itoa(page)},
+	}, &resp)
+	return resp.RecentTracks, err
+}
+
+// ContextDetails always fails, scrobbles are not played from a context.
+func (l *Lastfm) ContextDetails(ctx context.Context, c Context) (*ContextDetails, error) {
+	return nil, ErrContextNotFound
+}
+
+// CheckLastfmUser makes sure username exists on Last.fm.
+func CheckLastfmUser(ctx context.Context, username string) error {
+	l := NewLastfm(username)
+	var resp struct{}
+	return l.call(ctx, url.Values{
+		"method": {"user.getinfo"},
+		"user":   {username},
+	}, &resp)
+}
+
+func (l *Lastfm) call(ctx context.Context, values url.Values, v any) error {
+	values.Set("api_key", l.apiKey)
+	values.Set("format", "json")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, lastfmApi+"?"+values.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var lastfmErr lastfmError
+		if json.NewDecoder(resp.Body).Decode(&lastfmErr) == nil && lastfmErr.Message != "" {
+			return fmt.Errorf("last.fm %s: %s", values.Get("method"), lastfmErr.Message)
+		}
+		return fmt.Errorf("last.fm %s returned with HTTP %d %s", values.Get("method"), resp.StatusCode, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type lastfmError struct {
+	Error   int    `json:"error"`
+	Message string `json:"message"`
+}
+
+type lastfmText struct {
+	Text string `json:"#text"`
+}
+
+type lastfmTrack struct {
+	Name   string     `json:"name"`
+	Url    string     `json:"url"`
+	Artist lastfmText `json:"artist"`
+	Album  lastfmText `json:"album"`
+	Date   struct {
+		Uts string `json:"uts"`
+	} `json:"date"`
+	Attr struct {
+		NowPlaying string `json:"nowplaying"`
+	} `json:"@attr"`
+}
+
+type lastfmRecentTracks struct {
+	RecentTracks lastfmTrackList `json:"recenttracks"`
+}
+
+type lastfmTrackList struct {
+	// Track is a list, or a single object if there is only one
+	Track json.RawMessage `json:"track"`
+	Attr  struct {
+		TotalPages string `json:"totalPages"`
+	} `json:"@attr"`
+}
+
+func (l lastfmTrackList) tracks() ([]lastfmTrack, error) {
+	if len(l.Track) == 0 {
+		return nil, nil
+	}
+	var tracks []lastfmTrack
+	if l.Track[0] == '[' {
+		err := json.Unmarshal(l.Track, &tracks)
+		return tracks, err
+	}
+	var track lastfmTrack
+	err := json.Unmarshal(l.Track, &track)
+	return append(tracks, track), err
+}
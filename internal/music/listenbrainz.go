@@ -0,0 +1,188 @@
+package music
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	listenBrainzApi       = "https://api.listenbrainz.org/1/"
+	listenBrainzPageSize  = 1000
+	listenBrainzMaxPages  = 50
+	musicBrainzRecordings = "https://musicbrainz.org/recording/"
+)
+
+// ListenBrainz is the Source for the listens of a ListenBrainz user.
+type ListenBrainz struct {
+	username string
+	token    string
+}
+
+// NewListenBrainz returns the ListenBrainz source of username. The token
+// is optional, listens are public.
+func NewListenBrainz(username string, token string) *ListenBrainz {
+	return &ListenBrainz{username: username, token: token}
+}
+
+func (l *ListenBrainz) Name() string {
+	return SourceListenBrainz
+}
+
+// NowPlaying always returns nil, listens are only picked up once they are
+// submitted.
+func (l *ListenBrainz) NowPlaying(ctx context.Context) (*Play, error) {
+	return nil, nil
+}
+
+// RecentPlays pages through the listens since after. Listens that came from
+// Spotify keep their Spotify uri, so they match what the poller recorded.
+func (l *ListenBrainz) RecentPlays(ctx context.Context, after time.Time) ([]Play, error) {
+	var plays []Play
+	minTs := after.Unix()
+	for page := 0; page < listenBrainzMaxPages; page++ {
+		var resp listenBrainzListens
+		values := url.Values{
+			"min_ts": {strconv.FormatInt(minTs, 10)},
+			"count":  {strconv.Itoa(listenBrainzPageSize)},
+		}
+		err := l.call(ctx, "user/"+url.PathEscape(l.username)+"/listens?"+values.Encode(), &resp)
+		if err != nil {
+			return nil, err
+		}
+		for _, listen := range resp.Payload.Listens {
+			plays = append(plays, listen.Play())
+			minTs = max(minTs, listen.ListenedAt)
+		}
+		if len(resp.Payload.Listens) < listenBrainzPageSize {
+			break
+		}
+	}
+	sort.SliceStable(plays, func(i, j int) bool {
+		return plays[i].Start.Before(plays[j].Start)
+	})
+	return plays, nil
+}
+
+// ContextDetails always fails, listens are not played from a context.
+func (l *ListenBrainz) ContextDetails(ctx context.Context, c Context) (*ContextDetails, error) {
+	return nil, ErrContextNotFound
+}
+
+// ListenBrainzUser returns the name of the user token belongs to.
+func ListenBrainzUser(ctx context.Context, token string) (string, error) {
+	l := NewListenBrainz("", token)
+	var resp struct {
+		Valid    bool   `json:"valid"`
+		UserName string `json:"user_name"`
+	}
+	err := l.call(ctx, "validate-token", &resp)
+	if err != nil {
+		return "", err
+	}
+	if !resp.Valid {
+		return "", fmt.Errorf("invalid listenbrainz token")
+	}
+	return resp.UserName, nil
+}
+
+func (l *ListenBrainz) call(ctx context.Context, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, listenBrainzApi+path, nil)
+	if err != nil {
+		return err
+	}
+	if l.token != "" {
+		req.Header.Set("Authorization", "Token "+l.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("listenbrainz %s returned with HTTP %d %s", strings.SplitN(path, "?", 2)[0], resp.StatusCode, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type listenBrainzListens struct {
+	Payload struct {
+		Listens []ListenBrainzListen `json:"listens"`
+	} `json:"payload"`
+}
+
+// ListenBrainzListen is a listen in the format of the ListenBrainz API.
+type ListenBrainzListen struct {
+	ListenedAt    int64  `json:"listened_at"`
+	RecordingMsid string `json:"recording_msid"`
+	TrackMetadata struct {
+		ArtistName     string `json:"artist_name"`
+		TrackName      string `json:"track_name"`
+		ReleaseName    string `json:"release_name"`
+		AdditionalInfo struct {
+			DurationMs    int64  `json:"duration_ms"`
+			Duration      int64  `json:"duration"`
+			SpotifyID     string `json:"spotify_id"`
+			OriginUrl     string `json:"origin_url"`
+			RecordingMbid string `json:"recording_mbid"`
+		} `json:"additional_info"`
+		MbidMapping *struct {
+			RecordingMbid string `json:"recording_mbid"`
+		} `json:"mbid_mapping"`
+	} `json:"track_metadata"`
+}
+
+// webUrl reports whether s is an absolute http or https url. Listens are
+// submitted by clients, so anything else must not become a link.
+func webUrl(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Play converts the listen to a play, preferring a Spotify uri over a
+// MusicBrainz one so it matches what the Spotify poller recorded.
+func (l ListenBrainzListen) Play() Play {
+	meta := l.TrackMetadata
+	start := time.Unix(l.ListenedAt, 0).UTC()
+	duration := time.Duration(meta.AdditionalInfo.DurationMs) * time.Millisecond
+	if duration == 0 {
+		duration = time.Duration(meta.AdditionalInfo.Duration) * time.Second
+	}
+	mbid := meta.AdditionalInfo.RecordingMbid
+	if meta.MbidMapping != nil && meta.MbidMapping.RecordingMbid != "" {
+		mbid = meta.MbidMapping.RecordingMbid
+	}
+	item := Item{
+		Type:     "track",
+		Name:     meta.TrackName,
+		Artists:  []string{meta.ArtistName},
+		Album:    meta.ReleaseName,
+		Duration: duration,
+	}
+	switch {
+	case strings.HasPrefix(meta.AdditionalInfo.SpotifyID, "https://open.spotify.com/track/"):
+		id := strings.TrimPrefix(meta.AdditionalInfo.SpotifyID, "https://open.spotify.com/track/")
+		spotify := SpotifyItem("track", "spotify:track:"+id, meta.TrackName)
+		item.Href, item.Url, item.Uri = spotify.Href, spotify.Url, spotify.Uri
+	case mbid != "":
+		item.Url = musicBrainzRecordings + mbid
+		item.Href, item.Uri = item.Url, "musicbrainz:recording:"+mbid
+	case webUrl(meta.AdditionalInfo.OriginUrl):
+		item.Href, item.Url, item.Uri = meta.AdditionalInfo.OriginUrl, meta.AdditionalInfo.OriginUrl, meta.AdditionalInfo.OriginUrl
+	case l.RecordingMsid != "":
+		item.Uri = "listenbrainz:msid:" + l.RecordingMsid
+	default:
+		item.Uri = "listen:" + url.PathEscape(meta.ArtistName) + ":" + url.PathEscape(meta.TrackName)
+	}
+	return Play{
+		Start:    start,
+		PlayedAt: start.Add(duration),
+		Item:     item,
+	}
+}
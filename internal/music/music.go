@@ -0,0 +1,102 @@
+package music
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"stravafy/internal/database"
+	"time"
+)
+
+const (
+	SourceSpotify      = "spotify"
+	SourceLastfm       = "lastfm"
+	SourceListenBrainz = "listenbrainz"
+	// SourceLocal are listens submitted by players themselves.
+	SourceLocal = "local"
+)
+
+var ErrContextNotFound = errors.New("context not found")
+
+// Source is a service that knows what a user listens to.
+type Source interface {
+	// Name identifies the source in the history.
+	Name() string
+	// NowPlaying returns what is playing right now, nil if nothing is.
+	NowPlaying(ctx context.Context) (*Play, error)
+	// RecentPlays returns the plays that finished after after, oldest first.
+	RecentPlays(ctx context.Context, after time.Time) ([]Play, error)
+	// ContextDetails looks up the name and owner of a playlist, album, etc.
+	// It returns ErrContextNotFound if the context does not exist (anymore).
+	ContextDetails(ctx context.Context, c Context) (*ContextDetails, error)
+}
+
+// New returns the source called name for userID.
+func New(name string, q *database.Queries, userID int64) (Source, error) {
+	switch name {
+	case SourceSpotify:
+		return NewSpotify(q, userID), nil
+	case SourceLastfm, SourceListenBrainz:
+		account, err := q.GetMusicAccount(context.Background(), database.GetMusicAccountParams{
+			UserID: userID,
+			Source: name,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if name == SourceLastfm {
+			return NewLastfm(account.Username), nil
+		}
+		return NewListenBrainz(account.Username, account.Token.String), nil
+	}
+	return nil, fmt.Errorf("unknown music source %q", name)
+}
+
+// Play is an item played by a user.
+type Play struct {
+	// Start is when the item started playing. For now playing items it is
+	// when the player state was last updated.
+	Start time.Time
+	// PlayedAt is when a recent play finished. It is zero for now playing
+	// items.
+	PlayedAt time.Time
+	Context  *Context
+	Item     Item
+}
+
+// Item is a track or a podcast episode.
+type Item struct {
+	// Type is "track" or "episode".
+	Type     string
+	Href     string
+	Url      string
+	Uri      string
+	Name     string
+	Artists  []string
+	Album    string
+	AlbumUri string
+	Duration time.Duration
+	// Episode is only set for episodes.
+	Episode *Episode
+}
+
+type Episode struct {
+	Description     string
+	Show            string
+	ShowDescription string
+	ShowUri         string
+}
+
+// Context is what an item was played from, a playlist or an album for
+// example.
+type Context struct {
+	Type string
+	Href string
+	Url  string
+	Uri  string
+}
+
+type ContextDetails struct {
+	Name  string
+	Owner string
+}
@@ -0,0 +1,293 @@
+package music
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/oauth2"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"stravafy/internal/database"
+	"stravafy/internal/tokens"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Spotify is the Source for a Spotify account.
+type Spotify struct {
+	client *http.Client
+}
+
+// NewSpotify returns the Spotify source of userID.
+func NewSpotify(q *database.Queries, userID int64) *Spotify {
+	return &Spotify{client: oauth2.NewClient(context.Background(), tokens.Spotify(q, userID))}
+}
+
+func (s *Spotify) Name() string {
+	return SourceSpotify
+}
+
+func (s *Spotify) NowPlaying(ctx context.Context) (*Play, error) {
+	resp, err := s.get(ctx, "https://api.spotify.com/v1/me/player?additional_types=track,episode")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("player returned with HTTP %d %s", resp.StatusCode, resp.Status)
+	}
+	var playerState PlayerState
+	err = json.NewDecoder(resp.Body).Decode(&playerState)
+	if err != nil {
+		return nil, fmt.Errorf("could not serialize response: %v", err)
+	}
+	if !playerState.IsPlaying {
+		return nil, nil
+	}
+	var item ItemObject
+	err = json.Unmarshal(playerState.Item, &item)
+	if err != nil {
+		return nil, fmt.Errorf("could not serialize item: %v", err)
+	}
+	play := &Play{
+		Start:   time.UnixMilli(playerState.Timestamp).UTC(),
+		Context: playerState.Context.context(),
+	}
+	switch item.Type {
+	case "track":
+		var track TrackObject
+		err := json.Unmarshal(playerState.Item, &track)
+		if err != nil {
+			return nil, err
+		}
+		play.Item = track.item()
+	case "episode":
+		var episode EpisodeObject
+		err := json.Unmarshal(playerState.Item, &episode)
+		if err != nil {
+			return nil, err
+		}
+		play.Item = episode.item()
+	default:
+		return nil, fmt.Errorf("looking for type \"track\" or \"episode\" found %s", item.Type)
+	}
+	return play, nil
+}
+
+// RecentPlays pages through /me/player/recently-played. Spotify only
+// remembers the last 50 tracks and no episodes at all.
+func (s *Spotify) RecentPlays(ctx context.Context, after time.Time) ([]Play, error) {
+	var plays []Play
+	cursor := after.UnixMilli()
+	next := fmt.Sprintf("https://api.spotify.com/v1/me/player/recently-played?limit=50&after=%d", cursor)
+	for next != "" {
+		recentlyPlayed, err := s.recentlyPlayed(ctx, next)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range recentlyPlayed.Items {
+			playedAt := item.PlayedAt.UTC()
+			plays = append(plays, Play{
+				Start:    playedAt.Add(-time.Duration(item.Track.DurationMs) * time.Millisecond),
+				PlayedAt: playedAt,
+				Context:  item.Context.context(),
+				Item:     item.Track.item(),
+			})
+		}
+		if recentlyPlayed.Cursors == nil || recentlyPlayed.Cursors.After == "" {
+			break
+		}
+		newCursor, err := strconv.ParseInt(recentlyPlayed.Cursors.After, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recently played cursor %q: %v", recentlyPlayed.Cursors.After, err)
+		}
+		if newCursor <= cursor {
+			break
+		}
+		cursor = newCursor
+		next = recentlyPlayed.Next
+	}
+	// every page starts with the newest play
+	sort.SliceStable(plays, func(i, j int) bool {
+		return plays[i].PlayedAt.Before(plays[j].PlayedAt)
+	})
+	return plays, nil
+}
+
+func (s *Spotify) recentlyPlayed(ctx context.Context, url string) (*RecentlyPlayed, error) {
+	resp, err := s.get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bytes, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("recently played returned with HTTP %d %s: %s", resp.StatusCode, resp.Status, string(bytes))
+	}
+	var recentlyPlayed RecentlyPlayed
+	err = json.NewDecoder(resp.Body).Decode(&recentlyPlayed)
+	if err != nil {
+		return nil, err
+	}
+	return &recentlyPlayed, nil
+}
+
+func (s *Spotify) ContextDetails(ctx context.Context, c Context) (*ContextDetails, error) {
+	href := c.Href
+	if c.Type == "playlist" {
+		href += "?fields=name,owner.display_name"
+	}
+	resp, err := s.get(ctx, href)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrContextNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("getting %s returned with HTTP %d %s", c.Type, resp.StatusCode, resp.Status)
+	}
+	var details spotifyContext
+	err = json.NewDecoder(resp.Body).Decode(&details)
+	if err != nil {
+		return nil, err
+	}
+	return &ContextDetails{Name: details.Name, Owner: details.Owner.DisplayName}, nil
+}
+
+// Playlist is a playlist created on Spotify.
+type Playlist struct {
+	ID  string
+	Url string
+}
+
+// spotifyPlaylistPageSize is the most items added to a playlist at once.
+const spotifyPlaylistPageSize = 100
+
+// CreatePlaylist creates a private playlist for spotifyUserID with the
+// tracks and episodes in uris, in that order.
+func (s *Spotify) CreatePlaylist(ctx context.Context, spotifyUserID, name, description string, uris []string) (*Playlist, error) {
+	var created struct {
+		ID           string            `json:"id"`
+		ExternalUrls map[string]string `json:"external_urls"`
+	}
+	err := s.post(ctx, "https://api.spotify.com/v1/users/"+url.PathEscape(spotifyUserID)+"/playlists", map[string]any{
+		"name":        name,
+		"description": description,
+		"public":      false,
+	}, &created)
+	if err != nil {
+		return nil, err
+	}
+	for start := 0; start < len(uris); start += spotifyPlaylistPageSize {
+		end := min(start+spotifyPlaylistPageSize, len(uris))
+		err := s.post(ctx, "https://api.spotify.com/v1/playlists/"+created.ID+"/tracks", map[string]any{
+			"uris": uris[start:end],
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Playlist{ID: created.ID, Url: created.ExternalUrls["spotify"]}, nil
+}
+
+func (s *Spotify) post(ctx context.Context, url string, body any, v any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s returned with HTTP %d %s: %s", url, resp.StatusCode, resp.Status, string(msg))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (s *Spotify) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.client.Do(req)
+}
+
+// SpotifyItem builds an item from its uri when nothing but the name is
+// known, as in the streaming history export.
+func SpotifyItem(itemType string, uri string, name string) Item {
+	id := uri[strings.LastIndex(uri, ":")+1:]
+	return Item{
+		Type: itemType,
+		Href: fmt.Sprintf("https://api.spotify.com/v1/%ss/%s", itemType, id),
+		Url:  fmt.Sprintf("https://open.spotify.com/%s/%s", itemType, id),
+		Uri:  uri,
+		Name: name,
+	}
+}
+
+func (c *PlayerContext) context() *Context {
+	if c == nil {
+		return nil
+	}
+	return &Context{
+		Type: c.Type,
+		Href: c.Href,
+		Url:  c.ExternalUrls.Spotify,
+		Uri:  c.Uri,
+	}
+}
+
+func (i ItemObject) item() Item {
+	return Item{
+		Type:     i.Type,
+		Href:     i.Href,
+		Url:      i.ExternalUrls.Spotify,
+		Uri:      i.Uri,
+		Name:     i.Name,
+		Duration: time.Duration(i.DurationMs) * time.Millisecond,
+	}
+}
+
+func (t TrackObject) item() Item {
+	item := t.ItemObject.item()
+	for _, artist := range t.Artists {
+		item.Artists = append(item.Artists, artist.Name)
+	}
+	item.Album = t.Album.Name
+	item.AlbumUri = t.Album.Uri
+	return item
+}
+
+func (e EpisodeObject) item() Item {
+	item := e.ItemObject.item()
+	item.Episode = &Episode{
+		Description:     e.Description,
+		Show:            e.Show.Name,
+		ShowDescription: e.Show.Description,
+		ShowUri:         e.Show.Uri,
+	}
+	return item
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"stravafy/internal/api"
 	"stravafy/internal/api/auth"
+	"stravafy/internal/api/listens"
 	"stravafy/internal/api/pages"
 	"stravafy/internal/api/webhook"
 	"stravafy/internal/config"
@@ -30,15 +31,19 @@ func Init(queries *database.Queries) {
 	pagesService := pages.New(queries)
 	authService := auth.New(queries)
 	webhookService := webhook.New(queries)
+	listensService := listens.New(queries)
 
 	router = gin.Default()
 	router.HTMLRender = renderer.Default
 	router.Use(ErrorHandler())
-	router.Use(sessions.Middleware(queries))
 	router.StaticFS("/static", http.FS(assets))
-	pagesService.Mount(router.Group("/"))
-	authService.Mount(router.Group("/auth"))
+	// Strava and scrobblers never send a cookie, they would get a new
+	// session on every request
 	webhookService.Mount(router.Group("/callback"))
+	listensService.Mount(router.Group("/1"))
+	withSession := router.Group("/", sessions.Middleware(queries))
+	pagesService.Mount(withSession)
+	authService.Mount(withSession.Group("/auth"))
 
 	conf := config.GetConfig()
 
@@ -46,6 +51,7 @@ func Init(queries *database.Queries) {
 		Addr:    fmt.Sprintf("%s:%d", conf.Listen.Host, conf.Listen.Port),
 		Handler: router,
 	}
+	srv.RegisterOnShutdown(pagesService.CloseStreams)
 }
 
 func Run() error {
@@ -69,7 +75,9 @@ func ErrorHandler() gin.HandlerFunc {
 			switch {
 			case errors.Is(err, auth.ErrNotAuthorized),
 				errors.Is(err, auth.ErrMissingRequiredScopes),
-				errors.Is(err, auth.ErrTokenExchangeFailed):
+				errors.Is(err, auth.ErrTokenExchangeFailed),
+				errors.Is(err, sessions.ErrNotLoggedIn),
+				errors.Is(err, sessions.ErrSessionNotValid):
 				api.Error(c, http.StatusUnauthorized, err)
 			case errors.Is(err, auth.ErrBindingOauth2Callback),
 				errors.Is(err, auth.ErrStateNotSetCorrectly):
@@ -0,0 +1,104 @@
+package templates
+
+import (
+	"fmt"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"stravafy/internal/worker"
+	"sync"
+)
+
+var (
+	cardFontsOnce sync.Once
+	cardRegular   *opentype.Font
+	cardBold      *opentype.Font
+	cardFontsErr  error
+)
+
+var (
+	cardBackground = color.RGBA{0x12, 0x12, 0x12, 0xff}
+	cardOrange     = color.RGBA{0xfc, 0x4c, 0x02, 0xff}
+	cardGreen      = color.RGBA{0x1d, 0xb9, 0x54, 0xff}
+	cardGrey       = color.RGBA{0xb3, 0xb3, 0xb3, 0xff}
+)
+
+// card draws text on an image like the text elements of WrappedCard. The
+// first error is kept and later text is skipped.
+type card struct {
+	img *image.RGBA
+	err error
+}
+
+func (c *card) text(x, y int, size float64, bold bool, col color.Color, s string) {
+	if c.err != nil {
+		return
+	}
+	f := cardRegular
+	if bold {
+		f = cardBold
+	}
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		c.err = err
+		return
+	}
+	defer face.Close()
+	d := font.Drawer{
+		Dst:  c.img,
+		Src:  image.NewUniform(col),
+		Face: face,
+		Dot:  fixed.P(x, y),
+	}
+	d.DrawString(s)
+}
+
+// WrappedCardPNG draws the same card as WrappedCard as a PNG, which more
+// apps accept than SVG.
+func WrappedCardPNG(w io.Writer, wrapped *worker.Wrapped) error {
+	cardFontsOnce.Do(func() {
+		cardRegular, cardFontsErr = opentype.Parse(goregular.TTF)
+		if cardFontsErr == nil {
+			cardBold, cardFontsErr = opentype.Parse(gobold.TTF)
+		}
+	})
+	if cardFontsErr != nil {
+		return cardFontsErr
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 1080, 1080))
+	draw.Draw(img, img.Bounds(), image.NewUniform(cardBackground), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, 1080, 12), image.NewUniform(cardOrange), image.Point{}, draw.Src)
+
+	c := &card{img: img}
+	c.text(80, 140, 40, true, cardOrange, "STRAVAFY WRAPPED")
+	c.text(80, 250, 110, true, color.White, fmt.Sprint(wrapped.Year))
+	c.text(80, 330, 44, false, cardGreen, fmt.Sprintf("%s of music in %d activities", wrappedMinutes(wrapped.MusicTime), wrapped.Activities))
+	c.text(80, 440, 32, false, cardGrey, "TOP ARTISTS")
+	for i, artist := range wrapped.TopArtists {
+		c.text(80, 500+i*56, 38, false, color.White, fmt.Sprintf("%d. %s", i+1, wrappedTruncate(artist.Name, 20)))
+	}
+	c.text(560, 440, 32, false, cardGrey, "TOP TRACKS")
+	for i, track := range wrapped.TopTracks {
+		c.text(560, 500+i*56, 38, false, color.White, fmt.Sprintf("%d. %s", i+1, wrappedTruncate(track.Name, 20)))
+	}
+	if len(wrapped.PowerSongs) > 0 {
+		c.text(80, 860, 32, false, cardGrey, "POWER SONG")
+		c.text(80, 920, 44, true, color.White, wrappedTruncate(wrapped.PowerSongs[0].TrackName, 40))
+	}
+	footer := wrappedShare(wrapped.PodcastTime, wrapped.MusicTime+wrapped.PodcastTime) + " podcasts"
+	if len(wrapped.Sports) > 0 {
+		footer += " · mostly during " + wrapped.Sports[0].Name
+	}
+	c.text(80, 1010, 28, false, cardGrey, footer)
+	if c.err != nil {
+		return c.err
+	}
+	return png.Encode(w, img)
+}
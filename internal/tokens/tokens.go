@@ -0,0 +1,176 @@
+package tokens
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/oauth2"
+	"stravafy/internal/config"
+	"stravafy/internal/database"
+	"sync"
+	"time"
+)
+
+type provider string
+
+const (
+	providerSpotify provider = "spotify"
+	providerStrava  provider = "strava"
+)
+
+type key struct {
+	provider provider
+	userID   int64
+}
+
+var (
+	sourcesMu sync.Mutex
+	sources   = make(map[key]*tokenSource)
+)
+
+// tokenSource is an oauth2.TokenSource that keeps the database in sync with
+// every refresh. There is only one per provider and user, so concurrent
+// refreshes cannot race each other with the same (rotated) refresh token.
+type tokenSource struct {
+	mu     sync.Mutex
+	userID int64
+	q      *database.Queries
+	conf   oauth2.Config
+	token  *oauth2.Token
+	load   func(ctx context.Context, q *database.Queries, userID int64) (*oauth2.Token, error)
+	save   func(ctx context.Context, q *database.Queries, userID int64, old, new *oauth2.Token) error
+}
+
+// Spotify returns the database backed token source for the Spotify account of userID.
+func Spotify(q *database.Queries, userID int64) oauth2.TokenSource {
+	return get(key{providerSpotify, userID}, func() *tokenSource {
+		return &tokenSource{
+			userID: userID,
+			q:      q,
+			conf:   config.GetSpotifyOauthConfig(),
+			load:   loadSpotify,
+			save:   saveSpotify,
+		}
+	})
+}
+
+// Strava returns the database backed token source for the Strava account of userID.
+func Strava(q *database.Queries, userID int64) oauth2.TokenSource {
+	return get(key{providerStrava, userID}, func() *tokenSource {
+		return &tokenSource{
+			userID: userID,
+			q:      q,
+			conf:   config.GetStravaOauthConfig(),
+			load:   loadStrava,
+			save:   saveStrava,
+		}
+	})
+}
+
+func get(k key, create func() *tokenSource) *tokenSource {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+	s, ok := sources[k]
+	if !ok {
+		s = create()
+		sources[k] = s
+	}
+	return s
+}
+
+// Forget drops the cached tokens of userID, after the user revoked access
+// for example.
+func Forget(userID int64) {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+	delete(sources, key{providerSpotify, userID})
+	delete(sources, key{providerStrava, userID})
+}
+
+func (s *tokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token.Valid() {
+		return s.token, nil
+	}
+	// the token may have been replaced by a new login in the meantime
+	token, err := s.load(context.Background(), s.q, s.userID)
+	if err != nil {
+		return nil, fmt.Errorf("loading token for user %d: %w", s.userID, err)
+	}
+	if token.Valid() {
+		s.token = token
+		return s.token, nil
+	}
+	// Expiry is in the past, so the config's token source refreshes right away
+	refreshed, err := s.conf.TokenSource(context.Background(), token).Token()
+	if err != nil {
+		return nil, fmt.Errorf("refreshing token for user %d: %w", s.userID, err)
+	}
+	err = s.save(context.Background(), s.q, s.userID, token, refreshed)
+	if err != nil {
+		return nil, fmt.Errorf("saving token for user %d: %w", s.userID, err)
+	}
+	s.token = refreshed
+	return s.token, nil
+}
+
+func loadSpotify(ctx context.Context, q *database.Queries, userID int64) (*oauth2.Token, error) {
+	dbToken, err := q.GetSpotifyAccessToken(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{
+		AccessToken:  dbToken.AccessToken,
+		TokenType:    dbToken.TokenType,
+		RefreshToken: dbToken.RefreshToken,
+		Expiry:       time.Unix(dbToken.ExpiresAt, 0),
+	}, nil
+}
+
+func saveSpotify(ctx context.Context, q *database.Queries, userID int64, old, new *oauth2.Token) error {
+	err := q.UpdateSpotifyAccessToken(ctx, database.UpdateSpotifyAccessTokenParams{
+		AccessToken: new.AccessToken,
+		ExpiresAt:   new.Expiry.Unix(),
+		UserID:      userID,
+	})
+	if err != nil {
+		return err
+	}
+	if new.RefreshToken == old.RefreshToken {
+		return nil
+	}
+	return q.UpdateSpotifyRefreshToken(ctx, database.UpdateSpotifyRefreshTokenParams{
+		RefreshToken: new.RefreshToken,
+		UserID:       userID,
+	})
+}
+
+func loadStrava(ctx context.Context, q *database.Queries, userID int64) (*oauth2.Token, error) {
+	dbToken, err := q.GetTokenByUserId(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{
+		AccessToken:  dbToken.AccessToken,
+		RefreshToken: dbToken.RefreshToken,
+		Expiry:       time.Unix(dbToken.ExpiresAt, 0),
+	}, nil
+}
+
+func saveStrava(ctx context.Context, q *database.Queries, userID int64, old, new *oauth2.Token) error {
+	err := q.UpdateStravaAccessToken(ctx, database.UpdateStravaAccessTokenParams{
+		AccessToken: new.AccessToken,
+		ExpiresAt:   new.Expiry.Unix(),
+		UserID:      userID,
+	})
+	if err != nil {
+		return err
+	}
+	if new.RefreshToken == old.RefreshToken {
+		return nil
+	}
+	return q.UpdateStravaRefreshToken(ctx, database.UpdateStravaRefreshTokenParams{
+		RefreshToken: new.RefreshToken,
+		UserID:       userID,
+	})
+}
@@ -0,0 +1,175 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/oauth2"
+	"io"
+	"net/http"
+	"stravafy/internal/database"
+	"stravafy/internal/description"
+	"stravafy/internal/tokens"
+	"time"
+)
+
+// ErrActivityNotFound is returned for activities that were deleted on
+// Strava, or that the user can't see.
+var ErrActivityNotFound = errors.New("activity not found on strava")
+
+// FetchActivity loads an activity of userID from Strava.
+func FetchActivity(q *database.Queries, userID int64, activityID int64) (*DetailedActivity, error) {
+	client := oauth2.NewClient(context.Background(), tokens.Strava(q, userID))
+	resp, err := client.Get(fmt.Sprintf("https://www.strava.com/api/v3/activities/%d", activityID))
+	if err != nil {
+		return nil, fmt.Errorf("an error accured while fetching activity details: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrActivityNotFound
+	}
+	if resp.StatusCode > 299 {
+		bytes, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("an error accured while reading activity details: %v", err)
+		}
+		return nil, fmt.Errorf("activity details returned with HTTP %d %s: %s", resp.StatusCode, resp.Status, string(bytes))
+	}
+	var activity DetailedActivity
+	err = json.NewDecoder(resp.Body).Decode(&activity)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode activity: %v", err)
+	}
+	return &activity, nil
+}
+
+// FetchStreams loads the time, distance, heart rate, speed, power and
+// cadence streams of an activity. Activities without streams, manual ones
+// for example, return nil.
+func FetchStreams(q *database.Queries, userID int64, activityID int64) (*StreamSet, error) {
+	return fetchStreams(q, userID, activityID, "time,distance,heartrate,velocity_smooth,watts,cadence")
+}
+
+// FetchRoute loads the time, position and altitude streams of an activity.
+func FetchRoute(q *database.Queries, userID int64, activityID int64) (*StreamSet, error) {
+	return fetchStreams(q, userID, activityID, "time,latlng,altitude")
+}
+
+func fetchStreams(q *database.Queries, userID int64, activityID int64, keys string) (*StreamSet, error) {
+	client := oauth2.NewClient(context.Background(), tokens.Strava(q, userID))
+	resp, err := client.Get(fmt.Sprintf("https://www.strava.com/api/v3/activities/%d/streams?keys=%s&key_by_type=true", activityID, keys))
+	if err != nil {
+		return nil, fmt.Errorf("an error accured while fetching activity streams: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode > 299 {
+		bytes, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("an error accured while reading activity streams: %v", err)
+		}
+		return nil, fmt.Errorf("activity streams returned with HTTP %d %s: %s", resp.StatusCode, resp.Status, string(bytes))
+	}
+	var streams StreamSet
+	err = json.NewDecoder(resp.Body).Decode(&streams)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode activity streams: %v", err)
+	}
+	return &streams, nil
+}
+
+// ActivitySoundtrack collects what userID listened to during activity.
+func ActivitySoundtrack(q *database.Queries, userID int64, activity *DetailedActivity) (description.Data, error) {
+	streams, err := FetchStreams(q, userID, activity.ID)
+	if err != nil {
+		return description.Data{}, err
+	}
+	return activitySoundtrack(q, userID, activity, streams)
+}
+
+// activitySoundtrack is ActivitySoundtrack for activities whose streams are
+// already known, like those read from a file.
+func activitySoundtrack(q *database.Queries, userID int64, activity *DetailedActivity, streams *StreamSet) (description.Data, error) {
+	histEntries, err := q.GetHistoryEntriesBetween(context.Background(), database.GetHistoryEntriesBetweenParams{
+		UserID:      userID,
+		Timestamp:   activity.StartDate.UTC(),
+		Timestamp_2: activity.EndDate().UTC(),
+	})
+	if err != nil {
+		return description.Data{}, fmt.Errorf("an error accourd while fetching history: %v", err)
+	}
+	return description.Build(activity.DescriptionActivity(streams), histEntries), nil
+}
+
+func (a *DetailedActivity) EndDate() time.Time {
+	return a.StartDate.Add(time.Duration(a.ElapsedTime) * time.Second)
+}
+
+// DescriptionActivity converts the activity including its laps and streams
+// for the description package. Kilometre splits are cut from the distance
+// stream, for every sport type.
+func (a *DetailedActivity) DescriptionActivity(streams *StreamSet) description.Activity {
+	activity := description.Activity{
+		Name:        a.Name,
+		SportType:   a.SportType,
+		StartDate:   a.StartDate,
+		ElapsedTime: time.Duration(a.ElapsedTime) * time.Second,
+		Distance:    a.Distance,
+	}
+	for _, lap := range a.Laps {
+		name := lap.Name
+		if name == "" {
+			name = fmt.Sprintf("Lap %d", lap.LapIndex)
+		}
+		activity.Laps = append(activity.Laps, description.Interval{
+			Name:        name,
+			Distance:    lap.Distance,
+			Offset:      lap.StartDate.Sub(a.StartDate),
+			ElapsedTime: time.Duration(lap.ElapsedTime) * time.Second,
+		})
+	}
+	activity.Streams = streams.DescriptionStreams()
+	if streams == nil || streams.Time == nil || streams.Distance == nil || len(streams.Time.Data) != len(streams.Distance.Data) {
+		return activity
+	}
+	times, distance := streams.Time.Data, streams.Distance.Data
+	start := 0
+	for i, end := range splitEnds(distance) {
+		activity.Splits = append(activity.Splits, description.Interval{
+			Name:        fmt.Sprintf("Km %d", i+1),
+			Distance:    distance[end] - distance[start],
+			Offset:      seconds(times[start]),
+			ElapsedTime: seconds(times[end] - times[start]),
+		})
+		start = end
+	}
+	return activity
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// DescriptionStreams converts the streams for the description package.
+func (s *StreamSet) DescriptionStreams() *description.Streams {
+	if s == nil || s.Time == nil {
+		return nil
+	}
+	return &description.Streams{
+		Time:      s.Time.Data,
+		Heartrate: s.Heartrate.data(),
+		Speed:     s.VelocitySmooth.data(),
+		Watts:     s.Watts.data(),
+		Cadence:   s.Cadence.data(),
+	}
+}
+
+func (s *Stream) data() []float64 {
+	if s == nil {
+		return nil
+	}
+	return s.Data
+}
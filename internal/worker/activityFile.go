@@ -0,0 +1,492 @@
+package worker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strings"
+	"time"
+)
+
+// ActivityFile is an activity recorded by a device, read from a FIT, GPX or
+// TCX file.
+type ActivityFile struct {
+	Name string
+	// DataType is the data_type of the file for the Strava uploads API.
+	DataType string
+	Data     []byte
+	Activity DetailedActivity
+	Streams  StreamSet
+}
+
+// trackPoint is one sample of a recording. Missing values are zero,
+// distance is negative if the file does not contain it.
+type trackPoint struct {
+	time      time.Time
+	latLng    LatLng
+	hasLatLng bool
+	altitude  float64
+	distance  float64
+	heartrate float64
+	cadence   float64
+	watts     float64
+	speed     float64
+}
+
+// MaxActivityFileSize is the largest activity file that is read, gzipped
+// files are limited to this size after decompressing them too.
+const MaxActivityFileSize = 32 << 20
+
+// ReadActivityFile parses a FIT, GPX or TCX file, optionally gzipped, into
+// the same model Strava returns for activities.
+func ReadActivityFile(name string, data []byte) (*ActivityFile, error) {
+	ext := strings.ToLower(path.Ext(name))
+	content := data
+	dataType := ""
+	if ext == ".gz" {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		content, err = io.ReadAll(io.LimitReader(zr, MaxActivityFileSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(content) > MaxActivityFileSize {
+			return nil, fmt.Errorf("%s is larger than %d MB uncompressed", name, MaxActivityFileSize>>20)
+		}
+		ext = strings.ToLower(path.Ext(strings.TrimSuffix(name, path.Ext(name))))
+		dataType = ".gz"
+	}
+	var (
+		points []trackPoint
+		info   fileInfo
+		err    error
+	)
+	switch ext {
+	case ".fit":
+		points, info, err = decodeFit(content)
+	case ".gpx":
+		points, info, err = decodeGpx(content)
+	case ".tcx":
+		points, info, err = decodeTcx(content)
+	default:
+		return nil, fmt.Errorf("unsupported file type %q, expected .fit, .gpx or .tcx", ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(points) < 2 {
+		return nil, fmt.Errorf("%s contains no recorded track", name)
+	}
+	file := &ActivityFile{
+		Name:     name,
+		DataType: strings.TrimPrefix(ext, ".") + dataType,
+		Data:     data,
+	}
+	file.build(points, info)
+	return file, nil
+}
+
+// fileInfo is what a file says about the activity besides the samples.
+type fileInfo struct {
+	name      string
+	sportType string
+	// utcOffset is the difference of local time to UTC, if known.
+	utcOffset time.Duration
+	laps      []fileLap
+}
+
+type fileLap struct {
+	start    time.Time
+	elapsed  time.Duration
+	distance float64
+}
+
+// build fills in the activity and its streams from the recorded samples.
+func (f *ActivityFile) build(points []trackPoint, info fileInfo) {
+	start := points[0].time
+	end := points[len(points)-1].time
+	a := &f.Activity
+	a.SportType = info.sportType
+	if a.SportType == "" {
+		a.SportType = "Workout"
+	}
+	a.Type = a.SportType
+	if a.Type == "TrailRun" {
+		a.Type = "Run"
+	}
+	a.StartDate = start.UTC()
+	a.StartDateLocal = start.UTC().Add(info.utcOffset)
+	a.ElapsedTime = int(end.Sub(start).Seconds())
+	a.Name = info.name
+	if a.Name == "" {
+		a.Name = defaultActivityName(a.StartDateLocal, a.SportType)
+	}
+	a.ExternalID = f.Name
+
+	fillDistance(points)
+	var (
+		s                           = &f.Streams
+		times, distance             []float64
+		heartrate, cadence, watts   []float64
+		speed                       []float64
+		hrSum, wattsSum, moving     float64
+		hrSamples, wattsSamples     int
+		hasHr, hasCad, hasWatts     bool
+		elevationGain, lastAltitude float64
+	)
+	for i, p := range points {
+		t := p.time.Sub(start).Seconds()
+		v := p.speed
+		if v == 0 && i > 0 {
+			if dt := t - times[i-1]; dt > 0 {
+				v = (p.distance - distance[i-1]) / dt
+			}
+		}
+		times = append(times, t)
+		distance = append(distance, p.distance)
+		heartrate = append(heartrate, p.heartrate)
+		cadence = append(cadence, p.cadence)
+		watts = append(watts, p.watts)
+		speed = append(speed, v)
+		if p.heartrate > 0 {
+			hasHr = true
+			hrSum += p.heartrate
+			hrSamples++
+			a.MaxHeartrate = max(a.MaxHeartrate, p.heartrate)
+		}
+		if p.cadence > 0 {
+			hasCad = true
+		}
+		if p.watts > 0 {
+			hasWatts = true
+			wattsSum += p.watts
+			wattsSamples++
+		}
+		a.MaxSpeed = max(a.MaxSpeed, v)
+		// samples more than 10s apart are treated as pauses
+		if i > 0 && v > 0.5 && t-times[i-1] <= 10 {
+			moving += t - times[i-1]
+		}
+		if p.altitude != 0 {
+			if lastAltitude != 0 && p.altitude > lastAltitude {
+				elevationGain += p.altitude - lastAltitude
+			}
+			lastAltitude = p.altitude
+		}
+	}
+	a.Distance = distance[len(distance)-1]
+	a.MovingTime = int(moving)
+	if a.MovingTime == 0 {
+		a.MovingTime = a.ElapsedTime
+	}
+	if a.MovingTime > 0 {
+		a.AverageSpeed = a.Distance / float64(a.MovingTime)
+	}
+	a.TotalElevationGain = elevationGain
+	if hrSamples > 0 {
+		a.HasHeartrate = true
+		a.AverageHeartrate = hrSum / float64(hrSamples)
+	}
+	if wattsSamples > 0 {
+		a.AverageWatts = wattsSum / float64(wattsSamples)
+		a.DeviceWatts = true
+	}
+	for _, p := range points {
+		if p.hasLatLng {
+			a.StartLatLng = p.latLng
+			break
+		}
+	}
+	for i := len(points) - 1; i >= 0; i-- {
+		if points[i].hasLatLng {
+			a.EndLatLng = points[i].latLng
+			break
+		}
+	}
+
+	s.Time = &Stream{Data: times, SeriesType: "time", OriginalSize: len(times)}
+	s.Distance = &Stream{Data: distance, SeriesType: "time", OriginalSize: len(distance)}
+	s.VelocitySmooth = &Stream{Data: speed, SeriesType: "time", OriginalSize: len(speed)}
+	if hasHr {
+		s.Heartrate = &Stream{Data: heartrate, SeriesType: "time", OriginalSize: len(heartrate)}
+	}
+	if hasCad {
+		s.Cadence = &Stream{Data: cadence, SeriesType: "time", OriginalSize: len(cadence)}
+	}
+	if hasWatts {
+		s.Watts = &Stream{Data: watts, SeriesType: "time", OriginalSize: len(watts)}
+	}
+
+	for i, lap := range info.laps {
+		a.Laps = append(a.Laps, Lap{
+			Distance:       lap.distance,
+			ElapsedTime:    int(lap.elapsed.Seconds()),
+			LapIndex:       i + 1,
+			Name:           fmt.Sprintf("Lap %d", i+1),
+			StartDate:      lap.start.UTC(),
+			StartDateLocal: lap.start.UTC().Add(info.utcOffset),
+		})
+	}
+	a.SplitsMetric = metricSplits(times, distance)
+}
+
+// fillDistance computes the distance covered from the positions for files
+// that don't record it. Single samples without a distance keep the one
+// before them.
+func fillDistance(points []trackPoint) {
+	if points[0].distance >= 0 {
+		for i := 1; i < len(points); i++ {
+			if points[i].distance < 0 {
+				points[i].distance = points[i-1].distance
+			}
+		}
+		return
+	}
+	var total float64
+	var last *trackPoint
+	for i := range points {
+		p := &points[i]
+		if p.hasLatLng {
+			if last != nil {
+				total += haversine(last.latLng, p.latLng)
+			}
+			last = p
+		}
+		p.distance = total
+	}
+}
+
+// haversine returns the distance between a and b in metres.
+func haversine(a, b LatLng) float64 {
+	const earthRadius = 6371000
+	lat1 := a[0] * math.Pi / 180
+	lat2 := b[0] * math.Pi / 180
+	dLat := lat2 - lat1
+	dLng := (b[1] - a[1]) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+// metricSplits cuts the activity into kilometres like Strava's splits_metric.
+func metricSplits(times, distance []float64) []Split {
+	var splits []Split
+	start := 0
+	for _, end := range splitEnds(distance) {
+		d := distance[end] - distance[start]
+		elapsed := int(times[end] - times[start])
+		split := Split{
+			Distance:    d,
+			ElapsedTime: elapsed,
+			MovingTime:  elapsed,
+			Split:       len(splits) + 1,
+		}
+		if elapsed > 0 {
+			split.AverageSpeed = d / float64(elapsed)
+		}
+		splits = append(splits, split)
+		start = end
+	}
+	return splits
+}
+
+// splitEnds returns the index of the sample each kilometre ends at, the
+// first one after it. Each starts where the one before ended, the last one
+// ends with the activity.
+func splitEnds(distance []float64) []int {
+	var ends []int
+	start := 0
+	for i := range distance {
+		last := i == len(distance)-1
+		if distance[i]-distance[start] < 1000 && !(last && distance[i] > distance[start]) {
+			continue
+		}
+		ends = append(ends, i)
+		start = i
+	}
+	return ends
+}
+
+// defaultActivityName names activities like Strava does, "Morning Run" for
+// example.
+func defaultActivityName(localStart time.Time, sportType string) string {
+	daytime := "Night"
+	switch h := localStart.Hour(); {
+	case h >= 4 && h < 12:
+		daytime = "Morning"
+	case h >= 12 && h < 17:
+		daytime = "Afternoon"
+	case h >= 17 && h < 21:
+		daytime = "Evening"
+	}
+	return daytime + " " + sportType
+}
+
+type gpxFile struct {
+	Metadata struct {
+		Time time.Time `xml:"time"`
+	} `xml:"metadata"`
+	Tracks []struct {
+		Name     string `xml:"name"`
+		Type     string `xml:"type"`
+		Segments []struct {
+			Points []struct {
+				Lat        float64   `xml:"lat,attr"`
+				Lon        float64   `xml:"lon,attr"`
+				Elevation  float64   `xml:"ele"`
+				Time       time.Time `xml:"time"`
+				Extensions struct {
+					Power     float64 `xml:"power"`
+					Heartrate float64 `xml:"TrackPointExtension>hr"`
+					Cadence   float64 `xml:"TrackPointExtension>cad"`
+				} `xml:"extensions"`
+			} `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+}
+
+func decodeGpx(data []byte) ([]trackPoint, fileInfo, error) {
+	var gpx gpxFile
+	if err := xml.Unmarshal(data, &gpx); err != nil {
+		return nil, fileInfo{}, fmt.Errorf("invalid gpx file: %v", err)
+	}
+	var points []trackPoint
+	var info fileInfo
+	for _, track := range gpx.Tracks {
+		if info.name == "" {
+			info.name = track.Name
+		}
+		if info.sportType == "" {
+			info.sportType = sportTypes[strings.ToLower(track.Type)]
+		}
+		for _, segment := range track.Segments {
+			for _, p := range segment.Points {
+				if p.Time.IsZero() {
+					continue
+				}
+				points = append(points, trackPoint{
+					time:      p.Time,
+					latLng:    LatLng{p.Lat, p.Lon},
+					hasLatLng: true,
+					altitude:  p.Elevation,
+					distance:  -1,
+					heartrate: p.Extensions.Heartrate,
+					cadence:   p.Extensions.Cadence,
+					watts:     p.Extensions.Power,
+				})
+			}
+		}
+	}
+	return points, info, nil
+}
+
+type tcxFile struct {
+	Activities []struct {
+		Sport string `xml:"Sport,attr"`
+		Laps  []struct {
+			StartTime        time.Time `xml:"StartTime,attr"`
+			TotalTimeSeconds float64   `xml:"TotalTimeSeconds"`
+			DistanceMeters   float64   `xml:"DistanceMeters"`
+			Trackpoints      []struct {
+				Time     time.Time `xml:"Time"`
+				Position *struct {
+					Latitude  float64 `xml:"LatitudeDegrees"`
+					Longitude float64 `xml:"LongitudeDegrees"`
+				} `xml:"Position"`
+				Altitude   float64  `xml:"AltitudeMeters"`
+				Distance   *float64 `xml:"DistanceMeters"`
+				Heartrate  float64  `xml:"HeartRateBpm>Value"`
+				Cadence    float64  `xml:"Cadence"`
+				Extensions struct {
+					Speed float64 `xml:"TPX>Speed"`
+					Watts float64 `xml:"TPX>Watts"`
+					// running cadence is recorded per leg
+					RunCadence float64 `xml:"TPX>RunCadence"`
+				} `xml:"Extensions"`
+			} `xml:"Track>Trackpoint"`
+		} `xml:"Lap"`
+	} `xml:"Activities>Activity"`
+}
+
+func decodeTcx(data []byte) ([]trackPoint, fileInfo, error) {
+	var tcx tcxFile
+	if err := xml.Unmarshal(data, &tcx); err != nil {
+		return nil, fileInfo{}, fmt.Errorf("invalid tcx file: %v", err)
+	}
+	if len(tcx.Activities) == 0 {
+		return nil, fileInfo{}, fmt.Errorf("tcx file contains no activity")
+	}
+	activity := tcx.Activities[0]
+	info := fileInfo{sportType: sportTypes[strings.ToLower(activity.Sport)]}
+	var points []trackPoint
+	hasDistance := true
+	for _, lap := range activity.Laps {
+		info.laps = append(info.laps, fileLap{
+			start:    lap.StartTime,
+			elapsed:  time.Duration(lap.TotalTimeSeconds * float64(time.Second)),
+			distance: lap.DistanceMeters,
+		})
+		for _, tp := range lap.Trackpoints {
+			if tp.Time.IsZero() {
+				continue
+			}
+			p := trackPoint{
+				time:      tp.Time,
+				altitude:  tp.Altitude,
+				heartrate: tp.Heartrate,
+				cadence:   tp.Cadence,
+				watts:     tp.Extensions.Watts,
+				speed:     tp.Extensions.Speed,
+			}
+			if p.cadence == 0 {
+				p.cadence = tp.Extensions.RunCadence
+			}
+			if tp.Position != nil {
+				p.latLng = LatLng{tp.Position.Latitude, tp.Position.Longitude}
+				p.hasLatLng = true
+			}
+			if tp.Distance != nil {
+				p.distance = *tp.Distance
+			} else {
+				hasDistance = false
+			}
+			points = append(points, p)
+		}
+	}
+	if !hasDistance && len(points) > 0 {
+		points[0].distance = -1
+	}
+	return points, info, nil
+}
+
+// sportTypes maps the activity types used in GPX and TCX files to Strava
+// sport types.
+var sportTypes = map[string]string{
+	"running":              "Run",
+	"run":                  "Run",
+	"trail_running":        "TrailRun",
+	"biking":               "Ride",
+	"cycling":              "Ride",
+	"ride":                 "Ride",
+	"road_biking":          "Ride",
+	"mountain_biking":      "MountainBikeRide",
+	"gravel_cycling":       "GravelRide",
+	"virtual_ride":         "VirtualRide",
+	"walking":              "Walk",
+	"walk":                 "Walk",
+	"hiking":               "Hike",
+	"hike":                 "Hike",
+	"swimming":             "Swim",
+	"lap_swimming":         "Swim",
+	"open_water":           "Swim",
+	"rowing":               "Rowing",
+	"indoor_rowing":        "Rowing",
+	"cross_country_skiing": "NordicSki",
+	"alpine_skiing":        "AlpineSki",
+	"other":                "Workout",
+}
@@ -0,0 +1,178 @@
+package worker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readTestActivityFile(t *testing.T, name string) *ActivityFile {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := ReadActivityFile(name, data)
+	if err != nil {
+		t.Fatalf("reading %s: %v", name, err)
+	}
+	return file
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 0.01
+}
+
+// run.fit is a 400s run at 3 m/s with a record every second, two laps and
+// a developer field on every record. All records but the first have
+// compressed timestamps, which wrap around several times.
+func TestReadActivityFileFit(t *testing.T) {
+	file := readTestActivityFile(t, "run.fit")
+	a := file.Activity
+	start := time.Date(2024, time.May, 4, 7, 30, 0, 0, time.UTC)
+	if a.SportType != "Run" || a.Type != "Run" {
+		t.Errorf("sport type = %q, type = %q, want Run", a.SportType, a.Type)
+	}
+	if !a.StartDate.Equal(start) {
+		t.Errorf("start = %s, want %s", a.StartDate, start)
+	}
+	// local_timestamp of the activity message is two hours ahead
+	if want := start.Add(2 * time.Hour); !a.StartDateLocal.Equal(want) {
+		t.Errorf("local start = %s, want %s", a.StartDateLocal, want)
+	}
+	if a.Name != "Morning Run" {
+		t.Errorf("name = %q, want Morning Run", a.Name)
+	}
+	if a.ElapsedTime != 399 {
+		t.Errorf("elapsed time = %d, want 399", a.ElapsedTime)
+	}
+	if !near(a.Distance, 1197) {
+		t.Errorf("distance = %f, want 1197", a.Distance)
+	}
+	if !a.HasHeartrate || a.MaxHeartrate != 159 {
+		t.Errorf("heartrate = %v/%f, want max 159", a.HasHeartrate, a.MaxHeartrate)
+	}
+	if !near(a.TotalElevationGain, 39.8) {
+		t.Errorf("elevation gain = %f, want 39.8", a.TotalElevationGain)
+	}
+	times := file.Streams.Time.Data
+	if len(times) != 400 {
+		t.Fatalf("%d samples, want 400", len(times))
+	}
+	for i, s := range times {
+		if s != float64(i) {
+			t.Fatalf("sample %d at %fs", i, s)
+		}
+	}
+	if len(a.Laps) != 2 {
+		t.Fatalf("%d laps, want 2", len(a.Laps))
+	}
+	if lap := a.Laps[1]; !lap.StartDate.Equal(start.Add(199*time.Second)) || lap.ElapsedTime != 200 || !near(lap.Distance, 600) {
+		t.Errorf("second lap = %s %ds %fm", lap.StartDate, lap.ElapsedTime, lap.Distance)
+	}
+	// splits end at the first sample after each kilometre
+	if len(a.SplitsMetric) != 2 || !near(a.SplitsMetric[0].Distance, 1002) || !near(a.SplitsMetric[1].Distance, 195) {
+		t.Errorf("splits = %+v", a.SplitsMetric)
+	}
+	if file.DataType != "fit" {
+		t.Errorf("data type = %q, want fit", file.DataType)
+	}
+}
+
+func TestReadActivityFileGzip(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "run.fit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	file, err := ReadActivityFile("run.fit.gz", buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.DataType != "fit.gz" || len(file.Streams.Time.Data) != 400 {
+		t.Errorf("data type = %q with %d samples", file.DataType, len(file.Streams.Time.Data))
+	}
+}
+
+func TestReadActivityFileGzipTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(make([]byte, MaxActivityFileSize+1))
+	zw.Close()
+	_, err := ReadActivityFile("large.gpx.gz", buf.Bytes())
+	if err == nil {
+		t.Error("read a file larger than the limit")
+	}
+}
+
+func TestReadActivityFileGpx(t *testing.T) {
+	file := readTestActivityFile(t, "ride.gpx")
+	a := file.Activity
+	if a.SportType != "Ride" || a.Name != "Commute home" {
+		t.Errorf("sport type = %q, name = %q", a.SportType, a.Name)
+	}
+	if a.ElapsedTime != 30 {
+		t.Errorf("elapsed time = %d, want 30", a.ElapsedTime)
+	}
+	// 0.003° of longitude at 52.52° north
+	if a.Distance < 200 || a.Distance > 205 {
+		t.Errorf("distance = %f, want about 203", a.Distance)
+	}
+	if !near(a.AverageWatts, 200) || !near(a.AverageHeartrate, 125.5) {
+		t.Errorf("watts = %f, heartrate = %f", a.AverageWatts, a.AverageHeartrate)
+	}
+	if file.Streams.Cadence == nil || file.Streams.Cadence.Data[2] != 90 {
+		t.Errorf("cadence = %+v", file.Streams.Cadence)
+	}
+	if !near(a.TotalElevationGain, 2.5) {
+		t.Errorf("elevation gain = %f, want 2.5", a.TotalElevationGain)
+	}
+}
+
+func TestReadActivityFileTcx(t *testing.T) {
+	file := readTestActivityFile(t, "run.tcx")
+	a := file.Activity
+	if a.SportType != "Run" || a.Name != "Evening Run" {
+		t.Errorf("sport type = %q, name = %q", a.SportType, a.Name)
+	}
+	if a.ElapsedTime != 20 || !near(a.Distance, 70) || !near(a.MaxSpeed, 4) {
+		t.Errorf("%ds, %fm, max %f m/s", a.ElapsedTime, a.Distance, a.MaxSpeed)
+	}
+	if len(a.Laps) != 2 || !near(a.Laps[1].Distance, 40) || a.Laps[1].ElapsedTime != 10 {
+		t.Errorf("laps = %+v", a.Laps)
+	}
+	if file.Streams.Cadence == nil || file.Streams.Cadence.Data[0] != 85 {
+		t.Errorf("cadence = %+v", file.Streams.Cadence)
+	}
+	if len(a.SplitsMetric) != 1 || !near(a.SplitsMetric[0].Distance, 70) {
+		t.Errorf("splits = %+v", a.SplitsMetric)
+	}
+}
+
+// Splits of the description come from the streams, also for rides.
+func TestDescriptionActivitySplits(t *testing.T) {
+	file := readTestActivityFile(t, "run.fit")
+	splits := file.Activity.DescriptionActivity(&file.Streams).Splits
+	if len(splits) != 2 || splits[0].Offset != 0 || splits[1].Offset != splits[0].ElapsedTime {
+		t.Fatalf("splits = %+v", splits)
+	}
+	if end := splits[1].Offset + splits[1].ElapsedTime; end != 399*time.Second {
+		t.Errorf("last split ends at %s, want 399s", end)
+	}
+
+	file = readTestActivityFile(t, "ride.gpx")
+	splits = file.Activity.DescriptionActivity(&file.Streams).Splits
+	if len(splits) != 1 || splits[0].Name != "Km 1" || splits[0].ElapsedTime != 30*time.Second {
+		t.Errorf("splits = %+v", splits)
+	}
+	if splits := file.Activity.DescriptionActivity(nil).Splits; len(splits) != 0 {
+		t.Errorf("splits without streams = %+v", splits)
+	}
+}
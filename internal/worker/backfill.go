@@ -0,0 +1,204 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/oauth2"
+	"io"
+	"net/http"
+	"net/url"
+	"stravafy/internal/config"
+	"stravafy/internal/database"
+	"stravafy/internal/tokens"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const backfillPageSize = 50
+
+var (
+	ErrBackfillRunning = errors.New("a backfill is already running")
+	errBackfillStopped = errors.New("backfill stopped")
+)
+
+// BackfillOptions select the activities a backfill goes through.
+type BackfillOptions struct {
+	After  time.Time
+	Before time.Time
+	// RecordOnly only stores the matches locally and leaves the
+	// descriptions on Strava untouched.
+	RecordOnly bool
+}
+
+// BackfillStatus is the progress of a backfill.
+type BackfillStatus struct {
+	Options   BackfillOptions
+	Running   bool
+	Started   time.Time
+	Finished  time.Time
+	Processed int
+	Failed    int
+	Error     string
+}
+
+var (
+	backfillsMu sync.Mutex
+	backfills   = make(map[int64]*BackfillStatus)
+)
+
+// StartBackfill runs a backfill for userID in the background. Only one
+// backfill per user runs at a time.
+func StartBackfill(q *database.Queries, userID int64, opts BackfillOptions) error {
+	backfillsMu.Lock()
+	if status, ok := backfills[userID]; ok && status.Running {
+		backfillsMu.Unlock()
+		return ErrBackfillRunning
+	}
+	// running right away, so a second request can't start another one
+	status := &BackfillStatus{Options: opts, Running: true, Started: time.Now()}
+	backfills[userID] = status
+	backfillsMu.Unlock()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := Backfill(q, userID, opts, status, shutdownCh)
+		if err != nil {
+			errorf(userID, "backfill: %v", err)
+		}
+	}()
+	return nil
+}
+
+// GetBackfillStatus returns the status of the last backfill of userID.
+func GetBackfillStatus(userID int64) (BackfillStatus, bool) {
+	backfillsMu.Lock()
+	defer backfillsMu.Unlock()
+	status, ok := backfills[userID]
+	if !ok {
+		return BackfillStatus{}, false
+	}
+	return *status, true
+}
+
+// Backfill pages through the activities of userID between opts.After and
+// opts.Before and matches each of them like a newly created one. Progress is
+// reported in status, the backfill ends early once stop is closed.
+func Backfill(q *database.Queries, userID int64, opts BackfillOptions, status *BackfillStatus, stop <-chan struct{}) error {
+	update := func(f func(status *BackfillStatus)) {
+		backfillsMu.Lock()
+		defer backfillsMu.Unlock()
+		f(status)
+	}
+	update(func(status *BackfillStatus) {
+		*status = BackfillStatus{Options: opts, Running: true, Started: time.Now()}
+	})
+	err := backfill(q, userID, opts, stop, func(err error) {
+		update(func(status *BackfillStatus) {
+			status.Processed++
+			if err != nil {
+				status.Failed++
+			}
+		})
+	})
+	update(func(status *BackfillStatus) {
+		status.Running = false
+		status.Finished = time.Now()
+		if err != nil {
+			status.Error = err.Error()
+		}
+	})
+	return err
+}
+
+func backfill(q *database.Queries, userID int64, opts BackfillOptions, stop <-chan struct{}, done func(error)) error {
+	user, err := q.GetUserById(context.Background(), userID)
+	if err != nil {
+		return err
+	}
+	interval := time.Duration(config.GetConfig().Backfill.Interval) * time.Second
+	infof(userID, "backfilling activities between %s and %s", opts.After, opts.Before)
+	for page := 1; ; page++ {
+		activities, err := listActivities(q, userID, opts.After, opts.Before, page)
+		if err != nil {
+			return err
+		}
+		for _, activity := range activities {
+			err := backfillActivity(q, user, activity.ID, opts.RecordOnly)
+			if err != nil {
+				errorf(userID, "backfilling activity %d: %v", activity.ID, err)
+			}
+			done(err)
+			select {
+			case <-stop:
+				return errBackfillStopped
+			case <-time.After(interval):
+			}
+		}
+		if len(activities) < backfillPageSize {
+			infof(userID, "backfill done")
+			return nil
+		}
+	}
+}
+
+func backfillActivity(q *database.Queries, user database.User, activityID int64, recordOnly bool) error {
+	event := Callback{
+		ObjectType: ObjectTypeActivity,
+		ObjectId:   activityID,
+		AspectType: AspectTypeCreate,
+		OwnerId:    user.StravaID,
+		EventTime:  time.Now().Unix(),
+	}
+	infof(event.EventTime, "backfilling activity %d", activityID)
+	activity, err := FetchActivity(q, user.ID, activityID)
+	if err != nil {
+		return err
+	}
+	skip, err := checkRules(event.EventTime, q, user.ID, activity)
+	if err != nil || skip {
+		return err
+	}
+	if recordOnly || processed(activity.Description) {
+		_, err := matchSoundtrack(event, q, user, activity)
+		return err
+	}
+	err = autoShare(event.EventTime, q, user.ID, activity)
+	if err != nil {
+		return err
+	}
+	return writeSoundtrack(event, q, user, activity, activity.Description)
+}
+
+// listActivities loads one page of the activities of userID that started
+// between after and before.
+func listActivities(q *database.Queries, userID int64, after, before time.Time, page int) ([]MetaActivity, error) {
+	client := oauth2.NewClient(context.Background(), tokens.Strava(q, userID))
+	values := url.Values{
+		"after":    {strconv.FormatInt(after.Unix(), 10)},
+		"before":   {strconv.FormatInt(before.Unix(), 10)},
+		"page":     {strconv.Itoa(page)},
+		"per_page": {strconv.Itoa(backfillPageSize)},
+	}
+	resp, err := client.Get("https://www.strava.com/api/v3/athlete/activities?" + values.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("an error accured while listing activities: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bytes, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("an error accured while reading activities: %v", err)
+		}
+		return nil, fmt.Errorf("listing activities returned with HTTP %d %s: %s", resp.StatusCode, resp.Status, string(bytes))
+	}
+	var activities []MetaActivity
+	err = json.NewDecoder(resp.Body).Decode(&activities)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode activities: %v", err)
+	}
+	return activities, nil
+}
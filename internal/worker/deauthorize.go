@@ -0,0 +1,170 @@
+package worker
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"golang.org/x/oauth2"
+	"net/http"
+	"stravafy/internal/config"
+	"stravafy/internal/database"
+	"stravafy/internal/tokens"
+)
+
+// handleAthleteUpdate reacts to an athlete revoking access to their Strava
+// account. Other athlete updates carry nothing of interest.
+func handleAthleteUpdate(event Callback) error {
+	if event.Updates["authorized"] != "false" {
+		infof(event.EventTime, "skipping athlete update %v", event.Updates)
+		return nil
+	}
+	infof(event.EventTime, "athlete %d deauthorized stravafy", event.OwnerId)
+	q, user, err := eventUser(event)
+	if errors.Is(err, ErrUnknownAthlete) {
+		infof(event.EventTime, "athlete is not known (anymore)")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	revoked, err := stravaAccessRevoked(q, user.ID)
+	if err != nil {
+		return fmt.Errorf("confirming deauthorization: %w", err)
+	}
+	if !revoked {
+		errorf(event.EventTime, "athlete %d still authorizes stravafy, ignoring the event", event.OwnerId)
+		return nil
+	}
+	return deauthorize(event, q, user)
+}
+
+// stravaAccessRevoked asks Strava whether the token of userID still works.
+// Strava revokes it before sending a deauthorization event, so a real event
+// can be told apart from a forged one.
+func stravaAccessRevoked(q *database.Queries, userID int64) (bool, error) {
+	client := oauth2.NewClient(context.Background(), tokens.Strava(q, userID))
+	resp, err := client.Get("https://www.strava.com/api/v3/athlete")
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) && retrieveErr.Response != nil &&
+		(retrieveErr.Response.StatusCode == http.StatusBadRequest || retrieveErr.Response.StatusCode == http.StatusUnauthorized) {
+		// the refresh token was revoked as well
+		return true, nil
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		// no token left to check, there is nothing to revoke either
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return true, nil
+	case resp.StatusCode < 300:
+		return false, nil
+	}
+	return false, fmt.Errorf("strava returned with HTTP %d %s", resp.StatusCode, resp.Status)
+}
+
+func deauthorize(event Callback, q *database.Queries, user database.User) error {
+	StopSyncForUser(user.ID)
+	tokens.Forget(user.ID)
+
+	db, err := database.NewSQLite()
+	if err != nil {
+		return err
+	}
+	tx, err := db.DB.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	qtx := q.WithTx(tx)
+	ctx := context.Background()
+
+	err = qtx.DeleteSessionsForUser(ctx, sql.NullInt64{Int64: user.ID, Valid: true})
+	if err != nil {
+		return err
+	}
+	err = qtx.DeleteStravaAccessToken(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	err = qtx.DeleteStravaRefreshToken(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	// public pages go away even if the rest is kept
+	err = qtx.DeleteActivitySharesForUser(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	err = qtx.DeleteWrappedSharesForUser(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	// stop polling other services and accepting listens for the user
+	err = qtx.DeleteMusicAccountsForUser(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	err = qtx.DeleteApiTokensForUser(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	if config.GetConfig().Strava.PurgeOnDeauthorize {
+		infof(event.EventTime, "purging all data of user %d", user.ID)
+		err = purgeUser(ctx, qtx, user, event.eventID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// purgeUser deletes everything stored about user. The events of the user
+// are deleted except for currentEvent, which the queue still finishes.
+func purgeUser(ctx context.Context, q *database.Queries, user database.User, currentEvent int64) error {
+	deletes := []func(context.Context, int64) error{
+		q.DeleteActivityTracksForUser,
+		q.DeleteActivityIntervalsForUser,
+		q.DeleteActivitiesForUser,
+		q.DeleteSpotifyAccessToken,
+		q.DeleteSpotifyRefreshToken,
+		q.DeleteSpotifyUserImages,
+		q.DeleteSpotifyUserInfo,
+		q.DeleteSpotifyScope,
+		q.DeleteHistoryContextsForUser,
+		q.DeleteHistoryItemsForUser,
+		q.DeleteHistoryReconciledForUser,
+		q.DeleteHistoryImportedForUser,
+		q.DeleteHistoryForUser,
+		q.DeleteRecentlyPlayedCursor,
+		q.DeleteDescriptionTemplate,
+		q.DeletePlaylistSettings,
+		q.DeleteActivityRules,
+		q.DeleteReviewSettings,
+		q.DeletePendingDescriptionsForUser,
+		q.DeleteActivityPlaylistsForUser,
+		q.DeleteShareSettings,
+		q.DeleteActivitySharesForUser,
+		q.DeleteWrappedSharesForUser,
+		q.DeleteTrackMetricsForUser,
+		q.DeleteActivitySoundtracksForUser,
+	}
+	for _, del := range deletes {
+		if err := del(ctx, user.ID); err != nil {
+			return err
+		}
+	}
+	err := q.DeleteStravaEventsForOwner(ctx, database.DeleteStravaEventsForOwnerParams{
+		OwnerID: user.StravaID,
+		ID:      currentEvent,
+	})
+	if err != nil {
+		return err
+	}
+	return q.DeleteUser(ctx, user.ID)
+}
@@ -0,0 +1,219 @@
+package worker
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"stravafy/internal/database"
+	"strings"
+	"time"
+)
+
+const (
+	ExportFormatGPX = "gpx"
+	ExportFormatKML = "kml"
+)
+
+// ErrNoRoute is returned for activities recorded without GPS.
+var ErrNoRoute = errors.New("activity has no route")
+
+// Route is the track of an activity with a waypoint wherever a new song
+// started.
+type Route struct {
+	Name      string
+	SportType string
+	Points    []RoutePoint
+	Waypoints []Waypoint
+}
+
+type RoutePoint struct {
+	LatLng   LatLng
+	Altitude float64
+	Time     time.Time
+}
+
+type Waypoint struct {
+	RoutePoint
+	// Name is the song and its artists, or the episode and its show.
+	Name string
+	Url  string
+	Type string
+}
+
+// ActivityRoute loads the route of an activity of userID from Strava and
+// places the played items on it.
+func ActivityRoute(q *database.Queries, userID int64, activityID int64) (*Route, error) {
+	activity, err := FetchActivity(q, userID, activityID)
+	if err != nil {
+		return nil, err
+	}
+	streams, err := FetchRoute(q, userID, activityID)
+	if err != nil {
+		return nil, err
+	}
+	return buildRoute(q, userID, activity, streams)
+}
+
+func buildRoute(q *database.Queries, userID int64, activity *DetailedActivity, streams *StreamSet) (*Route, error) {
+	if streams == nil || streams.Time == nil || streams.Latlng == nil || len(streams.Latlng.Data) != len(streams.Time.Data) {
+		return nil, ErrNoRoute
+	}
+	// the metrics are not needed, only when something played
+	data, err := activitySoundtrack(q, userID, activity, nil)
+	if err != nil {
+		return nil, err
+	}
+	route := &Route{Name: activity.Name, SportType: activity.SportType}
+	for i, latlng := range streams.Latlng.Data {
+		point := RoutePoint{
+			LatLng: latlng,
+			Time:   activity.StartDate.Add(time.Duration(streams.Time.Data[i]) * time.Second).UTC(),
+		}
+		if streams.Altitude != nil && i < len(streams.Altitude.Data) {
+			point.Altitude = streams.Altitude.Data[i]
+		}
+		route.Points = append(route.Points, point)
+	}
+	for _, track := range data.Tracks {
+		route.addWaypoint(track.Offset, track.Name+" - "+track.Artists, track.Url, "track", streams.Time.Data)
+	}
+	for _, episode := range data.Episodes {
+		route.addWaypoint(episode.Offset, episode.Name+" - "+episode.Show, episode.Url, "episode", streams.Time.Data)
+	}
+	sort.SliceStable(route.Waypoints, func(i, j int) bool {
+		return route.Waypoints[i].Time.Before(route.Waypoints[j].Time)
+	})
+	return route, nil
+}
+
+// addWaypoint places a waypoint at the first sample at or after offset.
+// Items that started before the activity are placed at its start.
+func (r *Route) addWaypoint(offset time.Duration, name, url, itemType string, times []float64) {
+	i := sort.SearchFloat64s(times, offset.Seconds())
+	if i == len(times) {
+		return
+	}
+	r.Waypoints = append(r.Waypoints, Waypoint{
+		RoutePoint: r.Points[i],
+		Name:       name,
+		Url:        url,
+		Type:       itemType,
+	})
+}
+
+// WriteGPX writes route as GPX 1.1 with the songs as waypoints.
+func (r *Route) WriteGPX(w io.Writer) error {
+	type gpxLink struct {
+		Href string `xml:"href,attr"`
+	}
+	type gpxPoint struct {
+		Lat  float64  `xml:"lat,attr"`
+		Lon  float64  `xml:"lon,attr"`
+		Ele  float64  `xml:"ele"`
+		Time string   `xml:"time"`
+		Name string   `xml:"name,omitempty"`
+		Link *gpxLink `xml:"link,omitempty"`
+		Type string   `xml:"type,omitempty"`
+	}
+	type gpx struct {
+		XMLName  xml.Name `xml:"gpx"`
+		Version  string   `xml:"version,attr"`
+		Creator  string   `xml:"creator,attr"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Metadata struct {
+			Name string `xml:"name"`
+			Time string `xml:"time,omitempty"`
+		} `xml:"metadata"`
+		Waypoints []gpxPoint `xml:"wpt"`
+		Track     struct {
+			Name   string     `xml:"name"`
+			Type   string     `xml:"type"`
+			Points []gpxPoint `xml:"trkseg>trkpt"`
+		} `xml:"trk"`
+	}
+	point := func(p RoutePoint) gpxPoint {
+		return gpxPoint{Lat: p.LatLng[0], Lon: p.LatLng[1], Ele: p.Altitude, Time: p.Time.Format(time.RFC3339)}
+	}
+	doc := gpx{Version: "1.1", Creator: "Stravafy", Xmlns: "http://www.topografix.com/GPX/1/1"}
+	doc.Metadata.Name = r.Name
+	if len(r.Points) > 0 {
+		doc.Metadata.Time = r.Points[0].Time.Format(time.RFC3339)
+	}
+	for _, wp := range r.Waypoints {
+		p := point(wp.RoutePoint)
+		p.Name = wp.Name
+		p.Type = wp.Type
+		if wp.Url != "" {
+			p.Link = &gpxLink{Href: wp.Url}
+		}
+		doc.Waypoints = append(doc.Waypoints, p)
+	}
+	doc.Track.Name = r.Name
+	doc.Track.Type = r.SportType
+	for _, p := range r.Points {
+		doc.Track.Points = append(doc.Track.Points, point(p))
+	}
+	return writeXML(w, doc)
+}
+
+// WriteKML writes route as KML with a placemark per song.
+func (r *Route) WriteKML(w io.Writer) error {
+	type kmlPoint struct {
+		Coordinates string `xml:"coordinates"`
+	}
+	type kmlLineString struct {
+		Tessellate  int    `xml:"tessellate"`
+		Coordinates string `xml:"coordinates"`
+	}
+	type kmlTimeStamp struct {
+		When string `xml:"when"`
+	}
+	type kmlPlacemark struct {
+		Name        string         `xml:"name"`
+		Description string         `xml:"description,omitempty"`
+		TimeStamp   *kmlTimeStamp  `xml:"TimeStamp,omitempty"`
+		Point       *kmlPoint      `xml:"Point,omitempty"`
+		LineString  *kmlLineString `xml:"LineString,omitempty"`
+	}
+	type kml struct {
+		XMLName    xml.Name       `xml:"kml"`
+		Xmlns      string         `xml:"xmlns,attr"`
+		Name       string         `xml:"Document>name"`
+		Placemarks []kmlPlacemark `xml:"Document>Placemark"`
+	}
+	coordinates := func(p RoutePoint) string {
+		return fmt.Sprintf("%f,%f,%.1f", p.LatLng[1], p.LatLng[0], p.Altitude)
+	}
+	doc := kml{Xmlns: "http://www.opengis.net/kml/2.2", Name: r.Name}
+	line := make([]string, 0, len(r.Points))
+	for _, p := range r.Points {
+		line = append(line, coordinates(p))
+	}
+	doc.Placemarks = append(doc.Placemarks, kmlPlacemark{
+		Name:       r.Name,
+		LineString: &kmlLineString{Tessellate: 1, Coordinates: strings.Join(line, " ")},
+	})
+	for _, wp := range r.Waypoints {
+		doc.Placemarks = append(doc.Placemarks, kmlPlacemark{
+			Name:        wp.Name,
+			Description: wp.Url,
+			TimeStamp:   &kmlTimeStamp{When: wp.Time.Format(time.RFC3339)},
+			Point:       &kmlPoint{Coordinates: coordinates(wp.RoutePoint)},
+		})
+	}
+	return writeXML(w, doc)
+}
+
+func writeXML(w io.Writer, v any) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,315 @@
+package worker
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// fitEpoch is where FIT timestamps start counting.
+var fitEpoch = time.Date(1989, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+// global FIT message numbers
+const (
+	fitMesgSession  = 18
+	fitMesgLap      = 19
+	fitMesgRecord   = 20
+	fitMesgActivity = 34
+)
+
+const fitFieldTimestamp = 253
+
+type fitField struct {
+	num      byte
+	size     byte
+	baseType byte
+}
+
+type fitDefinition struct {
+	global    uint16
+	bigEndian bool
+	fields    []fitField
+	// devSize is the size of all developer fields, which are skipped.
+	devSize int
+}
+
+// fitMessage holds the numeric fields of a data message. Invalid values
+// are left out.
+type fitMessage map[byte]float64
+
+// decodeFit reads the records, laps and sport of a FIT activity file. Only
+// the parts of the protocol needed for that are implemented.
+func decodeFit(data []byte) ([]trackPoint, fileInfo, error) {
+	var info fileInfo
+	if len(data) < 12 || string(data[8:12]) != ".FIT" {
+		return nil, info, fmt.Errorf("invalid fit file")
+	}
+	headerSize := int(data[0])
+	end := headerSize + int(binary.LittleEndian.Uint32(data[4:8]))
+	if headerSize < 12 || end > len(data) {
+		return nil, info, fmt.Errorf("invalid fit file")
+	}
+	var (
+		definitions   [16]*fitDefinition
+		points        []trackPoint
+		lastTimestamp uint32
+		sport, sub    = -1.0, -1.0
+	)
+	pos := headerSize
+	for pos < end {
+		header := data[pos]
+		pos++
+		local := header & 0x0F
+		var timestamp uint32
+		compressed := header&0x80 != 0
+		if compressed {
+			local = (header >> 5) & 0x03
+			offset := uint32(header & 0x1F)
+			timestamp = lastTimestamp&^0x1F + offset
+			if offset < lastTimestamp&0x1F {
+				timestamp += 0x20
+			}
+			lastTimestamp = timestamp
+		} else if header&0x40 != 0 {
+			def, n, err := readFitDefinition(data[pos:end], header&0x20 != 0)
+			if err != nil {
+				return nil, info, err
+			}
+			definitions[local] = def
+			pos += n
+			continue
+		}
+		def := definitions[local]
+		if def == nil {
+			return nil, info, fmt.Errorf("invalid fit file: data message without definition")
+		}
+		msg := make(fitMessage, len(def.fields))
+		for _, field := range def.fields {
+			if pos+int(field.size) > end {
+				return nil, info, fmt.Errorf("invalid fit file: truncated message")
+			}
+			if v, ok := fitValue(data[pos:pos+int(field.size)], field.baseType, def.bigEndian); ok {
+				msg[field.num] = v
+			}
+			pos += int(field.size)
+		}
+		pos += def.devSize
+		if ts, ok := msg[fitFieldTimestamp]; ok {
+			lastTimestamp = uint32(ts)
+		} else if compressed {
+			msg[fitFieldTimestamp] = float64(timestamp)
+		}
+
+		switch def.global {
+		case fitMesgRecord:
+			if p, ok := msg.trackPoint(); ok {
+				points = append(points, p)
+			}
+		case fitMesgLap:
+			start, ok := msg[2]
+			if !ok {
+				continue
+			}
+			info.laps = append(info.laps, fileLap{
+				start:    fitTime(start),
+				elapsed:  time.Duration(msg[7] / 1000 * float64(time.Second)),
+				distance: msg[9] / 100,
+			})
+		case fitMesgSession:
+			if v, ok := msg[5]; ok && sport < 0 {
+				sport = v
+			}
+			if v, ok := msg[6]; ok && sub < 0 {
+				sub = v
+			}
+		case fitMesgActivity:
+			// local_timestamp tells the time zone the activity was recorded in
+			if local, ok := msg[5]; ok {
+				if ts, ok := msg[fitFieldTimestamp]; ok {
+					info.utcOffset = time.Duration(local-ts) * time.Second
+				}
+			}
+		}
+	}
+	info.sportType = fitSportType(int(sport), int(sub))
+	return points, info, nil
+}
+
+func readFitDefinition(data []byte, developer bool) (*fitDefinition, int, error) {
+	if len(data) < 5 {
+		return nil, 0, fmt.Errorf("invalid fit file: truncated definition")
+	}
+	def := &fitDefinition{bigEndian: data[1] == 1}
+	if def.bigEndian {
+		def.global = binary.BigEndian.Uint16(data[2:4])
+	} else {
+		def.global = binary.LittleEndian.Uint16(data[2:4])
+	}
+	n := int(data[4])
+	pos := 5
+	if len(data) < pos+3*n {
+		return nil, 0, fmt.Errorf("invalid fit file: truncated definition")
+	}
+	for i := 0; i < n; i++ {
+		def.fields = append(def.fields, fitField{data[pos], data[pos+1], data[pos+2]})
+		pos += 3
+	}
+	if developer {
+		if len(data) < pos+1 {
+			return nil, 0, fmt.Errorf("invalid fit file: truncated definition")
+		}
+		n := int(data[pos])
+		pos++
+		if len(data) < pos+3*n {
+			return nil, 0, fmt.Errorf("invalid fit file: truncated definition")
+		}
+		for i := 0; i < n; i++ {
+			def.devSize += int(data[pos+1])
+			pos += 3
+		}
+	}
+	return def, pos, nil
+}
+
+// fitValue decodes a numeric field. It reports false for invalid values
+// and types that are not numbers, like strings and arrays.
+func fitValue(b []byte, baseType byte, bigEndian bool) (float64, bool) {
+	var order binary.ByteOrder = binary.LittleEndian
+	if bigEndian {
+		order = binary.BigEndian
+	}
+	switch baseType & 0x1F {
+	case 0x00, 0x02, 0x0A, 0x0D: // enum, uint8, uint8z, byte
+		if len(b) != 1 || b[0] == 0xFF || (baseType&0x1F == 0x0A && b[0] == 0) {
+			return 0, false
+		}
+		return float64(b[0]), true
+	case 0x01: // sint8
+		if len(b) != 1 || b[0] == 0x7F {
+			return 0, false
+		}
+		return float64(int8(b[0])), true
+	case 0x03: // sint16
+		if len(b) != 2 {
+			return 0, false
+		}
+		v := order.Uint16(b)
+		return float64(int16(v)), v != 0x7FFF
+	case 0x04, 0x0B: // uint16, uint16z
+		if len(b) != 2 {
+			return 0, false
+		}
+		v := order.Uint16(b)
+		return float64(v), v != 0xFFFF && !(baseType&0x1F == 0x0B && v == 0)
+	case 0x05: // sint32
+		if len(b) != 4 {
+			return 0, false
+		}
+		v := order.Uint32(b)
+		return float64(int32(v)), v != 0x7FFFFFFF
+	case 0x06, 0x0C: // uint32, uint32z
+		if len(b) != 4 {
+			return 0, false
+		}
+		v := order.Uint32(b)
+		return float64(v), v != 0xFFFFFFFF && !(baseType&0x1F == 0x0C && v == 0)
+	case 0x08: // float32
+		if len(b) != 4 {
+			return 0, false
+		}
+		v := order.Uint32(b)
+		return float64(math.Float32frombits(v)), v != 0xFFFFFFFF
+	case 0x09: // float64
+		if len(b) != 8 {
+			return 0, false
+		}
+		v := order.Uint64(b)
+		return math.Float64frombits(v), v != 0xFFFFFFFFFFFFFFFF
+	}
+	return 0, false
+}
+
+func fitTime(ts float64) time.Time {
+	return fitEpoch.Add(time.Duration(ts) * time.Second)
+}
+
+// trackPoint converts a record message.
+func (m fitMessage) trackPoint() (trackPoint, bool) {
+	ts, ok := m[fitFieldTimestamp]
+	if !ok {
+		return trackPoint{}, false
+	}
+	p := trackPoint{
+		time:      fitTime(ts),
+		heartrate: m[3],
+		cadence:   m[4],
+		watts:     m[7],
+		distance:  -1,
+	}
+	lat, okLat := m[0]
+	lng, okLng := m[1]
+	if okLat && okLng {
+		// positions are stored in semicircles
+		p.latLng = LatLng{lat * 180 / math.MaxInt32, lng * 180 / math.MaxInt32}
+		p.hasLatLng = true
+	}
+	if d, ok := m[5]; ok {
+		p.distance = d / 100
+	}
+	if v, ok := m[73]; ok {
+		p.speed = v / 1000
+	} else if v, ok := m[6]; ok {
+		p.speed = v / 1000
+	}
+	if v, ok := m[78]; ok {
+		p.altitude = v/5 - 500
+	} else if v, ok := m[2]; ok {
+		p.altitude = v/5 - 500
+	}
+	return p, true
+}
+
+// fitSportType maps the sport and sub sport of a session to a Strava sport
+// type.
+func fitSportType(sport, sub int) string {
+	switch sport {
+	case 1:
+		if sub == 3 {
+			return "TrailRun"
+		}
+		if sub == 45 {
+			return "VirtualRun"
+		}
+		return "Run"
+	case 2:
+		switch sub {
+		case 6, 58:
+			return "VirtualRide"
+		case 7, 8:
+			return "MountainBikeRide"
+		case 46:
+			return "GravelRide"
+		}
+		return "Ride"
+	case 5:
+		return "Swim"
+	case 10:
+		return "WeightTraining"
+	case 11:
+		return "Walk"
+	case 12:
+		return "NordicSki"
+	case 13:
+		return "AlpineSki"
+	case 15:
+		return "Rowing"
+	case 17:
+		return "Hike"
+	case 37:
+		return "StandUpPaddling"
+	case 41:
+		return "Kayaking"
+	}
+	return "Workout"
+}
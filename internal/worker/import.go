@@ -0,0 +1,333 @@
+package worker
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"sort"
+	"stravafy/internal/config"
+	"stravafy/internal/database"
+	"stravafy/internal/music"
+	"strings"
+	"sync"
+	"time"
+)
+
+// playGap is the longest silence between two plays that is not recorded
+// as a pause.
+const playGap = 5 * time.Second
+
+const (
+	// maxStreamingHistoryFileSize caps a single file of the export, Spotify
+	// splits the history into files of about 12 MB.
+	maxStreamingHistoryFileSize = 64 << 20
+	// MaxStreamingHistorySize caps all files of an import together, after
+	// decompressing them.
+	MaxStreamingHistorySize = 256 << 20
+	// maxStreamingHistoryFiles caps the number of files of an import.
+	maxStreamingHistoryFiles = 100
+	// importBatchSize is how many plays are imported per transaction.
+	importBatchSize = 500
+)
+
+var (
+	ErrImportRunning  = errors.New("an import is already running")
+	ErrImportTooLarge = fmt.Errorf("the streaming history is larger than %d MB or has more than %d files",
+		MaxStreamingHistorySize>>20, maxStreamingHistoryFiles)
+	errImportStopped = errors.New("import stopped")
+)
+
+// ImportResult counts what an import of streaming history did.
+type ImportResult struct {
+	Plays      int
+	Imported   int
+	Duplicates int
+	Skipped    int
+}
+
+// ImportStatus is the progress of an import.
+type ImportStatus struct {
+	Result   ImportResult
+	Running  bool
+	Started  time.Time
+	Finished time.Time
+	Error    string
+}
+
+var (
+	importsMu sync.Mutex
+	imports   = make(map[int64]*ImportStatus)
+)
+
+// StreamingHistoryReader reads the files of one import and keeps them
+// within MaxStreamingHistorySize and maxStreamingHistoryFiles together.
+type StreamingHistoryReader struct {
+	size  int64
+	files int
+}
+
+// Read decodes the plays in a file of the extended streaming history
+// export. This is either one of the Streaming_History_Audio_*.json files or
+// the zip file Spotify sends, which contains all of them.
+func (h *StreamingHistoryReader) Read(name string, r io.ReaderAt, size int64) ([]StreamingHistoryPlay, error) {
+	if !strings.EqualFold(path.Ext(name), ".zip") {
+		return h.decode(io.NewSectionReader(r, 0, size), size)
+	}
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	var plays []StreamingHistoryPlay
+	for _, f := range zr.File {
+		base := path.Base(f.Name)
+		if !strings.HasPrefix(base, "Streaming_History_Audio_") || path.Ext(base) != ".json" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		filePlays, err := h.decode(rc, int64(min(f.UncompressedSize64, math.MaxInt64)))
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", base, err)
+		}
+		plays = append(plays, filePlays...)
+	}
+	if len(plays) == 0 {
+		return nil, fmt.Errorf("%s contains no Streaming_History_Audio_*.json files", name)
+	}
+	return plays, nil
+}
+
+// decode decodes one json file of size bytes. The size of zip entries is
+// not checked while inflating, so what is actually read counts.
+func (h *StreamingHistoryReader) decode(r io.Reader, size int64) ([]StreamingHistoryPlay, error) {
+	h.files++
+	if h.files > maxStreamingHistoryFiles {
+		return nil, ErrImportTooLarge
+	}
+	errFileTooLarge := fmt.Errorf("the file is larger than %d MB", maxStreamingHistoryFileSize>>20)
+	if size > maxStreamingHistoryFileSize {
+		return nil, errFileTooLarge
+	}
+	left := MaxStreamingHistorySize - h.size
+	if size > left {
+		return nil, ErrImportTooLarge
+	}
+	limit := min(int64(maxStreamingHistoryFileSize), left)
+	lr := &io.LimitedReader{R: r, N: limit + 1}
+	plays, err := decodeStreamingHistory(lr)
+	h.size += limit + 1 - lr.N
+	if lr.N == 0 && limit < maxStreamingHistoryFileSize {
+		return nil, ErrImportTooLarge
+	}
+	if lr.N == 0 {
+		return nil, errFileTooLarge
+	}
+	return plays, err
+}
+
+func decodeStreamingHistory(r io.Reader) ([]StreamingHistoryPlay, error) {
+	var plays []StreamingHistoryPlay
+	err := json.NewDecoder(r).Decode(&plays)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode streaming history: %v", err)
+	}
+	return plays, nil
+}
+
+// StartImport imports plays into the history of userID in the background.
+// Only one import per user runs at a time.
+func StartImport(q *database.Queries, userID int64, plays []StreamingHistoryPlay) error {
+	importsMu.Lock()
+	if status, ok := imports[userID]; ok && status.Running {
+		importsMu.Unlock()
+		return ErrImportRunning
+	}
+	status := &ImportStatus{Running: true, Started: time.Now(), Result: ImportResult{Plays: len(plays)}}
+	imports[userID] = status
+	importsMu.Unlock()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := ImportStreamingHistory(q, userID, plays, shutdownCh, func(result ImportResult) {
+			importsMu.Lock()
+			defer importsMu.Unlock()
+			status.Result = result
+		})
+		importsMu.Lock()
+		defer importsMu.Unlock()
+		status.Running = false
+		status.Finished = time.Now()
+		if err != nil {
+			errorf(userID, "import: %v", err)
+			status.Error = err.Error()
+		}
+	}()
+	return nil
+}
+
+// GetImportStatus returns the status of the last import of userID.
+func GetImportStatus(userID int64) (ImportStatus, bool) {
+	importsMu.Lock()
+	defer importsMu.Unlock()
+	status, ok := imports[userID]
+	if !ok {
+		return ImportStatus{}, false
+	}
+	return *status, true
+}
+
+// ImportStreamingHistory adds plays to the history of userID. Plays the
+// poller or an earlier import already recorded are skipped, so the same
+// export can be imported again. Every batch is committed on its own and
+// reported to progress, the import ends early once stop is closed.
+func ImportStreamingHistory(q *database.Queries, userID int64, plays []StreamingHistoryPlay, stop <-chan struct{}, progress func(ImportResult)) error {
+	result := ImportResult{Plays: len(plays)}
+	sort.SliceStable(plays, func(i, j int) bool {
+		return plays[i].start().Before(plays[j].start())
+	})
+	db, err := database.NewSQLite()
+	if err != nil {
+		return err
+	}
+	infof(userID, "importing %d plays", len(plays))
+	for start := 0; start < len(plays); start += importBatchSize {
+		select {
+		case <-stop:
+			return errImportStopped
+		default:
+		}
+		end := min(start+importBatchSize, len(plays))
+		err := importBatch(db, q, userID, plays, start, end, &result)
+		if err != nil {
+			return err
+		}
+		progress(result)
+	}
+	infof(userID, "imported %d plays, %d duplicates, %d skipped", result.Imported, result.Duplicates, result.Skipped)
+	return nil
+}
+
+// importBatch imports plays[start:end] in one transaction. The play after
+// the batch is still needed to tell where a pause goes.
+func importBatch(db *database.SQLite, q *database.Queries, userID int64, plays []StreamingHistoryPlay, start int, end int, result *ImportResult) error {
+	tolerance := time.Duration(config.GetConfig().Spotify.UpdateInterval) * time.Second
+	tx, err := db.DB.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	qtx := q.WithTx(tx)
+	ctx := context.Background()
+	batch := *result
+	for i := start; i < end; i++ {
+		exported := plays[i]
+		play := exported.play()
+		if play.Item.Uri == "" || exported.MsPlayed <= 0 {
+			batch.Skipped++
+			continue
+		}
+		playedAt := play.PlayedAt
+		count, err := qtx.CountHistoryItemsBetween(ctx, database.CountHistoryItemsBetweenParams{
+			UserID:      userID,
+			Uri:         play.Item.Uri,
+			Timestamp:   play.Start.Add(-tolerance),
+			Timestamp_2: playedAt,
+		})
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			batch.Duplicates++
+			continue
+		}
+		histId, err := insertHistoryEntry(userID, qtx, music.SourceSpotify, play)
+		if err != nil {
+			return err
+		}
+		err = qtx.InsertHistoryImported(ctx, database.InsertHistoryImportedParams{
+			HistoryID: histId,
+			PlayedAt:  playedAt,
+			MsPlayed:  exported.MsPlayed,
+		})
+		if err != nil {
+			return err
+		}
+		batch.Imported++
+
+		next := playedAt.Add(tolerance)
+		if i+1 < len(plays) {
+			next = plays[i+1].start()
+		}
+		err = endPlay(userID, qtx, music.SourceSpotify, playedAt, next, tolerance)
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	*result = batch
+	return nil
+}
+
+// endPlay records a pause at end unless something else started right
+// after it. A play lasts until the next history entry, which could be hours
+// later otherwise. next is when the next known play starts, source is the
+// source of the play that ends.
+func endPlay(userID int64, q *database.Queries, source string, end time.Time, next time.Time, tolerance time.Duration) error {
+	if limit := end.Add(tolerance); next.After(limit) {
+		next = limit
+	}
+	if next.Sub(end) <= playGap {
+		return nil
+	}
+	count, err := q.CountHistoryEntriesBetween(context.Background(), database.CountHistoryEntriesBetweenParams{
+		UserID:      userID,
+		Timestamp:   end,
+		Timestamp_2: next,
+	})
+	if err != nil || count > 0 {
+		return err
+	}
+	_, err = q.InsertHistory(context.Background(), database.InsertHistoryParams{
+		UserID:    userID,
+		Source:    source,
+		Timestamp: end,
+		IsPlaying: false,
+	})
+	return err
+}
+
+func (p StreamingHistoryPlay) start() time.Time {
+	return p.Ts.UTC().Add(-time.Duration(p.MsPlayed) * time.Millisecond)
+}
+
+// play converts the export entry to a play. The export has no album or
+// show uris and only the first artist.
+func (p StreamingHistoryPlay) play() music.Play {
+	play := music.Play{
+		Start:    p.start(),
+		PlayedAt: p.Ts.UTC(),
+	}
+	switch {
+	case p.TrackUri != "":
+		play.Item = music.SpotifyItem("track", p.TrackUri, p.TrackName)
+		play.Item.Artists = []string{p.ArtistName}
+		play.Item.Album = p.AlbumName
+	case p.EpisodeUri != "":
+		play.Item = music.SpotifyItem("episode", p.EpisodeUri, p.EpisodeName)
+		play.Item.Episode = &music.Episode{Show: p.EpisodeShowName}
+	}
+	play.Item.Duration = time.Duration(p.MsPlayed) * time.Millisecond
+	return play
+}
@@ -0,0 +1,53 @@
+package worker
+
+import (
+	"context"
+	"database/sql"
+	"stravafy/internal/database"
+	"stravafy/internal/description"
+)
+
+// PowerSongMinSeconds is how long a track has to play during activities in
+// total to rank as a power song, so a few seconds of a sprint don't count.
+const PowerSongMinSeconds = 180
+
+// storeTrackMetrics replaces the per track metrics of an activity, the base
+// for the power songs ranking.
+func storeTrackMetrics(q *database.Queries, userID int64, activityID int64, data description.Data) error {
+	err := q.DeleteTrackMetricsForActivity(context.Background(), database.DeleteTrackMetricsForActivityParams{
+		ActivityID: activityID,
+		UserID:     userID,
+	})
+	if err != nil {
+		return err
+	}
+	for _, track := range data.Tracks {
+		if track.Metrics.Samples == 0 {
+			continue
+		}
+		err := q.InsertTrackMetric(context.Background(), database.InsertTrackMetricParams{
+			UserID:          userID,
+			ActivityID:      activityID,
+			HistoryID:       track.HistoryID,
+			TrackUri:        track.Uri,
+			TrackName:       track.Name,
+			Artists:         track.Artists,
+			OffsetSeconds:   int64(track.Offset.Seconds()),
+			DurationSeconds: int64(track.Duration.Seconds()),
+			Samples:         int64(track.Metrics.Samples),
+			Heartrate:       nullFloat(track.Metrics.HeartRate),
+			Speed:           nullFloat(track.Metrics.Speed),
+			Watts:           nullFloat(track.Metrics.Watts),
+			Cadence:         nullFloat(track.Metrics.Cadence),
+			Effort:          track.Metrics.Effort,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func nullFloat(f float64) sql.NullFloat64 {
+	return sql.NullFloat64{Float64: f, Valid: f > 0}
+}
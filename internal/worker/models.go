@@ -1,7 +1,6 @@
 package worker
 
 import (
-	"encoding/json"
 	"time"
 )
 
@@ -13,74 +12,22 @@ type Callback struct {
 	OwnerId        int64             `json:"owner_id"`
 	SubscriptionId int64             `json:"subscription_id"`
 	EventTime      int64             `json:"event_time"`
+	// eventID is the queued strava_event the callback was read from.
+	eventID int64
 }
 
-type ExternalUrls struct {
-	Spotify string `json:"spotify"`
-}
-
-type PlayerContext struct {
-	Type         string       `json:"type"`
-	Href         string       `json:"href"`
-	ExternalUrls ExternalUrls `json:"external_urls"`
-	Uri          string       `json:"uri"`
-}
-
-type PlayerState struct {
-	Timestamp            int64           `json:"timestamp"`
-	IsPlaying            bool            `json:"is_playing"`
-	CurrentlyPlayingType string          `json:"currently_playing_type"`
-	Context              *PlayerContext  `json:"context"`
-	Item                 json.RawMessage `json:"item"`
-}
-
-type Artist struct {
-	Href         string       `json:"href"`
-	Id           string       `json:"id"`
-	Name         string       `json:"name"`
-	Type         string       `json:"type"`
-	Uri          string       `json:"uri"`
-	ExternalUrls ExternalUrls `json:"external_urls"`
-}
-
-type AlbumObject struct {
-	AlbumType    string       `json:"album_type;required"`
-	ExternalUrls ExternalUrls `json:"external_urls"`
-	Href         string       `json:"href"`
-	Id           string       `json:"id"`
-	Name         string       `json:"name"`
-	Type         string       `json:"type"`
-	Uri          string       `json:"uri"`
-	Artists      []Artist     `json:"artists"`
-}
-
-type ShowObject struct {
-	Description string `json:"description"`
-	Href        string `json:"href"`
-	Id          string `json:"id"`
-	Name        string `json:"name"`
-	Uri         string `json:"uri"`
-}
-
-type TrackObject struct {
-	ItemObject
-	Album   AlbumObject `json:"album"`
-	Artists []Artist    `json:"artists"`
-}
-
-type EpisodeObject struct {
-	ItemObject
-	Description string     `json:"description"`
-	Show        ShowObject `json:"show"`
-}
-
-type ItemObject struct {
-	ExternalUrls ExternalUrls `json:"external_urls"`
-	Href         string       `json:"href"`
-	Id           string       `json:"id"`
-	Name         string       `json:"name"`
-	Type         string       `json:"type"`
-	Uri          string       `json:"uri"`
+// StreamingHistoryPlay is a play in Spotify's extended streaming history
+// export. Ts is the time playback stopped.
+type StreamingHistoryPlay struct {
+	Ts              time.Time `json:"ts"`
+	MsPlayed        int64     `json:"ms_played"`
+	TrackName       string    `json:"master_metadata_track_name"`
+	ArtistName      string    `json:"master_metadata_album_artist_name"`
+	AlbumName       string    `json:"master_metadata_album_album_name"`
+	TrackUri        string    `json:"spotify_track_uri"`
+	EpisodeName     string    `json:"episode_name"`
+	EpisodeShowName string    `json:"episode_show_name"`
+	EpisodeUri      string    `json:"spotify_episode_uri"`
 }
 
 type MetaAthlete struct {
@@ -142,6 +89,16 @@ type Lap struct {
 	TotalElevationGain float64      `json:"total_elevation_gain"`
 }
 
+type Split struct {
+	AverageSpeed        float64 `json:"average_speed"`
+	Distance            float64 `json:"distance"`
+	ElapsedTime         int     `json:"elapsed_time"`
+	ElevationDifference float64 `json:"elevation_difference"`
+	MovingTime          int     `json:"moving_time"`
+	PaceZone            int     `json:"pace_zone"`
+	Split               int     `json:"split"`
+}
+
 type MetaActivity struct {
 	ID int64 `json:"id"`
 }
@@ -176,11 +133,15 @@ type DetailedActivity struct {
 	Commute              bool          `json:"commute"`
 	Manual               bool          `json:"manual"`
 	Private              bool          `json:"private"`
+	Visibility           string        `json:"visibility"`
 	Flagged              bool          `json:"flagged"`
 	WorkoutType          int           `json:"workout_type"`
 	UploadIdString       string        `json:"upload_id_str"`
 	AverageSpeed         float64       `json:"average_speed"`
 	MaxSpeed             float64       `json:"max_speed"`
+	HasHeartrate         bool          `json:"has_heartrate"`
+	AverageHeartrate     float64       `json:"average_heartrate"`
+	MaxHeartrate         float64       `json:"max_heartrate"`
 	HasKudos             bool          `json:"has_kudos"`
 	HideFromHome         bool          `json:"hide_from_home"`
 	GearID               string        `json:"gear_id"`
@@ -195,4 +156,41 @@ type DetailedActivity struct {
 	DeviceName           string        `json:"device_name"`
 	EmbedToken           string        `json:"embed_token"`
 	Laps                 []Lap         `json:"laps"`
+	SplitsMetric         []Split       `json:"splits_metric"`
+}
+
+type Stream struct {
+	Data         []float64 `json:"data"`
+	SeriesType   string    `json:"series_type"`
+	OriginalSize int       `json:"original_size"`
+	Resolution   string    `json:"resolution"`
+}
+
+type LatLngStream struct {
+	Data         []LatLng `json:"data"`
+	SeriesType   string   `json:"series_type"`
+	OriginalSize int      `json:"original_size"`
+	Resolution   string   `json:"resolution"`
+}
+
+// StreamSet is the response of /activities/{id}/streams with key_by_type.
+type StreamSet struct {
+	Time           *Stream       `json:"time"`
+	Distance       *Stream       `json:"distance"`
+	Latlng         *LatLngStream `json:"latlng"`
+	Altitude       *Stream       `json:"altitude"`
+	Heartrate      *Stream       `json:"heartrate"`
+	VelocitySmooth *Stream       `json:"velocity_smooth"`
+	Watts          *Stream       `json:"watts"`
+	Cadence        *Stream       `json:"cadence"`
+}
+
+// Upload is the state of a file uploaded to Strava.
+type Upload struct {
+	ID         int64  `json:"id"`
+	IdStr      string `json:"id_str"`
+	ExternalID string `json:"external_id"`
+	Error      string `json:"error"`
+	Status     string `json:"status"`
+	ActivityID int64  `json:"activity_id"`
 }
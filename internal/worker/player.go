@@ -0,0 +1,56 @@
+package worker
+
+import (
+	"stravafy/internal/music"
+	"sync"
+	"time"
+)
+
+// PlayerState is what the player of a user was doing when the worker last
+// noticed a change.
+type PlayerState struct {
+	UserID int64
+	// Play is nil while nothing is playing.
+	Play    *music.Play
+	Source  string
+	Updated time.Time
+}
+
+var player = struct {
+	sync.Mutex
+	subscribers map[int64]map[chan PlayerState]struct{}
+}{subscribers: make(map[int64]map[chan PlayerState]struct{})}
+
+// SubscribePlayer returns a channel that receives the player state of
+// userID whenever it changes, and a function to unsubscribe. Subscribers
+// that fall behind only get the latest state.
+func SubscribePlayer(userID int64) (<-chan PlayerState, func()) {
+	ch := make(chan PlayerState, 1)
+	player.Lock()
+	defer player.Unlock()
+	if player.subscribers[userID] == nil {
+		player.subscribers[userID] = make(map[chan PlayerState]struct{})
+	}
+	player.subscribers[userID][ch] = struct{}{}
+	return ch, func() {
+		player.Lock()
+		defer player.Unlock()
+		delete(player.subscribers[userID], ch)
+		if len(player.subscribers[userID]) == 0 {
+			delete(player.subscribers, userID)
+		}
+	}
+}
+
+func publishPlayer(state PlayerState) {
+	player.Lock()
+	defer player.Unlock()
+	for ch := range player.subscribers[state.UserID] {
+		// replace a state the subscriber has not picked up yet
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- state
+	}
+}
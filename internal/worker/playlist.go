@@ -0,0 +1,189 @@
+package worker
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"stravafy/internal/config"
+	"stravafy/internal/database"
+	"stravafy/internal/description"
+	"stravafy/internal/music"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrPlaylistScope is returned if the user connected Spotify before
+	// playlists could be created and has to connect it again.
+	ErrPlaylistScope = errors.New("connect Spotify again to allow creating playlists")
+	// ErrNoSpotifyItems is returned for activities without anything played
+	// on Spotify.
+	ErrNoSpotifyItems = errors.New("nothing from Spotify was played during this activity")
+	// ErrActivityNotStored is returned for activities that are not stored
+	// for the user.
+	ErrActivityNotStored = errors.New("activity not found")
+)
+
+// CanCreatePlaylists reports whether userID allowed Stravafy to create
+// playlists on Spotify.
+func CanCreatePlaylists(q *database.Queries, userID int64) (bool, error) {
+	return hasSpotifyScope(q, userID, config.SpotifyPlaylistScope)
+}
+
+// CanReadRecentPlays reports whether userID allowed Stravafy to read what
+// they recently played on Spotify.
+func CanReadRecentPlays(q *database.Queries, userID int64) (bool, error) {
+	return hasSpotifyScope(q, userID, config.SpotifyRecentlyPlayedScope)
+}
+
+// hasSpotifyScope reports whether userID granted scope on their last
+// Spotify login.
+func hasSpotifyScope(q *database.Queries, userID int64, scope string) (bool, error) {
+	granted, err := q.GetSpotifyScope(context.Background(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(strings.Fields(granted), scope), nil
+}
+
+// PlaylistSettings returns the playlist settings of userID, everything off
+// if they never saved any.
+func PlaylistSettings(q *database.Queries, userID int64) (database.PlaylistSetting, error) {
+	settings, err := q.GetPlaylistSettings(context.Background(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.PlaylistSetting{UserID: userID}, nil
+	}
+	return settings, err
+}
+
+// CreateActivityPlaylist creates the playlist of an activity on request and
+// returns its url. If the user wants the link in the description, the
+// soundtrack written to Strava is replaced.
+func CreateActivityPlaylist(q *database.Queries, userID int64, activityID int64) (string, error) {
+	user, err := q.GetUserById(context.Background(), userID)
+	if err != nil {
+		return "", err
+	}
+	event := Callback{
+		ObjectType: ObjectTypeActivity,
+		ObjectId:   activityID,
+		AspectType: AspectTypeUpdate,
+		OwnerId:    user.StravaID,
+		EventTime:  time.Now().Unix(),
+	}
+	infof(event.EventTime, "creating playlist for activity %d", activityID)
+	// only the owner's stored activities, Strava also returns public ones
+	// of others
+	_, err = q.GetActivity(context.Background(), database.GetActivityParams{ID: activityID, UserID: userID})
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrActivityNotStored
+	}
+	if err != nil {
+		return "", err
+	}
+	activity, err := FetchActivity(q, userID, activityID)
+	if err != nil {
+		return "", err
+	}
+	data, err := ActivitySoundtrack(q, userID, activity)
+	if err != nil {
+		return "", err
+	}
+	playlistUrl, err := activityPlaylist(event.EventTime, q, userID, activity, data, true)
+	if err != nil {
+		return "", err
+	}
+	settings, err := PlaylistSettings(q, userID)
+	if err != nil || !settings.AddToDescription {
+		return playlistUrl, err
+	}
+	previous, err := q.GetActivitySoundtrack(context.Background(), database.GetActivitySoundtrackParams{ActivityID: activityID, UserID: userID})
+	if errors.Is(err, sql.ErrNoRows) {
+		return playlistUrl, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return playlistUrl, rewriteSoundtrack(event, q, user, activity, previous)
+}
+
+// activityPlaylist returns the url of the playlist of activity. If there is
+// none yet and create is set, it is created from the Spotify tracks and
+// episodes in data.
+func activityPlaylist(id int64, q *database.Queries, userID int64, activity *DetailedActivity, data description.Data, create bool) (string, error) {
+	existing, err := q.GetActivityPlaylist(context.Background(), database.GetActivityPlaylistParams{ActivityID: activity.ID, UserID: userID})
+	if err == nil {
+		return existing.Url, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	if !create {
+		return "", nil
+	}
+	allowed, err := CanCreatePlaylists(q, userID)
+	if err != nil {
+		return "", err
+	}
+	if !allowed {
+		return "", ErrPlaylistScope
+	}
+	uris := spotifyUris(data)
+	if len(uris) == 0 {
+		return "", ErrNoSpotifyItems
+	}
+	info, err := q.GetSpotifyUserInfo(context.Background(), userID)
+	if err != nil {
+		return "", err
+	}
+	playlistDescription := fmt.Sprintf("Played during %s on %s", activity.Name, activity.StartDateLocal.Format("January 2, 2006"))
+	playlist, err := music.NewSpotify(q, userID).CreatePlaylist(context.Background(), info.SpotifyID, activity.Name, playlistDescription, uris)
+	if err != nil {
+		return "", fmt.Errorf("creating playlist: %v", err)
+	}
+	infof(id, "created playlist %s with %d items", playlist.Url, len(uris))
+	err = q.InsertActivityPlaylist(context.Background(), database.InsertActivityPlaylistParams{
+		ActivityID: activity.ID,
+		UserID:     userID,
+		PlaylistID: playlist.ID,
+		Url:        playlist.Url,
+	})
+	if err != nil {
+		return "", err
+	}
+	return playlist.Url, nil
+}
+
+// spotifyUris lists the Spotify tracks and episodes of data in the order
+// they were played.
+func spotifyUris(data description.Data) []string {
+	type played struct {
+		uri    string
+		offset time.Duration
+	}
+	var items []played
+	for _, track := range data.Tracks {
+		if strings.HasPrefix(track.Uri, "spotify:track:") {
+			items = append(items, played{track.Uri, track.Offset})
+		}
+	}
+	for _, episode := range data.Episodes {
+		if strings.HasPrefix(episode.Uri, "spotify:episode:") {
+			items = append(items, played{episode.Uri, episode.Offset})
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].offset < items[j].offset
+	})
+	uris := make([]string, 0, len(items))
+	for _, item := range items {
+		uris = append(uris, item.uri)
+	}
+	return uris
+}
@@ -0,0 +1,176 @@
+package worker
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"stravafy/internal/config"
+	"stravafy/internal/database"
+	"time"
+)
+
+const (
+	EventStatePending    = "pending"
+	EventStateProcessing = "processing"
+	EventStateDone       = "done"
+	EventStateFailed     = "failed"
+	EventStateDead       = "dead"
+)
+
+// queueID is the id used for log lines of the event queue itself.
+const queueID = 0
+
+var queueNotify = make(chan struct{}, 1)
+
+// EnqueueStravaEvent stores event so it survives restarts and wakes up the
+// event queue. The event is only acknowledged once it is persisted.
+func EnqueueStravaEvent(ctx context.Context, q *database.Queries, event Callback) error {
+	updates, err := json.Marshal(event.Updates)
+	if err != nil {
+		return err
+	}
+	id, err := q.InsertStravaEvent(ctx, database.InsertStravaEventParams{
+		ObjectType:     event.ObjectType,
+		ObjectID:       event.ObjectId,
+		AspectType:     event.AspectType,
+		Updates:        string(updates),
+		OwnerID:        event.OwnerId,
+		SubscriptionID: event.SubscriptionId,
+		EventTime:      event.EventTime,
+		NextAttemptAt:  time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	infof(event.EventTime, "queued as event %d", id)
+	select {
+	case queueNotify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func eventQueue(q *database.Queries, shutdown <-chan struct{}) {
+	defer wg.Done()
+	// events that were processing when the process died are picked up again
+	n, err := q.ResetProcessingStravaEvents(context.Background())
+	if err != nil {
+		errorf(queueID, "recovering events: %v", err)
+	} else if n > 0 {
+		infof(queueID, "recovered %d unfinished events", n)
+	}
+
+	conf := config.GetConfig()
+	ticker := time.Tick(time.Duration(conf.Events.PollInterval) * time.Second)
+	pruneTicker := time.Tick(time.Hour)
+	pruneEvents(q)
+	for {
+		dispatchDueEvents(q)
+		select {
+		case <-pruneTicker:
+			pruneEvents(q)
+		case <-ticker:
+		case <-queueNotify:
+		case <-shutdown:
+			infof(queueID, "shutting down event queue")
+			return
+		}
+	}
+}
+
+func dispatchDueEvents(q *database.Queries) {
+	events, err := q.GetDueStravaEvents(context.Background(), database.GetDueStravaEventsParams{
+		NextAttemptAt: time.Now().UTC(),
+		Limit:         50,
+	})
+	if err != nil {
+		errorf(queueID, "fetching due events: %v", err)
+		return
+	}
+	for _, event := range events {
+		claimed, err := q.ClaimStravaEvent(context.Background(), event.ID)
+		if err != nil {
+			errorf(queueID, "claiming event %d: %v", event.ID, err)
+			continue
+		}
+		if claimed == 0 {
+			continue
+		}
+		// at most one event per object is due at a time, see
+		// GetDueStravaEvents
+		wg.Add(1)
+		go processEvent(q, event)
+	}
+}
+
+func processEvent(q *database.Queries, event database.StravaEvent) {
+	defer wg.Done()
+	callback := Callback{
+		ObjectType:     event.ObjectType,
+		ObjectId:       event.ObjectID,
+		AspectType:     event.AspectType,
+		OwnerId:        event.OwnerID,
+		SubscriptionId: event.SubscriptionID,
+		EventTime:      event.EventTime,
+		eventID:        event.ID,
+	}
+	err := json.Unmarshal([]byte(event.Updates), &callback.Updates)
+	if err == nil {
+		err = handleStravaEvent(callback)
+	}
+	attempts := event.Attempts + 1
+	params := database.FinishStravaEventParams{
+		ID:            event.ID,
+		State:         EventStateDone,
+		NextAttemptAt: event.NextAttemptAt,
+	}
+	if err != nil {
+		conf := config.GetConfig()
+		params.LastError = sql.NullString{String: err.Error(), Valid: true}
+		if unretryable(err) {
+			errorf(event.EventTime, "giving up on event %d, retrying won't help: %v", event.ID, err)
+			params.State = EventStateDead
+		} else if attempts >= int64(conf.Events.MaxAttempts) {
+			errorf(event.EventTime, "giving up on event %d after %d attempts: %v", event.ID, attempts, err)
+			params.State = EventStateDead
+		} else {
+			delay := time.Duration(conf.Events.RetryBaseDelay) * time.Second << (attempts - 1)
+			errorf(event.EventTime, "event %d failed (attempt %d), retrying in %s: %v", event.ID, attempts, delay, err)
+			params.State = EventStateFailed
+			params.NextAttemptAt = time.Now().UTC().Add(delay)
+		}
+	}
+	err = q.FinishStravaEvent(context.Background(), params)
+	if err != nil {
+		errorf(event.EventTime, "updating state of event %d: %v", event.ID, err)
+	}
+	// the next event of the object may be waiting for this one
+	select {
+	case queueNotify <- struct{}{}:
+	default:
+	}
+}
+
+// unretryable reports whether err will happen again on every attempt, like
+// for events of athletes that are not signed up or activities that are gone.
+func unretryable(err error) bool {
+	var syntaxErr *json.SyntaxError
+	return errors.Is(err, ErrUnknownAthlete) || errors.Is(err, ErrActivityNotFound) || errors.As(err, &syntaxErr)
+}
+
+// pruneEvents deletes finished events older than the retention period.
+func pruneEvents(q *database.Queries) {
+	days := config.GetConfig().Events.RetentionDays
+	if days <= 0 {
+		days = config.DefaultConfig().Events.RetentionDays
+	}
+	n, err := q.DeleteFinishedStravaEvents(context.Background(), time.Now().UTC().AddDate(0, 0, -days))
+	if err != nil {
+		errorf(queueID, "pruning events: %v", err)
+		return
+	}
+	if n > 0 {
+		infof(queueID, "pruned %d finished events", n)
+	}
+}
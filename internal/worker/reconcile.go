@@ -0,0 +1,87 @@
+package worker
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"stravafy/internal/config"
+	"stravafy/internal/database"
+	"stravafy/internal/music"
+	"time"
+)
+
+// reconcileRecentPlays fills gaps in the polled history with the plays the
+// source reports as recently played. Songs shorter than the update interval
+// or played while the worker was down only show up there.
+func reconcileRecentPlays(id int64, q *database.Queries, source music.Source) error {
+	allowed, err := CanReadRecentPlays(q, id)
+	if err != nil || !allowed {
+		return err
+	}
+	infof(id, "reconciling recent plays")
+	after, err := q.GetRecentlyPlayedCursor(context.Background(), id)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	conf := config.GetConfig()
+	tolerance := time.Duration(conf.Spotify.UpdateInterval) * time.Second
+
+	plays, err := source.RecentPlays(context.Background(), time.UnixMilli(after))
+	if err != nil {
+		return err
+	}
+	merged := 0
+	for i, play := range plays {
+		next := play.PlayedAt.Add(tolerance)
+		if i+1 < len(plays) {
+			next = plays[i+1].Start
+		}
+		ok, err := mergeRecentPlay(id, q, source.Name(), play, next, tolerance)
+		if err != nil {
+			return err
+		}
+		if ok {
+			merged++
+		}
+		after = max(after, play.PlayedAt.UnixMilli())
+	}
+	infof(id, "merged %d of %d recent plays", merged, len(plays))
+	if len(plays) == 0 {
+		return nil
+	}
+	return q.UpsertRecentlyPlayedCursor(context.Background(), database.UpsertRecentlyPlayedCursorParams{
+		UserID:      id,
+		PlayedAfter: after,
+	})
+}
+
+// mergeRecentPlay inserts play into the history unless the poller already
+// recorded the same item while it was playing, and ends it unless
+// something else started right after it. next is when the next recent play
+// starts. It reports whether a new entry was written.
+func mergeRecentPlay(id int64, q *database.Queries, source string, play music.Play, next time.Time, tolerance time.Duration) (bool, error) {
+	count, err := q.CountHistoryItemsBetween(context.Background(), database.CountHistoryItemsBetweenParams{
+		UserID:      id,
+		Uri:         play.Item.Uri,
+		Timestamp:   play.Start.Add(-tolerance),
+		Timestamp_2: play.PlayedAt,
+	})
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, nil
+	}
+	histId, err := insertHistoryEntry(id, q, source, play)
+	if err != nil {
+		return false, err
+	}
+	err = q.InsertHistoryReconciled(context.Background(), database.InsertHistoryReconciledParams{
+		HistoryID: histId,
+		PlayedAt:  play.PlayedAt,
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, endPlay(id, q, source, play.PlayedAt, next, tolerance)
+}
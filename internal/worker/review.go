@@ -0,0 +1,294 @@
+package worker
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"stravafy/internal/config"
+	"stravafy/internal/database"
+	"stravafy/internal/description"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrPendingNotFound    = errors.New("pending description not found")
+	ErrApprovalExpired    = errors.New("approval link expired")
+	ErrDescriptionTooLong = fmt.Errorf("the description is longer than %d characters", description.MaxLength)
+	ErrNotifyUrl          = errors.New("the notification url must be an https url of a public host")
+)
+
+// approvalLifetime is how long the link in a review notification works.
+// After that the change can only be approved when logged in.
+const approvalLifetime = 7 * 24 * time.Hour
+
+// notifyClient only connects to public addresses, the notification url is
+// chosen by the user. Redirects are not followed.
+var notifyClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: dialPublic,
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// ReviewSettings returns the review settings of userID, publishing right
+// away if they never saved any.
+func ReviewSettings(q *database.Queries, userID int64) (database.ReviewSetting, error) {
+	settings, err := q.GetReviewSettings(context.Background(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.ReviewSetting{UserID: userID}, nil
+	}
+	return settings, err
+}
+
+// submitSoundtrack appends soundtrack to base and writes the result to
+// Strava, or keeps it for approval if the user reviews descriptions first.
+func submitSoundtrack(id int64, q *database.Queries, userID int64, activity *DetailedActivity, base, soundtrack string) error {
+	newDescription := withSoundtrack(base, soundtrack)
+	if newDescription == activity.Description {
+		infof(id, "done")
+		return nil
+	}
+	settings, err := ReviewSettings(q, userID)
+	if err != nil {
+		return err
+	}
+	if settings.Enabled {
+		return proposeSoundtrack(id, q, userID, activity, soundtrack, settings)
+	}
+	return publishSoundtrack(id, q, userID, activity, newDescription, soundtrack)
+}
+
+// withSoundtrack appends soundtrack to the description base.
+func withSoundtrack(base, soundtrack string) string {
+	if soundtrack == "" {
+		return base
+	}
+	return descriptionPrefix(base) + soundtrack
+}
+
+func descriptionPrefix(base string) string {
+	if base != "" && !strings.HasSuffix(base, "\n") {
+		return base + "\n\n"
+	}
+	return base
+}
+
+// publishSoundtrack writes newDescription to Strava and remembers the
+// soundtrack in it.
+func publishSoundtrack(id int64, q *database.Queries, userID int64, activity *DetailedActivity, newDescription, soundtrack string) error {
+	infof(id, "updating description:\n%s", newDescription)
+	err := updateDescription(q, userID, activity.ID, newDescription)
+	if err != nil {
+		return err
+	}
+	err = q.DeletePendingDescription(context.Background(), database.DeletePendingDescriptionParams{
+		ActivityID: activity.ID,
+		UserID:     userID,
+	})
+	if err != nil {
+		return err
+	}
+	if soundtrack == "" {
+		return q.DeleteActivitySoundtrack(context.Background(), database.DeleteActivitySoundtrackParams{
+			ActivityID: activity.ID,
+			UserID:     userID,
+		})
+	}
+	return q.UpsertActivitySoundtrack(context.Background(), database.UpsertActivitySoundtrackParams{
+		ActivityID:  activity.ID,
+		UserID:      userID,
+		StartDate:   activity.StartDate.UTC(),
+		ElapsedTime: int64(activity.ElapsedTime),
+		Soundtrack:  soundtrack,
+	})
+}
+
+// proposeSoundtrack stores soundtrack as pending and sends the approval link
+// to the notification url of the user.
+func proposeSoundtrack(id int64, q *database.Queries, userID int64, activity *DetailedActivity, soundtrack string, settings database.ReviewSetting) error {
+	token, err := newReviewToken()
+	if err != nil {
+		return err
+	}
+	err = q.UpsertPendingDescription(context.Background(), database.UpsertPendingDescriptionParams{
+		ActivityID: activity.ID,
+		UserID:     userID,
+		Name:       activity.Name,
+		StartDate:  activity.StartDate.UTC(),
+		Soundtrack: soundtrack,
+		TokenHash:  hashReviewToken(token),
+	})
+	if err != nil {
+		return err
+	}
+	infof(id, "description of activity %d is waiting for approval", activity.ID)
+	if settings.NotifyUrl == "" {
+		return nil
+	}
+	err = notifyReview(settings.NotifyUrl, activity.Name, ApprovalUrl(token))
+	if err != nil {
+		// the change can still be approved from the web ui
+		errorf(id, "sending review notification: %v", err)
+	}
+	return nil
+}
+
+// ApprovalUrl is the link that approves a pending description without
+// logging in.
+func ApprovalUrl(token string) string {
+	return strings.TrimSuffix(config.GetConfig().Strava.WebhookHost, "/") + "/approve/" + token
+}
+
+// CheckNotifyUrl returns ErrNotifyUrl unless rawUrl is an https url whose
+// host is not a private or loopback address. Names are resolved when
+// connecting, see dialPublic.
+func CheckNotifyUrl(rawUrl string) error {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" || u.User != nil {
+		return ErrNotifyUrl
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrNotifyUrl
+	}
+	if ip, err := netip.ParseAddr(host); err == nil && !publicAddr(ip) {
+		return ErrNotifyUrl
+	}
+	return nil
+}
+
+// dialPublic refuses connections to addresses that are not public, also
+// when a public name resolves to one.
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	addr, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !publicAddr(addr.Addr()) {
+		return fmt.Errorf("%s is not a public address", addr.Addr())
+	}
+	return nil
+}
+
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// notifyReview posts a short message with the approval link to notifyUrl.
+// The format is understood by ntfy and similar push services.
+func notifyReview(notifyUrl, activityName, approvalUrl string) error {
+	if err := CheckNotifyUrl(notifyUrl); err != nil {
+		return err
+	}
+	msg := fmt.Sprintf("The soundtrack of %s is ready for review: %s", activityName, approvalUrl)
+	req, err := http.NewRequest(http.MethodPost, notifyUrl, strings.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("Title", "Stravafy")
+	req.Header.Set("Click", approvalUrl)
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode > 299 {
+		return fmt.Errorf("notification returned with HTTP %d %s", resp.StatusCode, resp.Status)
+	}
+	return nil
+}
+
+// PendingByToken looks up the pending description an approval link is for.
+// Links older than approvalLifetime return ErrApprovalExpired.
+func PendingByToken(q *database.Queries, token string) (database.PendingDescription, error) {
+	pending, err := q.GetPendingDescriptionByToken(context.Background(), hashReviewToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return pending, ErrPendingNotFound
+	}
+	if err == nil && time.Since(pending.CreatedAt) > approvalLifetime {
+		return pending, ErrApprovalExpired
+	}
+	return pending, err
+}
+
+// ApprovePending publishes the pending description of an activity of
+// userID, with soundtrack as the user edited it. The soundtrack published
+// before, if any, is replaced.
+func ApprovePending(q *database.Queries, userID int64, activityID int64, soundtrack string) error {
+	pending, err := q.GetPendingDescription(context.Background(), activityID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && pending.UserID != userID) {
+		return ErrPendingNotFound
+	}
+	if err != nil {
+		return err
+	}
+	id := time.Now().Unix()
+	infof(id, "publishing approved description of activity %d", activityID)
+	activity, err := FetchActivity(q, userID, activityID)
+	if err != nil {
+		return err
+	}
+	base := activity.Description
+	previous, err := q.GetActivitySoundtrack(context.Background(), database.GetActivitySoundtrackParams{ActivityID: activityID, UserID: userID})
+	if err == nil && strings.Contains(base, previous.Soundtrack) {
+		base = strings.TrimRight(strings.Replace(base, previous.Soundtrack, "", 1), " \n")
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	soundtrack = strings.TrimSpace(strings.ReplaceAll(soundtrack, "\r\n", "\n"))
+	if soundtrack != "" && !processed(soundtrack) {
+		soundtrack += "\n\n" + description.Footer
+	}
+	newDescription := withSoundtrack(base, soundtrack)
+	if len([]rune(newDescription)) > description.MaxLength {
+		return ErrDescriptionTooLong
+	}
+	return publishSoundtrack(id, q, userID, activity, newDescription, soundtrack)
+}
+
+// DiscardPending drops the pending description of an activity of userID.
+func DiscardPending(q *database.Queries, userID int64, activityID int64) error {
+	pending, err := q.GetPendingDescription(context.Background(), activityID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && pending.UserID != userID) {
+		return ErrPendingNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return q.DeletePendingDescription(context.Background(), database.DeletePendingDescriptionParams{
+		ActivityID: activityID,
+		UserID:     userID,
+	})
+}
+
+func newReviewToken() (string, error) {
+	k := make([]byte, 32)
+	if _, err := rand.Read(k); err != nil {
+		return "", fmt.Errorf("generating review token: %w", err)
+	}
+	return hex.EncodeToString(k), nil
+}
+
+func hashReviewToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,94 @@
+package worker
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"stravafy/internal/database"
+	"strings"
+	"time"
+)
+
+// DefaultOptOutTag opts an activity out if it is in its title.
+const DefaultOptOutTag = "#nomusic"
+
+// SportTypes are the sport types Strava knows.
+var SportTypes = []string{
+	"AlpineSki", "BackcountrySki", "Badminton", "Canoeing", "Crossfit", "EBikeRide", "Elliptical",
+	"EMountainBikeRide", "Golf", "GravelRide", "Handcycle", "HighIntensityIntervalTraining", "Hike",
+	"IceSkate", "InlineSkate", "Kayaking", "Kitesurf", "MountainBikeRide", "NordicSki", "Pickleball",
+	"Pilates", "Racquetball", "Ride", "RockClimbing", "RollerSki", "Rowing", "Run", "Sail", "Skateboard",
+	"Snowboard", "Snowshoe", "Soccer", "Squash", "StairStepper", "StandUpPaddling", "Surfing", "Swim",
+	"TableTennis", "Tennis", "TrailRun", "Velomobile", "VirtualRide", "VirtualRow", "VirtualRun", "Walk",
+	"WeightTraining", "Wheelchair", "Windsurf", "Workout", "Yoga",
+}
+
+// ActivityRules returns the rules of userID, which let every activity pass
+// if they never saved any.
+func ActivityRules(q *database.Queries, userID int64) (database.ActivityRule, error) {
+	rules, err := q.GetActivityRules(context.Background(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.ActivityRule{UserID: userID, OptOutTag: DefaultOptOutTag}, nil
+	}
+	return rules, err
+}
+
+// RuleSportTypes splits the sport types of rules, nil means all.
+func RuleSportTypes(rules database.ActivityRule) []string {
+	if rules.SportTypes == "" {
+		return nil
+	}
+	return strings.Split(rules.SportTypes, ",")
+}
+
+// skipReason tells why activity does not get a soundtrack under rules. It
+// is empty if it does.
+func skipReason(rules database.ActivityRule, activity *DetailedActivity) string {
+	if sportTypes := RuleSportTypes(rules); sportTypes != nil && !slices.Contains(sportTypes, activity.SportType) {
+		return fmt.Sprintf("sport type %s is not selected", activity.SportType)
+	}
+	switch {
+	case rules.SkipPrivate && activity.Private:
+		return "private activities are skipped"
+	case rules.SkipCommute && activity.Commute:
+		return "commutes are skipped"
+	case rules.SkipTrainer && activity.Trainer:
+		return "trainer activities are skipped"
+	case rules.SkipManual && activity.Manual:
+		return "manual activities are skipped"
+	}
+	if rules.MinDuration > 0 && int64(activity.ElapsedTime) < rules.MinDuration {
+		return fmt.Sprintf("shorter than %s", time.Duration(rules.MinDuration)*time.Second)
+	}
+	if rules.OptOutTag != "" && strings.Contains(strings.ToLower(activity.Name), strings.ToLower(rules.OptOutTag)) {
+		return fmt.Sprintf("title contains %s", rules.OptOutTag)
+	}
+	return ""
+}
+
+// checkRules logs and reports whether activity is skipped by the rules of
+// userID.
+func checkRules(id int64, q *database.Queries, userID int64, activity *DetailedActivity) (bool, error) {
+	rules, err := ActivityRules(q, userID)
+	if err != nil {
+		return false, fmt.Errorf("loading activity rules: %v", err)
+	}
+	if reason := skipReason(rules, activity); reason != "" {
+		infof(id, "skipping activity %d: %s", activity.ID, reason)
+		return true, nil
+	}
+	return false, nil
+}
+
+// removeSoundtrack takes the soundtrack out of the description of an
+// activity the rules exclude now, unless it was edited on Strava.
+func removeSoundtrack(id int64, q *database.Queries, userID int64, activity *DetailedActivity, previous database.ActivitySoundtrack) error {
+	if !strings.Contains(activity.Description, previous.Soundtrack) {
+		infof(id, "soundtrack was edited on strava, leaving it alone")
+		return nil
+	}
+	base := strings.TrimRight(strings.Replace(activity.Description, previous.Soundtrack, "", 1), " \n")
+	return submitSoundtrack(id, q, userID, activity, base, "")
+}
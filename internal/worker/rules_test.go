@@ -0,0 +1,54 @@
+package worker
+
+import (
+	"stravafy/internal/database"
+	"testing"
+)
+
+func TestSkipReason(t *testing.T) {
+	run := DetailedActivity{Name: "Morning Run", SportType: "Run", ElapsedTime: 1800}
+	with := func(change func(a *DetailedActivity)) *DetailedActivity {
+		a := run
+		change(&a)
+		return &a
+	}
+	all := database.ActivityRule{OptOutTag: DefaultOptOutTag}
+	tests := []struct {
+		name     string
+		rules    database.ActivityRule
+		activity *DetailedActivity
+		want     string
+	}{
+		{"no rules", database.ActivityRule{}, with(func(a *DetailedActivity) { a.Private, a.Manual = true, true }), ""},
+		{"defaults", all, &run, ""},
+		{"selected sport type", database.ActivityRule{SportTypes: "Ride,Run"}, &run, ""},
+		{"other sport type", database.ActivityRule{SportTypes: "Ride,TrailRun"}, &run, "sport type Run is not selected"},
+		{"private", database.ActivityRule{SkipPrivate: true}, with(func(a *DetailedActivity) { a.Private = true }), "private activities are skipped"},
+		{"public", database.ActivityRule{SkipPrivate: true}, &run, ""},
+		{"commute", database.ActivityRule{SkipCommute: true}, with(func(a *DetailedActivity) { a.Commute = true }), "commutes are skipped"},
+		{"trainer", database.ActivityRule{SkipTrainer: true}, with(func(a *DetailedActivity) { a.Trainer = true }), "trainer activities are skipped"},
+		{"manual", database.ActivityRule{SkipManual: true}, with(func(a *DetailedActivity) { a.Manual = true }), "manual activities are skipped"},
+		{"too short", database.ActivityRule{MinDuration: 3600}, &run, "shorter than 1h0m0s"},
+		{"long enough", database.ActivityRule{MinDuration: 1800}, &run, ""},
+		{"opt out tag", all, with(func(a *DetailedActivity) { a.Name = "Easy run #NoMusic" }), "title contains #nomusic"},
+		{"no opt out tag", database.ActivityRule{}, with(func(a *DetailedActivity) { a.Name = "Easy run #nomusic" }), ""},
+		{"sport type first", database.ActivityRule{SportTypes: "Ride", SkipManual: true}, with(func(a *DetailedActivity) { a.Manual = true }), "sport type Run is not selected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := skipReason(tt.rules, tt.activity); got != tt.want {
+				t.Errorf("skipReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleSportTypes(t *testing.T) {
+	if got := RuleSportTypes(database.ActivityRule{}); got != nil {
+		t.Errorf("RuleSportTypes() = %v, want nil", got)
+	}
+	got := RuleSportTypes(database.ActivityRule{SportTypes: "Ride,Run"})
+	if len(got) != 2 || got[0] != "Ride" || got[1] != "Run" {
+		t.Errorf("RuleSportTypes() = %v, want [Ride Run]", got)
+	}
+}
@@ -0,0 +1,162 @@
+package worker
+
+import (
+	"context"
+	"sort"
+	"stravafy/internal/config"
+	"stravafy/internal/database"
+	"stravafy/internal/music"
+	"time"
+)
+
+// scrobbleDuration is assumed for scrobbles that don't say how long they
+// played.
+const scrobbleDuration = 4 * time.Minute
+
+// scrobbles periodically pulls the plays of all linked Last.fm and
+// ListenBrainz accounts into the history.
+func scrobbles(q *database.Queries, shutdown <-chan struct{}) {
+	defer wg.Done()
+	pollInterval := config.GetConfig().Scrobbles.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = config.DefaultConfig().Scrobbles.PollInterval
+	}
+	ticker := time.NewTicker(time.Duration(pollInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		syncAllScrobbles(q)
+		select {
+		case <-ticker.C:
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+func syncAllScrobbles(q *database.Queries) {
+	accounts, err := q.ListMusicAccounts(context.Background())
+	if err != nil {
+		errorf(queueID, "listing music accounts: %v", err)
+		return
+	}
+	for _, account := range accounts {
+		err := SyncScrobbles(q, account)
+		if err != nil {
+			errorf(account.UserID, "syncing %s: %v", account.Source, err)
+		}
+	}
+}
+
+// SyncScrobbles merges the plays of account since the last sync into the
+// history.
+func SyncScrobbles(q *database.Queries, account database.MusicAccount) error {
+	source, err := music.New(account.Source, q, account.UserID)
+	if err != nil {
+		return err
+	}
+	plays, err := source.RecentPlays(context.Background(), time.Unix(account.PlayedAfter, 0))
+	if err != nil {
+		return err
+	}
+	merged, err := mergeScrobbles(account.UserID, q, source.Name(), plays)
+	if err != nil {
+		return err
+	}
+	after := account.PlayedAfter
+	for _, play := range plays {
+		after = max(after, play.Start.Unix())
+	}
+	infof(account.UserID, "merged %d of %d plays from %s", merged, len(plays), source.Name())
+	return q.UpdateMusicAccountCursor(context.Background(), database.UpdateMusicAccountCursorParams{
+		PlayedAfter: after,
+		UserID:      account.UserID,
+		Source:      account.Source,
+	})
+}
+
+// SubmitListens merges plays a player submitted into the history of userID.
+func SubmitListens(q *database.Queries, userID int64, plays []music.Play) error {
+	sort.SliceStable(plays, func(i, j int) bool {
+		return plays[i].Start.Before(plays[j].Start)
+	})
+	merged, err := mergeScrobbles(userID, q, music.SourceLocal, plays)
+	if err != nil {
+		return err
+	}
+	infof(userID, "merged %d of %d submitted listens", merged, len(plays))
+	return nil
+}
+
+// SubmitPlayingNow records what a player reports as playing right now, like
+// the Spotify poller does.
+func SubmitPlayingNow(q *database.Queries, userID int64, play music.Play) error {
+	play.Start = time.Now().UTC()
+	return handlePlaying(userID, q, music.SourceLocal, &play)
+}
+
+// mergeScrobbles merges plays, which have to be ordered by their start,
+// and returns how many of them were new.
+func mergeScrobbles(id int64, q *database.Queries, source string, plays []music.Play) (int, error) {
+	tolerance := time.Duration(config.GetConfig().Spotify.UpdateInterval) * time.Second
+	merged := 0
+	for i, play := range plays {
+		next := play.Start.Add(scrobbleDuration + tolerance)
+		if i+1 < len(plays) {
+			next = plays[i+1].Start
+		}
+		ok, err := mergeScrobble(id, q, source, play, next, tolerance)
+		if err != nil {
+			return merged, err
+		}
+		if ok {
+			merged++
+		}
+	}
+	return merged, nil
+}
+
+// mergeScrobble inserts play into the history unless a track with the same
+// name is already known around that time, recorded by the Spotify poller
+// for example. It reports whether a new entry was written.
+func mergeScrobble(id int64, q *database.Queries, source string, play music.Play, next time.Time, tolerance time.Duration) (bool, error) {
+	count, err := q.CountHistoryItemsByNameBetween(context.Background(), database.CountHistoryItemsByNameBetweenParams{
+		UserID:      id,
+		Name:        play.Item.Name,
+		Timestamp:   play.Start.Add(-tolerance),
+		Timestamp_2: play.Start.Add(tolerance),
+	})
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, endOpenPlay(id, q, source, play, next, tolerance)
+	}
+	_, err = insertHistoryEntry(id, q, source, play)
+	if err != nil {
+		return false, err
+	}
+	return true, endPlay(id, q, source, play.Start.Add(playDuration(play)), next, tolerance)
+}
+
+// endOpenPlay ends the entry a player opened when it reported play as
+// playing now, nothing else would close it.
+func endOpenPlay(id int64, q *database.Queries, source string, play music.Play, next time.Time, tolerance time.Duration) error {
+	open, ok, err := openEntry(id, q)
+	if err != nil || !ok {
+		return err
+	}
+	if open.Source != source || open.Name != play.Item.Name {
+		return nil
+	}
+	if d := open.Timestamp.Sub(play.Start); d < -tolerance || d > tolerance {
+		return nil
+	}
+	return endPlay(id, q, source, open.Timestamp.Add(playDuration(play)), next, tolerance)
+}
+
+func playDuration(play music.Play) time.Duration {
+	if play.Item.Duration == 0 {
+		return scrobbleDuration
+	}
+	return play.Item.Duration
+}
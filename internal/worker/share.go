@@ -0,0 +1,220 @@
+package worker
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"stravafy/internal/config"
+	"stravafy/internal/database"
+	"stravafy/internal/description"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrPrivateActivity is returned when sharing an activity that not
+	// everyone can see on Strava.
+	ErrPrivateActivity = errors.New("only activities visible to everyone can be shared")
+	ErrShareNotFound   = errors.New("shared activity not found")
+)
+
+// ShareSettings returns the share settings of userID, nothing is shared if
+// they never saved any.
+func ShareSettings(q *database.Queries, userID int64) (database.ShareSetting, error) {
+	settings, err := q.GetShareSettings(context.Background(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.ShareSetting{UserID: userID}, nil
+	}
+	return settings, err
+}
+
+// ShareUrl is the public page of a shared activity.
+func ShareUrl(token string) string {
+	return sharePrefix() + token
+}
+
+func sharePrefix() string {
+	return strings.TrimSuffix(config.GetConfig().Strava.WebhookHost, "/") + "/s/"
+}
+
+// processed reports whether a description already has a soundtrack, which
+// either mentions Stravafy or links a public page.
+func processed(activityDescription string) bool {
+	if strings.Contains(activityDescription, description.Marker) {
+		return true
+	}
+	return config.GetConfig().Strava.WebhookHost != "" && strings.Contains(activityDescription, sharePrefix())
+}
+
+// shareable reports whether everyone can see activity on Strava. Activities
+// only visible to followers are not.
+func shareable(activity *DetailedActivity) bool {
+	return !activity.Private && activity.Visibility == "everyone"
+}
+
+// SharedActivity looks up the activity a public link is for. Links to
+// activities that are no longer visible to everyone are treated like revoked
+// ones.
+func SharedActivity(q *database.Queries, token string) (database.Activity, error) {
+	share, err := q.GetActivityShareByToken(context.Background(), token)
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.Activity{}, ErrShareNotFound
+	}
+	if err != nil {
+		return database.Activity{}, err
+	}
+	activity, err := q.GetActivity(context.Background(), database.GetActivityParams{ID: share.ActivityID, UserID: share.UserID})
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && activity.Private) {
+		return database.Activity{}, ErrShareNotFound
+	}
+	return activity, err
+}
+
+// ShareActivity creates the public page of an activity of userID on request
+// and returns its url. If the user links it in descriptions, the soundtrack
+// written to Strava is replaced.
+func ShareActivity(q *database.Queries, userID int64, activityID int64) (string, error) {
+	return updateShare(q, userID, activityID, true)
+}
+
+// RevokeShare deletes the public page of an activity of userID. A link in
+// the description is replaced by the default footer.
+func RevokeShare(q *database.Queries, userID int64, activityID int64) error {
+	_, err := updateShare(q, userID, activityID, false)
+	return err
+}
+
+func updateShare(q *database.Queries, userID int64, activityID int64, share bool) (string, error) {
+	user, err := q.GetUserById(context.Background(), userID)
+	if err != nil {
+		return "", err
+	}
+	event := Callback{
+		ObjectType: ObjectTypeActivity,
+		ObjectId:   activityID,
+		AspectType: AspectTypeUpdate,
+		OwnerId:    user.StravaID,
+		EventTime:  time.Now().Unix(),
+	}
+	// the page shows the local copy, so only activities stored before can be
+	// shared
+	stored, err := q.GetActivity(context.Background(), database.GetActivityParams{ID: activityID, UserID: userID})
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrShareNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	var activity *DetailedActivity
+	shareUrl := ""
+	if share {
+		infof(event.EventTime, "sharing activity %d", activityID)
+		// the stored flag may be stale, so ask Strava
+		activity, err = FetchActivity(q, userID, activityID)
+		if err != nil {
+			return "", err
+		}
+		if stored.Private || !shareable(activity) {
+			return "", ErrPrivateActivity
+		}
+		shareUrl, err = activityShare(event.EventTime, q, userID, activityID, true)
+	} else {
+		infof(event.EventTime, "revoking public page of activity %d", activityID)
+		err = q.DeleteActivityShare(context.Background(), database.DeleteActivityShareParams{
+			ActivityID: activityID,
+			UserID:     userID,
+		})
+	}
+	if err != nil {
+		return "", err
+	}
+	settings, err := ShareSettings(q, userID)
+	if err != nil || !settings.AddToDescription {
+		return shareUrl, err
+	}
+	previous, err := q.GetActivitySoundtrack(context.Background(), database.GetActivitySoundtrackParams{ActivityID: activityID, UserID: userID})
+	if errors.Is(err, sql.ErrNoRows) {
+		return shareUrl, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if activity == nil {
+		activity, err = FetchActivity(q, userID, activityID)
+		if err != nil {
+			return "", err
+		}
+	}
+	return shareUrl, rewriteSoundtrack(event, q, user, activity, previous)
+}
+
+// activityShare returns the url of the public page of an activity. If there
+// is none yet and create is set, a new token is made.
+func activityShare(id int64, q *database.Queries, userID int64, activityID int64, create bool) (string, error) {
+	existing, err := q.GetActivityShare(context.Background(), database.GetActivityShareParams{ActivityID: activityID, UserID: userID})
+	if err == nil {
+		return ShareUrl(existing.Token), nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	if !create {
+		return "", nil
+	}
+	token, err := newShareToken()
+	if err != nil {
+		return "", err
+	}
+	err = q.InsertActivityShare(context.Background(), database.InsertActivityShareParams{
+		ActivityID: activityID,
+		UserID:     userID,
+		Token:      token,
+	})
+	if err != nil {
+		return "", err
+	}
+	infof(id, "created public page of activity %d", activityID)
+	return ShareUrl(token), nil
+}
+
+// autoShare creates the public page of a new activity if the user shares
+// all of them.
+func autoShare(id int64, q *database.Queries, userID int64, activity *DetailedActivity) error {
+	settings, err := ShareSettings(q, userID)
+	if err != nil || !settings.AutoCreate || !shareable(activity) {
+		return err
+	}
+	_, err = activityShare(id, q, userID, activity.ID, true)
+	return err
+}
+
+// unshareIfPrivate revokes the public page of activity once not everyone can
+// see it on Strava.
+func unshareIfPrivate(id int64, q *database.Queries, userID int64, activity *DetailedActivity) error {
+	if shareable(activity) {
+		return nil
+	}
+	_, err := q.GetActivityShare(context.Background(), database.GetActivityShareParams{ActivityID: activity.ID, UserID: userID})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	infof(id, "activity %d is no longer public, revoking its public page", activity.ID)
+	return q.DeleteActivityShare(context.Background(), database.DeleteActivityShareParams{
+		ActivityID: activity.ID,
+		UserID:     userID,
+	})
+}
+
+func newShareToken() (string, error) {
+	k := make([]byte, 18)
+	if _, err := rand.Read(k); err != nil {
+		return "", fmt.Errorf("generating share token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(k), nil
+}
@@ -0,0 +1,157 @@
+package worker
+
+import (
+	"context"
+	"sort"
+	"stravafy/internal/database"
+	"stravafy/internal/description"
+	"time"
+)
+
+// storeActivity keeps a local copy of activity together with its laps and
+// splits and the history entries that played during it, so pages don't need
+// to ask Strava again.
+func storeActivity(q *database.Queries, userID int64, activity *DetailedActivity, data description.Data) error {
+	ctx := context.Background()
+	err := q.UpsertActivity(ctx, database.UpsertActivityParams{
+		ID:                 activity.ID,
+		UserID:             userID,
+		Name:               activity.Name,
+		Type:               activity.Type,
+		SportType:          activity.SportType,
+		StartDate:          activity.StartDate.UTC(),
+		StartDateLocal:     activity.StartDateLocal,
+		Timezone:           activity.Timezone,
+		ElapsedTime:        int64(activity.ElapsedTime),
+		MovingTime:         int64(activity.MovingTime),
+		Distance:           activity.Distance,
+		TotalElevationGain: activity.TotalElevationGain,
+		AverageSpeed:       activity.AverageSpeed,
+		MaxSpeed:           activity.MaxSpeed,
+		AverageHeartrate:   nullFloat(activity.AverageHeartrate),
+		AverageWatts:       nullFloat(activity.AverageWatts),
+		// private marks anything not everyone can see, followers only too
+		Private:         !shareable(activity),
+		Commute:         activity.Commute,
+		Trainer:         activity.Trainer,
+		Manual:          activity.Manual,
+		SummaryPolyline: activity.Map.SummaryPolyline,
+	})
+	if err != nil {
+		return err
+	}
+	err = q.DeleteActivityTracks(ctx, database.DeleteActivityTracksParams{
+		ActivityID: activity.ID,
+		UserID:     userID,
+	})
+	if err != nil {
+		return err
+	}
+	for i, played := range playedItems(data) {
+		err := q.InsertActivityTrack(ctx, database.InsertActivityTrackParams{
+			ActivityID:      activity.ID,
+			HistoryID:       played.historyID,
+			Position:        int64(i),
+			OffsetSeconds:   int64(played.offset.Seconds()),
+			DurationSeconds: int64(played.duration.Seconds()),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return storeIntervals(ctx, q, userID, activity.ID, data)
+}
+
+const (
+	intervalKindLap   = "lap"
+	intervalKindSplit = "split"
+)
+
+func storeIntervals(ctx context.Context, q *database.Queries, userID int64, activityID int64, data description.Data) error {
+	err := q.DeleteActivityIntervals(ctx, database.DeleteActivityIntervalsParams{
+		ActivityID: activityID,
+		UserID:     userID,
+	})
+	if err != nil {
+		return err
+	}
+	for kind, segments := range map[string][]description.Segment{intervalKindLap: data.Laps, intervalKindSplit: data.Splits} {
+		for i, segment := range segments {
+			err := q.InsertActivityInterval(ctx, database.InsertActivityIntervalParams{
+				ActivityID:     activityID,
+				Kind:           kind,
+				Position:       int64(i),
+				Name:           segment.Name,
+				Distance:       segment.Distance,
+				OffsetSeconds:  int64(segment.Offset.Seconds()),
+				ElapsedSeconds: int64(segment.ElapsedTime.Seconds()),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// StoredSoundtrack collects what userID listened to during a stored
+// activity, with the laps and splits stored along with it. Unlike
+// ActivitySoundtrack it doesn't ask Strava, heart rate and the other
+// streams are missing.
+func StoredSoundtrack(q *database.Queries, userID int64, activity database.Activity) (description.Data, error) {
+	ctx := context.Background()
+	intervals, err := q.GetActivityIntervals(ctx, activity.ID)
+	if err != nil {
+		return description.Data{}, err
+	}
+	stored := description.Activity{
+		Name:        activity.Name,
+		SportType:   activity.SportType,
+		StartDate:   activity.StartDate,
+		ElapsedTime: time.Duration(activity.ElapsedTime) * time.Second,
+		Distance:    activity.Distance,
+	}
+	for _, interval := range intervals {
+		converted := description.Interval{
+			Name:        interval.Name,
+			Distance:    interval.Distance,
+			Offset:      time.Duration(interval.OffsetSeconds) * time.Second,
+			ElapsedTime: time.Duration(interval.ElapsedSeconds) * time.Second,
+		}
+		if interval.Kind == intervalKindLap {
+			stored.Laps = append(stored.Laps, converted)
+		} else {
+			stored.Splits = append(stored.Splits, converted)
+		}
+	}
+	histEntries, err := q.GetHistoryEntriesBetween(ctx, database.GetHistoryEntriesBetweenParams{
+		UserID:      userID,
+		Timestamp:   activity.StartDate.UTC(),
+		Timestamp_2: stored.StartDate.Add(stored.ElapsedTime).UTC(),
+	})
+	if err != nil {
+		return description.Data{}, err
+	}
+	return description.Build(stored, histEntries), nil
+}
+
+type playedItem struct {
+	historyID int64
+	offset    time.Duration
+	duration  time.Duration
+}
+
+// playedItems merges tracks and episodes in the order they were played.
+func playedItems(data description.Data) []playedItem {
+	items := make([]playedItem, 0, len(data.Tracks)+len(data.Episodes))
+	for _, track := range data.Tracks {
+		items = append(items, playedItem{track.HistoryID, track.Offset, track.Duration})
+	}
+	for _, episode := range data.Episodes {
+		items = append(items, playedItem{episode.HistoryID, episode.Offset, episode.Duration})
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].offset < items[j].offset
+	})
+	return items
+}
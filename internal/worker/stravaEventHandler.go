@@ -2,17 +2,18 @@ package worker
 
 import (
 	"context"
-	"encoding/json"
+	"database/sql"
 	"errors"
 	"fmt"
 	"golang.org/x/oauth2"
 	"io"
 	"net/http"
 	"net/url"
-	"stravafy/internal/config"
 	"stravafy/internal/database"
+	"stravafy/internal/description"
+	"stravafy/internal/music"
+	"stravafy/internal/tokens"
 	"strings"
-	"time"
 )
 
 const (
@@ -23,180 +24,354 @@ const (
 	ObjectTypeAthlete  = "athlete"
 )
 
-func HandleStravaEvent(event Callback) {
-	wg.Add(1)
-	go handleStravaEvent(event)
-}
+// ErrUnknownAthlete is returned for events of athletes that are not signed
+// up (anymore).
+var ErrUnknownAthlete = errors.New("athlete is not known")
+
+// relevantUpdates are the fields of an activity update that change what
+// ends up in the description.
+var relevantUpdates = []string{"title", "type", "sport_type", "private"}
 
-func handleStravaEvent(event Callback) {
-	defer wg.Done()
-	if event.AspectType != AspectTypeCreate {
-		infof(event.EventTime, "skipping event of type %s", event.AspectType)
-		return
+func handleStravaEvent(event Callback) error {
+	if event.ObjectType == ObjectTypeAthlete && event.AspectType == AspectTypeUpdate {
+		return handleAthleteUpdate(event)
 	}
 	if event.ObjectType != ObjectTypeActivity {
 		infof(event.EventTime, "skipping event of type %s", event.ObjectType)
-		return
+		return nil
 	}
-	infof(event.EventTime, "start processing...")
-	infof(event.EventTime, "\tactivity: %d", event.ObjectId)
+	switch event.AspectType {
+	case AspectTypeCreate:
+		return handleActivityCreate(event)
+	case AspectTypeUpdate:
+		return handleActivityUpdate(event)
+	case AspectTypeDelete:
+		return handleActivityDelete(event)
+	}
+	infof(event.EventTime, "skipping event of type %s", event.AspectType)
+	return nil
+}
+
+func eventUser(event Callback) (*database.Queries, database.User, error) {
 	db, err := database.NewSQLite()
 	if err != nil {
-		errorf(event.EventTime, "nono database: %v", err)
-		return
+		return nil, database.User{}, fmt.Errorf("nono database: %v", err)
 	}
 	q := database.New(db.DB)
 	user, err := q.GetUserByStravaId(context.Background(), event.OwnerId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, database.User{}, fmt.Errorf("%w: %d", ErrUnknownAthlete, event.OwnerId)
+	}
 	if err != nil {
-		errorf(event.EventTime, "error getting user from db: %v", err)
-		return
+		return nil, database.User{}, fmt.Errorf("error getting user from db: %w", err)
 	}
 	infof(event.EventTime, "\tstrava user: \"%s %s\"", user.FirstName, user.LastName)
-	dbToken, err := q.GetTokenByUserId(context.Background(), user.ID)
+	return q, user, nil
+}
+
+func handleActivityCreate(event Callback) error {
+	infof(event.EventTime, "start processing...")
+	infof(event.EventTime, "\tactivity: %d", event.ObjectId)
+	q, user, err := eventUser(event)
 	if err != nil {
-		errorf(event.EventTime, "error while fetching accesstoken: %v", err)
+		return err
 	}
-	token := oauth2.Token{
-		AccessToken:  dbToken.AccessToken,
-		RefreshToken: dbToken.RefreshToken,
-		Expiry:       time.Unix(dbToken.ExpiresAt, 0),
+	activity, err := FetchActivity(q, user.ID, event.ObjectId)
+	if err != nil {
+		return err
 	}
+	return createSoundtrack(event, q, user, activity)
+}
 
-	oauth2Conf := config.GetStravaOauthConfig()
-	client := oauth2Conf.Client(context.Background(), &token)
+// createSoundtrack writes the first soundtrack of activity, unless the
+// description already has one or the rules skip it.
+func createSoundtrack(event Callback, q *database.Queries, user database.User, activity *DetailedActivity) error {
+	if processed(activity.Description) {
+		infof(event.EventTime, "already processed")
+		infof(event.EventTime, "exiting...")
+		return nil
+	}
+	skip, err := checkRules(event.EventTime, q, user.ID, activity)
+	if err != nil || skip {
+		return err
+	}
+	err = autoShare(event.EventTime, q, user.ID, activity)
+	if err != nil {
+		return err
+	}
+	return writeSoundtrack(event, q, user, activity, activity.Description)
+}
 
-	resp, err := client.Get(fmt.Sprintf("https://www.strava.com/api/v3/activities/%d", event.ObjectId))
+// handleActivityUpdate replaces the soundtrack written for the activity if
+// anything it depends on changed. The start time is not part of the update
+// event, so it is compared with the one the soundtrack was made for.
+func handleActivityUpdate(event Callback) error {
+	infof(event.EventTime, "processing update of activity %d: %v", event.ObjectId, event.Updates)
+	q, user, err := eventUser(event)
 	if err != nil {
-		errorf(event.EventTime, "an error accured while fetching activity details: %v", err)
-		return
+		return err
 	}
-	if resp.StatusCode > 299 {
-		bytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			errorf(event.EventTime, "an error accured while reading activity details: %v", err)
-			return
-		}
-		errorf(event.EventTime, "activity details returned with HTTP %d %s: %s", resp.StatusCode, resp.Status, string(bytes))
-		return
+	activity, err := FetchActivity(q, user.ID, event.ObjectId)
+	if err != nil {
+		return err
 	}
-	decoder := json.NewDecoder(resp.Body)
-	var activity DetailedActivity
-	err = decoder.Decode(&activity)
+	// visibility changes apply whether or not there is a soundtrack yet
+	err = unshareIfPrivate(event.EventTime, q, user.ID, activity)
 	if err != nil {
-		errorf(event.EventTime, "unable to decode activity: %v", err)
-		return
+		return err
 	}
-	if strings.Contains(activity.Description, "stravafy.servebeer.com") {
-		infof(event.EventTime, "already processed")
-		infof(event.EventTime, "exiting...")
-		return
-	}
-	startTime := activity.StartDate
-	endTime := activity.StartDate.Add(time.Duration(activity.ElapsedTime) * time.Second)
-	histEntries, err := q.GetHistoryEntriesBetween(context.Background(), database.GetHistoryEntriesBetweenParams{
-		UserID:      user.ID,
-		Timestamp:   startTime.UTC(),
-		Timestamp_2: endTime.UTC(),
+	err = q.UpdateActivityPrivate(context.Background(), database.UpdateActivityPrivateParams{
+		Private: !shareable(activity),
+		ID:      activity.ID,
+		UserID:  user.ID,
 	})
 	if err != nil {
-		errorf(event.EventTime, "an error accourd while fetching history: %v", err)
-		return
+		return err
 	}
-	infof(event.EventTime, "Found following Spotify Activity:")
-	playContexts := make(map[string]struct {
-		Type string
-		Href string
-		Url  string
-	})
-	for _, entry := range histEntries {
-		if entry.IsPlaying {
-			infof(event.EventTime, "\t Name: %s", entry.Name)
-			infof(event.EventTime, "\t Artists: %s", entry.Artists.String)
-			infof(event.EventTime, "")
-			playContexts[entry.CtxUri] = struct {
-				Type string
-				Href string
-				Url  string
-			}{Type: entry.CtxType, Href: entry.CtxHref, Url: entry.CtxExternalUrl}
-		}
+	previous, err := q.GetActivitySoundtrack(context.Background(), database.GetActivitySoundtrackParams{ActivityID: event.ObjectId, UserID: user.ID})
+	if errors.Is(err, sql.ErrNoRows) {
+		return createSoundtrack(event, q, user, activity)
+	}
+	if err != nil {
+		return err
+	}
+	skip, err := checkRules(event.EventTime, q, user.ID, activity)
+	if err != nil {
+		return err
+	}
+	if skip {
+		return removeSoundtrack(event.EventTime, q, user.ID, activity, previous)
+	}
+	moved := !previous.StartDate.Equal(activity.StartDate) || previous.ElapsedTime != int64(activity.ElapsedTime)
+	if !moved && !hasRelevantUpdate(event.Updates) {
+		infof(event.EventTime, "nothing relevant changed")
+		return nil
+	}
+	return rewriteSoundtrack(event, q, user, activity, previous)
+}
+
+// rewriteSoundtrack replaces the previous soundtrack in the description of
+// activity with a new one, unless it was edited on Strava.
+func rewriteSoundtrack(event Callback, q *database.Queries, user database.User, activity *DetailedActivity, previous database.ActivitySoundtrack) error {
+	if !strings.Contains(activity.Description, previous.Soundtrack) {
+		infof(event.EventTime, "soundtrack was edited on strava, leaving it alone")
+		return nil
 	}
-	newDescription := activity.Description
-	for uri, ctx := range playContexts {
-		infof(event.EventTime, "Contexts:")
-		infof(event.EventTime, "\t Type: %s", ctx.Type)
-		infof(event.EventTime, "\t Uri: %s", uri)
-		infof(event.EventTime, "\t Url: %s", ctx.Url)
-		infof(event.EventTime, "\t Href: %s", ctx.Href)
-		if len(playContexts) == 1 && ctx.Type == "playlist" {
-			pl, err := getPlaylist(q, user.ID, ctx.Href)
-			if err != nil {
-				errorf(event.EventTime, "an error acourd while getting context playlist: %v", err)
-				continue
-			}
-			newDescription += fmt.Sprintf("Playlist: %s\nBy: %s\n%s\n\n--stravafy.servebeer.com", pl.Name, pl.Owner.DisplayName, ctx.Url)
+	base := strings.TrimRight(strings.Replace(activity.Description, previous.Soundtrack, "", 1), " \n")
+	return writeSoundtrack(event, q, user, activity, base)
+}
+
+func hasRelevantUpdate(updates map[string]string) bool {
+	for _, key := range relevantUpdates {
+		if _, ok := updates[key]; ok {
+			return true
 		}
 	}
-	if newDescription == activity.Description {
-		infof(event.EventTime, "done")
-		return
+	return false
+}
+
+// handleActivityDelete removes what is stored about an activity of the
+// owner of event, once Strava confirms it is gone.
+func handleActivityDelete(event Callback) error {
+	infof(event.EventTime, "removing activity %d", event.ObjectId)
+	q, user, err := eventUser(event)
+	if err != nil {
+		return err
+	}
+	_, err = FetchActivity(q, user.ID, event.ObjectId)
+	if err == nil {
+		errorf(event.EventTime, "activity %d still exists, ignoring the event", event.ObjectId)
+		return nil
+	}
+	if !errors.Is(err, ErrActivityNotFound) {
+		return err
+	}
+	ctx := context.Background()
+	activityID := event.ObjectId
+	deletes := []func() error{
+		func() error {
+			return q.DeleteTrackMetricsForActivity(ctx, database.DeleteTrackMetricsForActivityParams{ActivityID: activityID, UserID: user.ID})
+		},
+		func() error {
+			return q.DeleteActivitySoundtrack(ctx, database.DeleteActivitySoundtrackParams{ActivityID: activityID, UserID: user.ID})
+		},
+		func() error {
+			return q.DeleteActivityTracks(ctx, database.DeleteActivityTracksParams{ActivityID: activityID, UserID: user.ID})
+		},
+		func() error {
+			return q.DeleteActivityIntervals(ctx, database.DeleteActivityIntervalsParams{ActivityID: activityID, UserID: user.ID})
+		},
+		func() error {
+			return q.DeleteActivityPlaylist(ctx, database.DeleteActivityPlaylistParams{ActivityID: activityID, UserID: user.ID})
+		},
+		func() error {
+			return q.DeleteActivityShare(ctx, database.DeleteActivityShareParams{ActivityID: activityID, UserID: user.ID})
+		},
+		func() error {
+			return q.DeletePendingDescription(ctx, database.DeletePendingDescriptionParams{ActivityID: activityID, UserID: user.ID})
+		},
+		func() error {
+			return q.DeleteActivity(ctx, database.DeleteActivityParams{ID: activityID, UserID: user.ID})
+		},
+	}
+	for _, del := range deletes {
+		if err := del(); err != nil {
+			return err
+		}
 	}
-	infof(event.EventTime, "updating description:\n%s", newDescription)
+	return nil
+}
 
-	values := make(url.Values)
-	values.Add("description", newDescription)
-	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("https://www.strava.com/api/v3/activities/%d?%s", event.ObjectId, values.Encode()), nil)
+// matchSoundtrack collects what was played during activity, records it
+// locally and looks up the names of the contexts.
+func matchSoundtrack(event Callback, q *database.Queries, user database.User, activity *DetailedActivity) (description.Data, error) {
+	data, err := ActivitySoundtrack(q, user.ID, activity)
 	if err != nil {
-		errorf(event.EventTime, "%v", err)
-		return
+		return description.Data{}, err
 	}
-	r, err := client.Do(req)
+	err = storeTrackMetrics(q, user.ID, activity.ID, data)
 	if err != nil {
-		errorf(event.EventTime, "%v", err)
-		return
+		return description.Data{}, fmt.Errorf("storing track metrics: %v", err)
 	}
-	if r.StatusCode > 299 {
-		bytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			errorf(event.EventTime, "an error accured while updating activity details: %v", err)
-			return
-		}
-		errorf(event.EventTime, "updating activity returned with HTTP %d %s: %s", r.StatusCode, r.Status, string(bytes))
-		return
+	err = storeActivity(q, user.ID, activity, data)
+	if err != nil {
+		return description.Data{}, fmt.Errorf("storing activity: %v", err)
+	}
+	infof(event.EventTime, "Found following Spotify Activity:")
+	for _, track := range data.Tracks {
+		infof(event.EventTime, "\t Name: %s", track.Name)
+		infof(event.EventTime, "\t Artists: %s", track.Artists)
+		infof(event.EventTime, "")
+	}
+	err = resolveContexts(event.EventTime, q, user.ID, &data)
+	if err != nil {
+		return description.Data{}, err
 	}
+	return data, nil
 }
 
-type MinimalPlaylist struct {
-	Name  string `json:"name"`
-	Owner struct {
-		DisplayName string `json:"display_name"`
-	} `json:"owner"`
+// resolveContexts looks up the names and owners of the contexts in data and
+// picks the playlist.
+func resolveContexts(id int64, q *database.Queries, userID int64, data *description.Data) error {
+	for i, ctx := range data.Contexts {
+		infof(id, "Contexts:")
+		infof(id, "\t Type: %s", ctx.Type)
+		infof(id, "\t Uri: %s", ctx.Uri)
+		infof(id, "\t Url: %s", ctx.Url)
+		infof(id, "\t Href: %s", ctx.Href)
+		if ctx.Href == "" || ctx.Type == "collection" {
+			continue
+		}
+		source, err := music.New(ctx.Source, q, userID)
+		if err != nil {
+			return err
+		}
+		details, err := source.ContextDetails(context.Background(), music.Context{
+			Type: ctx.Type,
+			Href: ctx.Href,
+			Url:  ctx.Url,
+			Uri:  ctx.Uri,
+		})
+		if errors.Is(err, music.ErrContextNotFound) {
+			infof(id, "\t context not found")
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("an error acourd while getting context %s: %v", ctx.Type, err)
+		}
+		data.Contexts[i].Name = details.Name
+		data.Contexts[i].Owner = details.Owner
+	}
+	data.SetPlaylist()
+	return nil
 }
 
-func getPlaylist(q *database.Queries, userId int64, playlistHref string) (*MinimalPlaylist, error) {
-	oauth2config := config.GetSpotifyOauthConfig()
-	dbToken, err := q.GetSpotifyAccessToken(context.Background(), userId)
+// writeSoundtrack appends the soundtrack of activity to base and writes the
+// result as the new description.
+func writeSoundtrack(event Callback, q *database.Queries, user database.User, activity *DetailedActivity, base string) error {
+	data, err := matchSoundtrack(event, q, user, activity)
+	if err != nil {
+		return err
+	}
+	settings, err := PlaylistSettings(q, user.ID)
+	if err != nil {
+		return err
+	}
+	data.ActivityPlaylist, err = activityPlaylist(event.EventTime, q, user.ID, activity, data, settings.AutoCreate)
+	if err != nil && !errors.Is(err, ErrNoSpotifyItems) {
+		// the description is more important than the playlist
+		errorf(event.EventTime, "creating playlist: %v", err)
+	}
+	err = unshareIfPrivate(event.EventTime, q, user.ID, activity)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	token := oauth2.Token{
-		TokenType:    dbToken.TokenType,
-		AccessToken:  dbToken.AccessToken,
-		RefreshToken: dbToken.RefreshToken,
-		Expiry:       time.Unix(dbToken.ExpiresAt, 0),
+	shareSettings, err := ShareSettings(q, user.ID)
+	if err != nil {
+		return err
+	}
+	if shareSettings.AddToDescription {
+		data.ShareUrl, err = activityShare(event.EventTime, q, user.ID, activity.ID, false)
+		if err != nil {
+			return err
+		}
+	}
+	tmpl, err := descriptionTemplate(q, user.ID)
+	if err != nil {
+		return err
+	}
+	prefix := descriptionPrefix(base)
+	playlistLine := ""
+	if settings.AddToDescription && data.ActivityPlaylist != "" {
+		playlistLine = "Playlist of this activity: " + data.ActivityPlaylist + "\n\n"
+	}
+	data.Limit = description.MaxLength - len([]rune(prefix)) - len([]rune(playlistLine))
+	if data.Limit <= len(data.Footer()) {
+		infof(event.EventTime, "description is too long to add a soundtrack")
+		return nil
+	}
+	soundtrack, err := description.Render(tmpl, data)
+	if err != nil {
+		return fmt.Errorf("rendering description template: %v", err)
+	}
+	if soundtrack != "" && playlistLine != "" && !strings.Contains(soundtrack, data.ActivityPlaylist) {
+		soundtrack = playlistLine + soundtrack
+	}
+	return submitSoundtrack(event.EventTime, q, user.ID, activity, base, soundtrack)
+}
+
+// descriptionTemplate returns the template of userID, the default one if
+// they did not write their own.
+func descriptionTemplate(q *database.Queries, userID int64) (string, error) {
+	tmpl, err := q.GetDescriptionTemplate(context.Background(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return description.Default, nil
 	}
-	client := oauth2config.Client(context.Background(), &token)
-	resp, err := client.Get(playlistHref + "?fields=name,owner.display_name")
 	if err != nil {
-		return nil, err
+		return "", fmt.Errorf("an error accourd while fetching description template: %v", err)
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("playlist not found")
+	return tmpl, nil
+}
+
+func updateDescription(q *database.Queries, userID int64, activityID int64, newDescription string) error {
+	client := oauth2.NewClient(context.Background(), tokens.Strava(q, userID))
+	values := make(url.Values)
+	values.Add("description", newDescription)
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("https://www.strava.com/api/v3/activities/%d?%s", activityID, values.Encode()), nil)
+	if err != nil {
+		return err
 	}
-	decoder := json.NewDecoder(resp.Body)
-	var pl MinimalPlaylist
-	err = decoder.Decode(&pl)
+	r, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode > 299 {
+		bytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			return fmt.Errorf("an error accured while updating activity details: %v", err)
+		}
+		return fmt.Errorf("updating activity returned with HTTP %d %s: %s", r.StatusCode, r.Status, string(bytes))
 	}
-	return &pl, nil
+	return nil
 }
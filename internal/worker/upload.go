@@ -0,0 +1,90 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/oauth2"
+	"io"
+	"mime/multipart"
+	"stravafy/internal/database"
+	"stravafy/internal/description"
+	"stravafy/internal/tokens"
+	"time"
+)
+
+// MatchActivityFile collects the soundtrack of an activity read from a file
+// and renders it with the description template of userID. Nothing is
+// stored, the activity is not on Strava (yet).
+func MatchActivityFile(q *database.Queries, userID int64, file *ActivityFile) (description.Data, string, error) {
+	id := time.Now().Unix()
+	infof(id, "matching uploaded file %s of user %d", file.Name, userID)
+	data, err := activitySoundtrack(q, userID, &file.Activity, &file.Streams)
+	if err != nil {
+		return description.Data{}, "", err
+	}
+	err = resolveContexts(id, q, userID, &data)
+	if err != nil {
+		return description.Data{}, "", err
+	}
+	tmpl, err := descriptionTemplate(q, userID)
+	if err != nil {
+		return description.Data{}, "", err
+	}
+	data.Limit = description.MaxLength
+	soundtrack, err := description.Render(tmpl, data)
+	if err != nil {
+		return description.Data{}, "", fmt.Errorf("rendering description template: %v", err)
+	}
+	return data, soundtrack, nil
+}
+
+// UploadActivity creates an activity on Strava from file. Strava processes
+// uploads asynchronously, the webhook reports the activity once it exists.
+// As the description already contains the soundtrack it is left alone then.
+func UploadActivity(q *database.Queries, userID int64, file *ActivityFile, desc string) (*Upload, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	fields := map[string]string{
+		"name":        file.Activity.Name,
+		"description": desc,
+		"data_type":   file.DataType,
+		"external_id": file.Name,
+	}
+	for key, value := range fields {
+		if err := w.WriteField(key, value); err != nil {
+			return nil, err
+		}
+	}
+	part, err := w.CreateFormFile("file", file.Name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write(file.Data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	client := oauth2.NewClient(context.Background(), tokens.Strava(q, userID))
+	resp, err := client.Post("https://www.strava.com/api/v3/uploads", w.FormDataContentType(), &body)
+	if err != nil {
+		return nil, fmt.Errorf("an error accured while uploading activity: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode > 299 {
+		bytes, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("an error accured while reading upload: %v", err)
+		}
+		return nil, fmt.Errorf("upload returned with HTTP %d %s: %s", resp.StatusCode, resp.Status, string(bytes))
+	}
+	var upload Upload
+	err = json.NewDecoder(resp.Body).Decode(&upload)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode upload: %v", err)
+	}
+	infof(userID, "uploaded %s to strava as upload %d: %s", file.Name, upload.ID, upload.Status)
+	return &upload, nil
+}
@@ -3,16 +3,13 @@ package worker
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"golang.org/x/oauth2"
-	"io"
 	"log"
-	"net/http"
 	"os"
 	"stravafy/internal/config"
 	"stravafy/internal/database"
+	"stravafy/internal/music"
 	"strings"
 	"sync"
 	"time"
@@ -22,6 +19,8 @@ var (
 	logger     *log.Logger
 	shutdownCh chan struct{}
 	wg         sync.WaitGroup
+	workersMu  sync.Mutex
+	workers    = make(map[int64]chan struct{})
 )
 
 func init() {
@@ -40,24 +39,46 @@ func Start() {
 		logger.Fatalf("nono database: %v", err)
 	}
 	queries := database.New(db.DB)
+	wg.Add(2)
+	go eventQueue(queries, shutdownCh)
+	go scrobbles(queries, shutdownCh)
+
 	userIds, err := queries.GetUserIdsWithActiveSpotify(context.Background())
 	if err != nil {
 		logger.Printf("worker error: %v", err)
 		return
 	}
-	wg.Add(len(userIds))
 	for _, id := range userIds {
-		go worker(id, shutdownCh, &wg)
+		LaunchSyncForUser(id)
 	}
 
 }
 
+// LaunchSyncForUser starts the Spotify worker of userID unless it is
+// already running.
 func LaunchSyncForUser(userID int64) {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	if _, ok := workers[userID]; ok {
+		return
+	}
+	stop := make(chan struct{})
+	workers[userID] = stop
 	wg.Add(1)
-	go worker(userID, shutdownCh, &wg)
+	go worker(userID, stop, shutdownCh, &wg)
 }
 
-func worker(id int64, shutdown <-chan struct{}, wg *sync.WaitGroup) {
+// StopSyncForUser stops the Spotify worker of userID if it is running.
+func StopSyncForUser(userID int64) {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	if stop, ok := workers[userID]; ok {
+		close(stop)
+		delete(workers, userID)
+	}
+}
+
+func worker(id int64, stop <-chan struct{}, shutdown <-chan struct{}, wg *sync.WaitGroup) {
 	defer wg.Done()
 	infof(id, "started worker for %d", id)
 
@@ -67,42 +88,45 @@ func worker(id int64, shutdown <-chan struct{}, wg *sync.WaitGroup) {
 		return
 	}
 	queries := database.New(db.DB)
-	dbToken, err := queries.GetSpotifyAccessToken(context.Background(), id)
-	token := oauth2.Token{
-		AccessToken:  dbToken.AccessToken,
-		TokenType:    dbToken.TokenType,
-		RefreshToken: dbToken.RefreshToken,
-		Expiry:       time.Unix(dbToken.ExpiresAt, 0),
-	}
-
-	oauth2Conf := config.GetSpotifyOauthConfig()
-	client := oauth2Conf.Client(context.Background(), &token)
+	source := music.NewSpotify(queries, id)
 
 	conf := config.GetConfig()
 	ticker := time.Tick(time.Duration(conf.Spotify.UpdateInterval) * time.Second)
+	reconcileInterval := conf.Spotify.ReconcileInterval
+	if reconcileInterval <= 0 {
+		reconcileInterval = config.DefaultConfig().Spotify.ReconcileInterval
+	}
+	reconcileTicker := time.Tick(time.Duration(reconcileInterval) * time.Second)
+
+	// catch up on everything played while the worker was not running
+	if err := reconcileRecentPlays(id, queries, source); err != nil {
+		errorf(id, "reconciling recent plays: %v", err)
+	}
 
 	for {
 		select {
+		case <-reconcileTicker:
+			if err := reconcileRecentPlays(id, queries, source); err != nil {
+				errorf(id, "reconciling recent plays: %v", err)
+			}
 		case <-ticker:
 			logger.Printf("worker %d [INFO]: updating player state", id)
-			resp, err := client.Get("https://api.spotify.com/v1/me/player?additional_types=track,episode")
+			play, err := source.NowPlaying(context.Background())
 			if err != nil {
 				errorf(id, "%v", err)
 				continue
 			}
-			infof(id, "[HTTP] GET /me/player %d", resp.StatusCode)
-			switch resp.StatusCode {
-			case http.StatusNoContent:
-				err := handlePaused(id, queries)
-				if err != nil {
-					errorf(id, "%v", err)
-				}
-			case http.StatusOK:
-				err := handlePlaying(id, queries, resp)
-				if err != nil {
-					errorf(id, "%v", err)
-				}
+			if play == nil {
+				err = handlePaused(id, queries, source.Name())
+			} else {
+				err = handlePlaying(id, queries, source.Name(), play)
 			}
+			if err != nil {
+				errorf(id, "%v", err)
+			}
+		case <-stop:
+			infof(id, "stopping worker for %d", id)
+			return
 		case <-shutdown:
 			infof(id, "shutting down worker for %d", id)
 			return
@@ -111,154 +135,161 @@ func worker(id int64, shutdown <-chan struct{}, wg *sync.WaitGroup) {
 
 }
 
-func handlePlaying(id int64, q *database.Queries, resp *http.Response) error {
-	bytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		errorf(id, "could not read body: %v", err)
-		return err
-	}
-	var playerState PlayerState
-	err = json.Unmarshal(bytes, &playerState)
-	if err != nil {
-		errorf(id, "could not serialize response: %v", err)
-		return err
-	}
-	if !playerState.IsPlaying {
-		return handlePaused(id, q)
-	}
-	var item ItemObject
-	err = json.Unmarshal(playerState.Item, &item)
-	if err != nil {
-		return fmt.Errorf("could not serialize item: %v", err)
-	}
-	var track TrackObject
-	var episode EpisodeObject
-	switch item.Type {
-	case "track":
-		err := json.Unmarshal(playerState.Item, &track)
-		if err != nil {
-			return err
-		}
-	case "episode":
-		err := json.Unmarshal(playerState.Item, &episode)
-		if err != nil {
-			return err
-		}
-	default:
-		infof(id, string(bytes))
-		return fmt.Errorf("looking for type \"track\" or \"episode\" found %s", item.Type)
-	}
+func handlePlaying(id int64, q *database.Queries, source string, play *music.Play) error {
 	lastHistEntry, err := q.GetLastHistoryEntryComplete(context.Background(), id)
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return err
 	}
-	if errors.Is(err, sql.ErrNoRows) || hasChanged(id, lastHistEntry, playerState, item) {
-		return insertPlayingState(id, q, playerState, item, &track, &episode)
+	if errors.Is(err, sql.ErrNoRows) || hasChanged(id, lastHistEntry, source, play) {
+		return insertPlayingState(id, q, source, play)
 	}
 	return nil
 }
 
-func hasChanged(id int64, lastEntry database.GetLastHistoryEntryCompleteRow, state PlayerState, item ItemObject) bool {
+func hasChanged(id int64, lastEntry database.GetLastHistoryEntryCompleteRow, source string, play *music.Play) bool {
 	infof(id, "looking for changes")
-	if lastEntry.IsPlaying != state.IsPlaying {
+	if !lastEntry.IsPlaying || lastEntry.Source != source {
 		return true
 	}
-	if lastEntry.CtxUri != state.Context.Uri {
+	ctxUri := ""
+	if play.Context != nil {
+		ctxUri = play.Context.Uri
+	}
+	if lastEntry.CtxUri.String != ctxUri {
 		return true
 	}
-	if lastEntry.ItemUri != item.Uri {
+	if lastEntry.ItemUri != play.Item.Uri {
 		return true
 	}
 	infof(id, "no changes found")
 	return false
 }
 
-func insertPlayingState(id int64, q *database.Queries, playerState PlayerState, item ItemObject, track *TrackObject, episode *EpisodeObject) error {
+func insertPlayingState(id int64, q *database.Queries, source string, play *music.Play) error {
 	infof(id, "inserting new player state")
+	_, err := insertHistoryEntry(id, q, source, *play)
+	if err != nil {
+		return err
+	}
+	publishPlayer(PlayerState{UserID: id, Play: play, Source: source, Updated: time.Now().UTC()})
+	return nil
+}
+
+func insertHistoryEntry(id int64, q *database.Queries, source string, play music.Play) (int64, error) {
 	histId, err := q.InsertHistory(context.Background(), database.InsertHistoryParams{
 		UserID:    id,
-		Timestamp: time.UnixMilli(playerState.Timestamp).UTC(),
+		Source:    source,
+		Timestamp: play.Start,
 		IsPlaying: true,
 	})
 	if err != nil {
-		return err
+		return 0, err
 	}
-	if playerState.Context != nil {
+	if play.Context != nil {
 		err := q.InsertHistoryContext(context.Background(), database.InsertHistoryContextParams{
 			HistoryID:   histId,
-			Type:        playerState.Context.Type,
-			Href:        playerState.Context.Href,
-			ExternalUrl: playerState.Context.ExternalUrls.Spotify,
-			Uri:         playerState.Context.Uri,
+			Type:        play.Context.Type,
+			Href:        play.Context.Href,
+			ExternalUrl: play.Context.Url,
+			Uri:         play.Context.Uri,
 		})
 		if err != nil {
-			return err
+			return 0, err
 		}
 	}
+	item := play.Item
 	params := database.InsertHistoryItemParams{
 		HistoryID:   histId,
 		Type:        item.Type,
 		Href:        item.Href,
-		ExternalUrl: item.ExternalUrls.Spotify,
+		ExternalUrl: item.Url,
 		Uri:         item.Uri,
 		Name:        item.Name,
 	}
-	if item.Type == "track" {
-		var artists []string
-		for _, artist := range track.Artists {
-			artists = append(artists, artist.Name)
-		}
+	if item.Episode == nil {
 		params.Artists = sql.NullString{
-			String: strings.Join(artists, ", "),
+			String: strings.Join(item.Artists, ", "),
 			Valid:  true,
 		}
 		params.Album = sql.NullString{
-			String: track.Album.Name,
+			String: item.Album,
 			Valid:  true,
 		}
 		params.AlbumUri = sql.NullString{
-			String: track.Album.Uri,
-			Valid:  true,
+			String: item.AlbumUri,
+			Valid:  item.AlbumUri != "",
 		}
 	} else {
 		params.EpisodeDescription = sql.NullString{
-			String: episode.Description,
+			String: item.Episode.Description,
 			Valid:  true,
 		}
 		params.EpisodeShowName = sql.NullString{
-			String: episode.Show.Name,
+			String: item.Episode.Show,
 			Valid:  true,
 		}
 		params.EpisodeShowDescription = sql.NullString{
-			String: episode.Show.Description,
+			String: item.Episode.ShowDescription,
 			Valid:  true,
 		}
 		params.EpisodeShowUri = sql.NullString{
-			String: episode.Show.Uri,
-			Valid:  true,
+			String: item.Episode.ShowUri,
+			Valid:  item.Episode.ShowUri != "",
 		}
 	}
 	infof(id, "new history entry id: %d", histId)
-	return q.InsertHistoryItem(context.Background(), params)
+	return histId, q.InsertHistoryItem(context.Background(), params)
 }
 
-func handlePaused(id int64, q *database.Queries) error {
+// handlePaused closes the play source last reported. A play another source
+// started is left open, that source ends it.
+func handlePaused(id int64, q *database.Queries, source string) error {
 	infof(id, "currently not playing")
 	lastHistEntry, err := q.GetLastHistoryEntryForUser(context.Background(), id)
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return err
 	}
-	if errors.Is(err, sql.ErrNoRows) || lastHistEntry.IsPlaying {
-		_, err := q.InsertHistory(context.Background(), database.InsertHistoryParams{
-			UserID:    id,
-			Timestamp: time.Now().UTC(),
-			IsPlaying: false,
-		})
+	if err == nil && !lastHistEntry.IsPlaying {
+		return nil
+	}
+	if err == nil && lastHistEntry.Source != source {
+		infof(id, "%s is playing, leaving it open", lastHistEntry.Source)
+		return nil
+	}
+	now := time.Now().UTC()
+	_, err = q.InsertHistory(context.Background(), database.InsertHistoryParams{
+		UserID:    id,
+		Source:    source,
+		Timestamp: now,
+		IsPlaying: false,
+	})
+	if err != nil {
 		return err
 	}
+	publishPlayer(PlayerState{UserID: id, Updated: now})
 	return nil
 }
 
+// openEntry returns the last entry of the history of id if it is still
+// playing.
+func openEntry(id int64, q *database.Queries) (database.GetLastHistoryEntryCompleteRow, bool, error) {
+	last, err := q.GetLastHistoryEntryForUser(context.Background(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.GetLastHistoryEntryCompleteRow{}, false, nil
+	}
+	if err != nil || !last.IsPlaying {
+		return database.GetLastHistoryEntryCompleteRow{}, false, err
+	}
+	entry, err := q.GetLastHistoryEntryComplete(context.Background(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entry, false, nil
+	}
+	if err != nil {
+		return entry, false, err
+	}
+	return entry, entry.ID == last.ID, nil
+}
+
 func Shutdown() {
 	close(shutdownCh)
 	wg.Wait()
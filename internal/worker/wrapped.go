@@ -0,0 +1,196 @@
+package worker
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"stravafy/internal/config"
+	"stravafy/internal/database"
+	"strings"
+	"time"
+)
+
+const wrappedTopSize = 5
+
+// Wrapped is the year in review of a user, made from the soundtracks of
+// their stored activities.
+type Wrapped struct {
+	Year int
+	// Activities counts the activities something played during.
+	Activities  int
+	MusicTime   time.Duration
+	PodcastTime time.Duration
+	TopArtists  []WrappedCount
+	TopTracks   []WrappedCount
+	// Sports is the time of music per sport type, most first.
+	Sports     []WrappedCount
+	Longest    *LongestSoundtrack
+	PowerSongs []database.GetPowerSongsBetweenRow
+}
+
+// WrappedCount is how often and how long something played.
+type WrappedCount struct {
+	Name string
+	// Detail is the artists of a track.
+	Detail string
+	Url    string
+	Plays  int
+	Time   time.Duration
+}
+
+// LongestSoundtrack is the activity with the most time of music and
+// podcasts.
+type LongestSoundtrack struct {
+	ActivityID int64
+	Name       string
+	Date       time.Time
+	Items      int
+	Time       time.Duration
+}
+
+// YearInReview sums up what userID played during the activities they
+// started in year, in their local time.
+func YearInReview(q *database.Queries, userID int64, year int) (*Wrapped, error) {
+	after := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+	before := after.AddDate(1, 0, 0)
+	rows, err := q.ListSoundtracksBetween(context.Background(), database.ListSoundtracksBetweenParams{
+		UserID: userID,
+		After:  after,
+		Before: before,
+	})
+	if err != nil {
+		return nil, err
+	}
+	wrapped := &Wrapped{Year: year}
+	wrapped.PowerSongs, err = q.GetPowerSongsBetween(context.Background(), database.GetPowerSongsBetweenParams{
+		UserID:     userID,
+		After:      after,
+		Before:     before,
+		MinSeconds: PowerSongMinSeconds,
+		Limit:      wrappedTopSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	artists := make(map[string]*WrappedCount)
+	tracks := make(map[string]*WrappedCount)
+	sports := make(map[string]*WrappedCount)
+	soundtracks := make(map[int64]*LongestSoundtrack)
+	for _, row := range rows {
+		played := time.Duration(row.DurationSeconds) * time.Second
+		soundtrack, ok := soundtracks[row.ActivityID]
+		if !ok {
+			soundtrack = &LongestSoundtrack{ActivityID: row.ActivityID, Name: row.ActivityName, Date: row.StartDateLocal}
+			soundtracks[row.ActivityID] = soundtrack
+		}
+		soundtrack.Items++
+		soundtrack.Time += played
+		if row.ItemType == "episode" {
+			wrapped.PodcastTime += played
+			continue
+		}
+		wrapped.MusicTime += played
+		count(sports, row.SportType, WrappedCount{Name: row.SportType}, played)
+		count(tracks, row.ItemUri, WrappedCount{Name: row.Name, Detail: row.Artists.String, Url: row.ItemExternalUrl}, played)
+		for _, artist := range strings.Split(row.Artists.String, ", ") {
+			if artist != "" {
+				count(artists, artist, WrappedCount{Name: artist}, played)
+			}
+		}
+	}
+	wrapped.Activities = len(soundtracks)
+	for _, soundtrack := range soundtracks {
+		if wrapped.Longest == nil || soundtrack.Time > wrapped.Longest.Time ||
+			(soundtrack.Time == wrapped.Longest.Time && soundtrack.Date.Before(wrapped.Longest.Date)) {
+			wrapped.Longest = soundtrack
+		}
+	}
+	wrapped.TopArtists = top(artists, wrappedTopSize)
+	wrapped.TopTracks = top(tracks, wrappedTopSize)
+	wrapped.Sports = top(sports, len(sports))
+	return wrapped, nil
+}
+
+// WrappedShareUrl is the public page of a shared Wrapped.
+func WrappedShareUrl(token string) string {
+	return strings.TrimSuffix(config.GetConfig().Strava.WebhookHost, "/") + "/w/" + token
+}
+
+// WrappedShare returns the url of the public page of the Wrapped of year,
+// empty if it is not shared.
+func WrappedShare(q *database.Queries, userID int64, year int) (string, error) {
+	share, err := q.GetWrappedShare(context.Background(), database.GetWrappedShareParams{UserID: userID, Year: int64(year)})
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return WrappedShareUrl(share.Token), nil
+}
+
+// ShareWrapped creates the public page of the Wrapped of year and returns
+// its url. Sharing it again keeps the link.
+func ShareWrapped(q *database.Queries, userID int64, year int) (string, error) {
+	shareUrl, err := WrappedShare(q, userID, year)
+	if err != nil || shareUrl != "" {
+		return shareUrl, err
+	}
+	token, err := newShareToken()
+	if err != nil {
+		return "", err
+	}
+	err = q.InsertWrappedShare(context.Background(), database.InsertWrappedShareParams{
+		UserID: userID,
+		Year:   int64(year),
+		Token:  token,
+	})
+	if err != nil {
+		return "", err
+	}
+	infof(userID, "created public page of wrapped %d", year)
+	return WrappedShareUrl(token), nil
+}
+
+// RevokeWrapped deletes the public page of the Wrapped of year.
+func RevokeWrapped(q *database.Queries, userID int64, year int) error {
+	infof(userID, "revoking public page of wrapped %d", year)
+	return q.DeleteWrappedShare(context.Background(), database.DeleteWrappedShareParams{UserID: userID, Year: int64(year)})
+}
+
+// SharedWrapped sums up the year a public link is for.
+func SharedWrapped(q *database.Queries, token string) (*Wrapped, error) {
+	share, err := q.GetWrappedShareByToken(context.Background(), token)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrShareNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return YearInReview(q, share.UserID, int(share.Year))
+}
+
+func count(counts map[string]*WrappedCount, key string, c WrappedCount, played time.Duration) {
+	if _, ok := counts[key]; !ok {
+		counts[key] = &c
+	}
+	counts[key].Plays++
+	counts[key].Time += played
+}
+
+// top returns the n counts played the longest, which is what "most
+// played" means here.
+func top(counts map[string]*WrappedCount, n int) []WrappedCount {
+	all := make([]WrappedCount, 0, len(counts))
+	for _, c := range counts {
+		all = append(all, *c)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Time != all[j].Time {
+			return all[i].Time > all[j].Time
+		}
+		return all[i].Name < all[j].Name
+	})
+	return all[:min(n, len(all))]
+}
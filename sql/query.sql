@@ -72,30 +72,31 @@ UPDATE  spotify_refresh_token SET refresh_token = ? WHERE user_id = ?;
 SELECT * FROM spotify_user_info WHERE user_id = ?;
 
 -- name: InsertSpotifyUserInfo :exec
-INSERT INTO spotify_user_info (user_id, spotify_id, display_name) VALUES (?, ?, ?);
+INSERT INTO spotify_user_info (user_id, spotify_id, display_name) VALUES (?, ?, ?)
+ON CONFLICT (user_id) DO UPDATE SET spotify_id = excluded.spotify_id, display_name = excluded.display_name;
 
 -- name: InsertSpotifyUserImage :exec
-INSERT INTO spotify_user_images (user_id, url, width, height) VALUES (?, ?, ?, ?);
+INSERT OR REPLACE INTO spotify_user_images (user_id, url, width, height) VALUES (?, ?, ?, ?);
 
 -- name: GetUserIdsWithActiveSpotify :many
-SELECT user_id from spotify_user_info;
+SELECT user_id from spotify_user_info
+WHERE user_id IN (SELECT user_id FROM strava_access_token);
 
 -- name: InsertHistory :one
-INSERT INTO spotify_user_history (user_id, timestamp, is_playing) VALUES (?, ?, ?) RETURNING id;
+INSERT INTO history (user_id, source, timestamp, is_playing) VALUES (?, ?, ?, ?) RETURNING id;
 
 -- name: InsertHistoryContext :exec
-INSERT INTO spotify_user_history_context (history_id, type, href, external_url, uri) VALUES (?, ?, ?, ?, ?);
+INSERT INTO history_context (history_id, type, href, external_url, uri) VALUES (?, ?, ?, ?, ?);
 
 -- name: GetLastHistoryEntryForUser :one
-SELECT * FROM spotify_user_history
+SELECT * FROM history
 WHERE user_id = ?
 ORDER BY timestamp DESC
 LIMIT 1;
 
 -- name: InsertHistoryItem :exec
-INSERT INTO spotify_user_history_item (history_id, type, href, external_url, uri, name, artists, album, album_uri,
-                                       episode_description, episode_show_name, episode_show_description,
-                                       episode_show_uri)
+INSERT INTO history_item (history_id, type, href, external_url, uri, name, artists, album, album_uri,
+                          episode_description, episode_show_name, episode_show_description, episode_show_uri)
 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
 
 -- name: GetLastHistoryEntryComplete :one
@@ -117,10 +118,11 @@ SELECT id,
        item.episode_description,
        item.episode_show_name,
        item.episode_show_description,
-       item.episode_show_uri
-FROM spotify_user_history
-         JOIN main.spotify_user_history_context ctx on spotify_user_history.id = ctx.history_id
-         JOIN main.spotify_user_history_item item on spotify_user_history.id = item.history_id
+       item.episode_show_uri,
+       source
+FROM history
+         LEFT JOIN main.history_context ctx on history.id = ctx.history_id
+         JOIN main.history_item item on history.id = item.history_id
 WHERE user_id = ?
 ORDER BY timestamp DESC
 LIMIT 1;
@@ -144,10 +146,540 @@ SELECT id,
        item.episode_description,
        item.episode_show_name,
        item.episode_show_description,
-       item.episode_show_uri
-FROM spotify_user_history
-         JOIN main.spotify_user_history_context ctx on spotify_user_history.id = ctx.history_id
-         JOIN main.spotify_user_history_item item on spotify_user_history.id = item.history_id
+       item.episode_show_uri,
+       source
+FROM history
+         LEFT JOIN main.history_context ctx on history.id = ctx.history_id
+         LEFT JOIN main.history_item item on history.id = item.history_id
 WHERE
 user_id = ? AND timestamp > ? AND timestamp < ?
 ORDER BY timestamp;
+
+-- name: CountHistoryItemsBetween :one
+SELECT COUNT(*) FROM history
+         JOIN main.history_item item on history.id = item.history_id
+WHERE user_id = ? AND item.uri = ? AND timestamp >= ? AND timestamp <= ?;
+
+-- name: InsertHistoryReconciled :exec
+INSERT INTO spotify_user_history_reconciled (history_id, played_at) VALUES (?, ?);
+
+-- name: CountHistoryEntriesBetween :one
+SELECT COUNT(*) FROM history
+WHERE user_id = ? AND timestamp >= ? AND timestamp < ?;
+
+-- name: InsertHistoryImported :exec
+INSERT INTO spotify_user_history_imported (history_id, played_at, ms_played) VALUES (?, ?, ?);
+
+-- name: GetRecentlyPlayedCursor :one
+SELECT played_after FROM spotify_recently_played_cursor WHERE user_id = ?;
+
+-- name: UpsertRecentlyPlayedCursor :exec
+INSERT INTO spotify_recently_played_cursor (user_id, played_after) VALUES (?, ?)
+ON CONFLICT (user_id) DO UPDATE SET played_after = excluded.played_after;
+
+-- name: InsertStravaEvent :one
+INSERT INTO strava_event (object_type, object_id, aspect_type, updates, owner_id, subscription_id, event_time,
+                          next_attempt_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+RETURNING id;
+
+-- name: ResetProcessingStravaEvents :execrows
+UPDATE strava_event SET state = 'pending', updated_at = CURRENT_TIMESTAMP WHERE state = 'processing';
+
+-- name: GetDueStravaEvents :many
+-- Events of an object are handled one after the other in the order they
+-- happened, so an event waits for every earlier one that is not finished.
+SELECT * FROM strava_event e
+WHERE e.state IN ('pending', 'failed') AND e.next_attempt_at <= ?
+  AND NOT EXISTS (SELECT 1 FROM strava_event prev
+                  WHERE prev.object_type = e.object_type
+                    AND prev.object_id = e.object_id
+                    AND prev.state IN ('pending', 'processing', 'failed')
+                    AND (prev.event_time < e.event_time OR (prev.event_time = e.event_time AND prev.id < e.id)))
+ORDER BY e.event_time, e.id
+LIMIT ?;
+
+-- name: ClaimStravaEvent :execrows
+UPDATE strava_event SET state = 'processing', attempts = attempts + 1, updated_at = CURRENT_TIMESTAMP
+WHERE id = ? AND state IN ('pending', 'failed');
+
+-- name: DeleteFinishedStravaEvents :execrows
+DELETE FROM strava_event WHERE state IN ('done', 'dead') AND updated_at < ?;
+
+-- name: FinishStravaEvent :exec
+UPDATE strava_event SET state = ?, last_error = ?, next_attempt_at = ?, updated_at = CURRENT_TIMESTAMP
+WHERE id = ?;
+
+-- name: GetDescriptionTemplate :one
+SELECT template FROM description_template WHERE user_id = ?;
+
+-- name: UpsertDescriptionTemplate :exec
+INSERT INTO description_template (user_id, template) VALUES (?, ?)
+ON CONFLICT (user_id) DO UPDATE SET template = excluded.template, updated_at = CURRENT_TIMESTAMP;
+
+-- name: DeleteDescriptionTemplate :exec
+DELETE FROM description_template WHERE user_id = ?;
+
+-- name: DeleteTrackMetricsForActivity :exec
+DELETE FROM track_metric WHERE activity_id = ? AND user_id = ?;
+
+-- name: InsertTrackMetric :exec
+INSERT INTO track_metric (user_id, activity_id, history_id, track_uri, track_name, artists, offset_seconds,
+                          duration_seconds, samples, heartrate, speed, watts, cadence, effort)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+
+-- name: GetPowerSongs :many
+-- Effort is weighted by how long a track played, tracks that played less
+-- than min_seconds in total are left out.
+SELECT track_uri,
+       track_name,
+       artists,
+       CAST(COUNT(DISTINCT activity_id) AS INTEGER)                        activities,
+       CAST(SUM(duration_seconds) AS INTEGER)                              seconds,
+       CAST(SUM(effort * duration_seconds) / SUM(duration_seconds) AS REAL) effort,
+       CAST(COALESCE(AVG(heartrate), 0) AS REAL)                           heartrate,
+       CAST(COALESCE(AVG(speed), 0) AS REAL)                               speed,
+       CAST(COALESCE(AVG(watts), 0) AS REAL)                               watts
+FROM track_metric
+WHERE user_id = sqlc.arg(user_id) AND effort > 0
+GROUP BY track_uri
+HAVING SUM(duration_seconds) >= sqlc.arg(min_seconds)
+ORDER BY effort DESC
+LIMIT sqlc.arg(limit);
+
+-- name: GetActivitySoundtrack :one
+SELECT * FROM activity_soundtrack WHERE activity_id = ? AND user_id = ?;
+
+-- name: UpsertActivitySoundtrack :exec
+INSERT INTO activity_soundtrack (activity_id, user_id, start_date, elapsed_time, soundtrack) VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (activity_id) DO UPDATE SET start_date   = excluded.start_date,
+                                        elapsed_time = excluded.elapsed_time,
+                                        soundtrack   = excluded.soundtrack,
+                                        updated_at   = CURRENT_TIMESTAMP;
+
+-- name: DeleteActivitySoundtrack :exec
+DELETE FROM activity_soundtrack WHERE activity_id = ? AND user_id = ?;
+
+-- name: UpsertStravaAccessToken :exec
+INSERT INTO strava_access_token (user_id, access_token, expires_at) VALUES (?, ?, ?)
+ON CONFLICT (user_id) DO UPDATE SET access_token = excluded.access_token, expires_at = excluded.expires_at;
+
+-- name: UpsertStravaRefreshToken :exec
+INSERT INTO strava_refresh_token (user_id, refresh_token) VALUES (?, ?)
+ON CONFLICT (user_id) DO UPDATE SET refresh_token = excluded.refresh_token;
+
+-- name: DeleteStravaAccessToken :exec
+DELETE FROM strava_access_token WHERE user_id = ?;
+
+-- name: DeleteStravaRefreshToken :exec
+DELETE FROM strava_refresh_token WHERE user_id = ?;
+
+-- name: DeleteSessionsForUser :exec
+DELETE FROM session WHERE user_id = ?;
+
+-- name: DeleteSpotifyAccessToken :exec
+DELETE FROM spotify_access_token WHERE user_id = ?;
+
+-- name: DeleteSpotifyRefreshToken :exec
+DELETE FROM spotify_refresh_token WHERE user_id = ?;
+
+-- name: DeleteSpotifyUserInfo :exec
+DELETE FROM spotify_user_info WHERE user_id = ?;
+
+-- name: DeleteSpotifyUserImages :exec
+DELETE FROM spotify_user_images WHERE user_id = ?;
+
+-- name: DeleteHistoryContextsForUser :exec
+DELETE FROM history_context
+WHERE history_id IN (SELECT id FROM history WHERE user_id = ?);
+
+-- name: DeleteHistoryItemsForUser :exec
+DELETE FROM history_item
+WHERE history_id IN (SELECT id FROM history WHERE user_id = ?);
+
+-- name: DeleteHistoryReconciledForUser :exec
+DELETE FROM spotify_user_history_reconciled
+WHERE history_id IN (SELECT id FROM history WHERE user_id = ?);
+
+-- name: DeleteHistoryImportedForUser :exec
+DELETE FROM spotify_user_history_imported
+WHERE history_id IN (SELECT id FROM history WHERE user_id = ?);
+
+-- name: DeleteHistoryForUser :exec
+DELETE FROM history WHERE user_id = ?;
+
+-- name: DeleteRecentlyPlayedCursor :exec
+DELETE FROM spotify_recently_played_cursor WHERE user_id = ?;
+
+-- name: DeleteTrackMetricsForUser :exec
+DELETE FROM track_metric WHERE user_id = ?;
+
+-- name: DeleteActivitySoundtracksForUser :exec
+DELETE FROM activity_soundtrack WHERE user_id = ?;
+
+-- name: DeleteStravaEventsForOwner :exec
+DELETE FROM strava_event WHERE owner_id = ? AND id != ?;
+
+-- name: DeleteUser :exec
+DELETE FROM user WHERE id = ?;
+
+-- name: UpsertActivity :exec
+INSERT INTO activity (id, user_id, name, type, sport_type, start_date, start_date_local, timezone, elapsed_time,
+                      moving_time, distance, total_elevation_gain, average_speed, max_speed, average_heartrate,
+                      average_watts, private, commute, trainer, manual, summary_polyline)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET name                 = excluded.name,
+                               type                 = excluded.type,
+                               sport_type           = excluded.sport_type,
+                               start_date           = excluded.start_date,
+                               start_date_local     = excluded.start_date_local,
+                               timezone             = excluded.timezone,
+                               elapsed_time         = excluded.elapsed_time,
+                               moving_time          = excluded.moving_time,
+                               distance             = excluded.distance,
+                               total_elevation_gain = excluded.total_elevation_gain,
+                               average_speed        = excluded.average_speed,
+                               max_speed            = excluded.max_speed,
+                               average_heartrate    = excluded.average_heartrate,
+                               average_watts        = excluded.average_watts,
+                               private              = excluded.private,
+                               commute              = excluded.commute,
+                               trainer              = excluded.trainer,
+                               manual               = excluded.manual,
+                               summary_polyline     = excluded.summary_polyline,
+                               updated_at           = CURRENT_TIMESTAMP;
+
+-- name: GetActivity :one
+SELECT * FROM activity WHERE id = ? AND user_id = ?;
+
+-- name: UpdateActivityPrivate :exec
+UPDATE activity SET private = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND user_id = ?;
+
+-- name: ListActivitiesForUser :many
+SELECT * FROM activity
+WHERE user_id = ?
+ORDER BY start_date DESC
+LIMIT ? OFFSET ?;
+
+-- name: CountActivitiesForUser :one
+SELECT COUNT(*) FROM activity WHERE user_id = ?;
+
+-- name: DeleteActivity :exec
+DELETE FROM activity WHERE id = ? AND user_id = ?;
+
+-- name: DeleteActivitiesForUser :exec
+DELETE FROM activity WHERE user_id = ?;
+
+-- name: InsertActivityTrack :exec
+INSERT INTO activity_track (activity_id, history_id, position, offset_seconds, duration_seconds)
+VALUES (?, ?, ?, ?, ?);
+
+-- name: DeleteActivityTracks :exec
+DELETE FROM activity_track
+WHERE activity_id = sqlc.arg(activity_id)
+  AND activity_id IN (SELECT id FROM activity WHERE user_id = sqlc.arg(user_id));
+
+-- name: DeleteActivityTracksForUser :exec
+DELETE FROM activity_track
+WHERE activity_id IN (SELECT id FROM activity WHERE user_id = ?);
+
+-- name: InsertActivityInterval :exec
+INSERT INTO activity_interval (activity_id, kind, position, name, distance, offset_seconds, elapsed_seconds)
+VALUES (?, ?, ?, ?, ?, ?, ?);
+
+-- name: DeleteActivityIntervals :exec
+DELETE FROM activity_interval
+WHERE activity_id = sqlc.arg(activity_id)
+  AND activity_id IN (SELECT id FROM activity WHERE user_id = sqlc.arg(user_id));
+
+-- name: DeleteActivityIntervalsForUser :exec
+DELETE FROM activity_interval
+WHERE activity_id IN (SELECT id FROM activity WHERE user_id = ?);
+
+-- name: GetActivityIntervals :many
+SELECT * FROM activity_interval
+WHERE activity_id = ?
+ORDER BY kind, position;
+
+-- name: GetActivityTracks :many
+SELECT at.activity_id,
+       at.history_id,
+       at.position,
+       at.offset_seconds,
+       at.duration_seconds,
+       h.timestamp,
+       item.type         item_type,
+       item.uri          item_uri,
+       item.external_url item_external_url,
+       item.name,
+       item.artists,
+       item.album,
+       item.episode_show_name,
+       ctx.type          ctx_type,
+       ctx.uri           ctx_uri,
+       ctx.external_url  ctx_external_url
+FROM activity_track at
+         JOIN main.history h on at.history_id = h.id
+         JOIN main.history_item item on at.history_id = item.history_id
+         LEFT JOIN main.history_context ctx on at.history_id = ctx.history_id
+WHERE at.activity_id = ?
+ORDER BY at.position;
+
+-- name: UpsertMusicAccount :exec
+INSERT INTO music_account (user_id, source, username, token)
+VALUES (?, ?, ?, ?)
+ON CONFLICT (user_id, source) DO UPDATE SET played_after = CASE
+                                                               WHEN username = excluded.username THEN played_after
+                                                               ELSE 0 END,
+                                            username     = excluded.username,
+                                            token        = excluded.token;
+
+-- name: GetMusicAccount :one
+SELECT * FROM music_account WHERE user_id = ? AND source = ?;
+
+-- name: ListMusicAccounts :many
+SELECT * FROM music_account ORDER BY user_id, source;
+
+-- name: ListMusicAccountsForUser :many
+SELECT * FROM music_account WHERE user_id = ? ORDER BY source;
+
+-- name: UpdateMusicAccountCursor :exec
+UPDATE music_account SET played_after = ? WHERE user_id = ? AND source = ?;
+
+-- name: DeleteMusicAccount :exec
+DELETE FROM music_account WHERE user_id = ? AND source = ?;
+
+-- name: DeleteMusicAccountsForUser :exec
+DELETE FROM music_account WHERE user_id = ?;
+
+-- name: CountHistoryItemsByNameBetween :one
+SELECT COUNT(*) FROM history
+         JOIN main.history_item item on history.id = item.history_id
+WHERE user_id = ? AND item.name = ? AND timestamp >= ? AND timestamp <= ?;
+
+-- name: InsertApiToken :exec
+INSERT INTO api_token (user_id, name, token_hash) VALUES (?, ?, ?);
+
+-- name: GetApiTokenByHash :one
+SELECT * FROM api_token WHERE token_hash = ?;
+
+-- name: ListApiTokensForUser :many
+SELECT * FROM api_token WHERE user_id = ? ORDER BY created_at;
+
+-- name: TouchApiToken :exec
+UPDATE api_token SET last_used_at = CURRENT_TIMESTAMP WHERE id = ?;
+
+-- name: DeleteApiToken :exec
+DELETE FROM api_token WHERE id = ? AND user_id = ?;
+
+-- name: DeleteApiTokensForUser :exec
+DELETE FROM api_token WHERE user_id = ?;
+
+-- name: UpsertSpotifyScope :exec
+INSERT INTO spotify_scope (user_id, scope) VALUES (?, ?)
+ON CONFLICT (user_id) DO UPDATE SET scope = excluded.scope;
+
+-- name: GetSpotifyScope :one
+SELECT scope FROM spotify_scope WHERE user_id = ?;
+
+-- name: DeleteSpotifyScope :exec
+DELETE FROM spotify_scope WHERE user_id = ?;
+
+-- name: GetPlaylistSettings :one
+SELECT * FROM playlist_settings WHERE user_id = ?;
+
+-- name: UpsertPlaylistSettings :exec
+INSERT INTO playlist_settings (user_id, auto_create, add_to_description) VALUES (?, ?, ?)
+ON CONFLICT (user_id) DO UPDATE SET auto_create        = excluded.auto_create,
+                                    add_to_description = excluded.add_to_description;
+
+-- name: DeletePlaylistSettings :exec
+DELETE FROM playlist_settings WHERE user_id = ?;
+
+-- name: GetActivityPlaylist :one
+SELECT * FROM activity_playlist WHERE activity_id = ? AND user_id = ?;
+
+-- name: InsertActivityPlaylist :exec
+INSERT INTO activity_playlist (activity_id, user_id, playlist_id, url) VALUES (?, ?, ?, ?);
+
+-- name: DeleteActivityPlaylist :exec
+DELETE FROM activity_playlist WHERE activity_id = ? AND user_id = ?;
+
+-- name: DeleteActivityPlaylistsForUser :exec
+DELETE FROM activity_playlist WHERE user_id = ?;
+
+-- name: GetActivityRules :one
+SELECT * FROM activity_rules WHERE user_id = ?;
+
+-- name: UpsertActivityRules :exec
+INSERT INTO activity_rules (user_id, sport_types, skip_private, skip_commute, skip_trainer, skip_manual, min_duration, opt_out_tag)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (user_id) DO UPDATE SET sport_types  = excluded.sport_types,
+                                    skip_private = excluded.skip_private,
+                                    skip_commute = excluded.skip_commute,
+                                    skip_trainer = excluded.skip_trainer,
+                                    skip_manual  = excluded.skip_manual,
+                                    min_duration = excluded.min_duration,
+                                    opt_out_tag  = excluded.opt_out_tag;
+
+-- name: DeleteActivityRules :exec
+DELETE FROM activity_rules WHERE user_id = ?;
+
+-- name: GetReviewSettings :one
+SELECT * FROM review_settings WHERE user_id = ?;
+
+-- name: UpsertReviewSettings :exec
+INSERT INTO review_settings (user_id, enabled, notify_url) VALUES (?, ?, ?)
+ON CONFLICT (user_id) DO UPDATE SET enabled = excluded.enabled, notify_url = excluded.notify_url;
+
+-- name: DeleteReviewSettings :exec
+DELETE FROM review_settings WHERE user_id = ?;
+
+-- name: UpsertPendingDescription :exec
+INSERT INTO pending_description (activity_id, user_id, name, start_date, soundtrack, token_hash) VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (activity_id) DO UPDATE SET name       = excluded.name,
+                                        start_date = excluded.start_date,
+                                        soundtrack = excluded.soundtrack,
+                                        token_hash = excluded.token_hash,
+                                        created_at = CURRENT_TIMESTAMP;
+
+-- name: GetPendingDescription :one
+SELECT * FROM pending_description WHERE activity_id = ?;
+
+-- name: GetPendingDescriptionByToken :one
+SELECT * FROM pending_description WHERE token_hash = ?;
+
+-- name: ListPendingDescriptions :many
+SELECT * FROM pending_description WHERE user_id = ? ORDER BY start_date DESC;
+
+-- name: DeletePendingDescription :exec
+DELETE FROM pending_description WHERE activity_id = ? AND user_id = ?;
+
+-- name: DeletePendingDescriptionsForUser :exec
+DELETE FROM pending_description WHERE user_id = ?;
+
+-- name: ListHistory :many
+-- Plays that match the filters, artist is a LIKE pattern escaped with \.
+SELECT h.id,
+       h.timestamp,
+       ctx.type ctx_type,
+       ctx.external_url ctx_external_url,
+       ctx.uri ctx_uri,
+       item.type item_type,
+       item.external_url item_external_url,
+       item.uri item_uri,
+       item.name,
+       item.artists,
+       item.album,
+       item.episode_show_name,
+       h.source
+FROM history h
+         LEFT JOIN history_context ctx ON h.id = ctx.history_id
+         JOIN history_item item ON h.id = item.history_id
+WHERE h.user_id = sqlc.arg(user_id)
+  AND h.is_playing = TRUE
+  AND h.timestamp >= sqlc.arg(after)
+  AND h.timestamp < sqlc.arg(before)
+  AND (CAST(sqlc.arg(artist) AS TEXT) = '' OR item.artists LIKE '%' || CAST(sqlc.arg(artist) AS TEXT) || '%' ESCAPE '\')
+  AND (CAST(sqlc.arg(context_uri) AS TEXT) = '' OR ctx.uri = CAST(sqlc.arg(context_uri) AS TEXT))
+  AND (CAST(sqlc.arg(item_type) AS TEXT) = '' OR item.type = CAST(sqlc.arg(item_type) AS TEXT))
+ORDER BY h.timestamp DESC
+LIMIT sqlc.arg(limit) OFFSET sqlc.arg(offset);
+
+-- name: ListHistoryPauses :many
+-- The pauses from after to before and the first one after before, which
+-- end the listening sessions of the plays in between.
+SELECT timestamp
+FROM history
+WHERE user_id = sqlc.arg(user_id)
+  AND is_playing = FALSE
+  AND timestamp >= sqlc.arg(after)
+  AND timestamp <= COALESCE((SELECT MIN(timestamp)
+                             FROM history
+                             WHERE user_id = sqlc.arg(user_id)
+                               AND is_playing = FALSE
+                               AND timestamp >= sqlc.arg(before)), sqlc.arg(before))
+ORDER BY timestamp;
+
+-- name: GetPowerSongsBetween :many
+-- Like GetPowerSongs for the activities between after and before.
+SELECT tm.track_uri,
+       tm.track_name,
+       tm.artists,
+       CAST(COUNT(DISTINCT tm.activity_id) AS INTEGER) activities,
+       CAST(SUM(tm.duration_seconds) AS INTEGER)       seconds,
+       CAST(SUM(tm.effort * tm.duration_seconds) / SUM(tm.duration_seconds) AS REAL) effort,
+       CAST(COALESCE(AVG(tm.heartrate), 0) AS REAL)    heartrate,
+       CAST(COALESCE(AVG(tm.speed), 0) AS REAL)        speed,
+       CAST(COALESCE(AVG(tm.watts), 0) AS REAL)        watts
+FROM track_metric tm
+         JOIN activity a ON tm.activity_id = a.id
+WHERE tm.user_id = sqlc.arg(user_id)
+  AND tm.effort > 0
+  AND a.start_date_local >= sqlc.arg(after)
+  AND a.start_date_local < sqlc.arg(before)
+GROUP BY tm.track_uri
+HAVING SUM(tm.duration_seconds) >= sqlc.arg(min_seconds)
+ORDER BY effort DESC
+LIMIT sqlc.arg(limit);
+
+-- name: ListSoundtracksBetween :many
+SELECT a.id   activity_id,
+       a.name activity_name,
+       a.sport_type,
+       a.start_date_local,
+       at.duration_seconds,
+       item.type         item_type,
+       item.uri          item_uri,
+       item.external_url item_external_url,
+       item.name,
+       item.artists,
+       item.episode_show_name
+FROM activity a
+         JOIN activity_track at ON a.id = at.activity_id
+         JOIN history_item item ON at.history_id = item.history_id
+WHERE a.user_id = sqlc.arg(user_id)
+  AND a.start_date_local >= sqlc.arg(after)
+  AND a.start_date_local < sqlc.arg(before)
+ORDER BY a.start_date, at.position;
+
+-- name: GetShareSettings :one
+SELECT * FROM share_settings WHERE user_id = ?;
+
+-- name: UpsertShareSettings :exec
+INSERT INTO share_settings (user_id, auto_create, add_to_description) VALUES (?, ?, ?)
+ON CONFLICT (user_id) DO UPDATE SET auto_create        = excluded.auto_create,
+                                    add_to_description = excluded.add_to_description;
+
+-- name: DeleteShareSettings :exec
+DELETE FROM share_settings WHERE user_id = ?;
+
+-- name: GetActivityShare :one
+SELECT * FROM activity_share WHERE activity_id = ? AND user_id = ?;
+
+-- name: GetActivityShareByToken :one
+SELECT * FROM activity_share WHERE token = ?;
+
+-- name: InsertActivityShare :exec
+INSERT INTO activity_share (activity_id, user_id, token) VALUES (?, ?, ?);
+
+-- name: DeleteActivityShare :exec
+DELETE FROM activity_share WHERE activity_id = ? AND user_id = ?;
+
+-- name: DeleteActivitySharesForUser :exec
+DELETE FROM activity_share WHERE user_id = ?;
+
+-- name: GetWrappedShare :one
+SELECT * FROM wrapped_share WHERE user_id = ? AND year = ?;
+
+-- name: GetWrappedShareByToken :one
+SELECT * FROM wrapped_share WHERE token = ?;
+
+-- name: InsertWrappedShare :exec
+INSERT INTO wrapped_share (user_id, year, token) VALUES (?, ?, ?);
+
+-- name: DeleteWrappedShare :exec
+DELETE FROM wrapped_share WHERE user_id = ? AND year = ?;
+
+-- name: DeleteWrappedSharesForUser :exec
+DELETE FROM wrapped_share WHERE user_id = ?;
@@ -72,25 +72,28 @@ CREATE TABLE IF NOT EXISTS spotify_refresh_token
     FOREIGN KEY (user_id) REFERENCES user (id)
 );
 
-CREATE TABLE IF NOT EXISTS spotify_user_history
+-- history holds what the music sources of a user played, pauses are entries
+-- that are not playing.
+CREATE TABLE IF NOT EXISTS history
 (
-    id         INTEGER   PRIMARY KEY AUTOINCREMENT,
-    user_id    INT       NOT NULL,
-    timestamp  TIMESTAMP NOT NULL,
-    is_playing BOOLEAN   NOT NULL
+    id         INTEGER     PRIMARY KEY AUTOINCREMENT,
+    user_id    INT         NOT NULL,
+    source     VARCHAR(20) NOT NULL,
+    timestamp  TIMESTAMP   NOT NULL,
+    is_playing BOOLEAN     NOT NULL
 );
 
-CREATE TABLE IF NOT EXISTS spotify_user_history_context
+CREATE TABLE IF NOT EXISTS history_context
 (
     history_id   INTEGER      NOT NULL PRIMARY KEY,
     type         VARCHAR(10)  NOT NULL,
     href         TEXT         NOT NULL,
     external_url TEXT         NOT NULL,
     uri          VARCHAR(255) NOT NULL,
-    FOREIGN KEY (history_id) REFERENCES spotify_user_history (id)
+    FOREIGN KEY (history_id) REFERENCES history (id)
 );
 
-CREATE TABLE IF NOT EXISTS spotify_user_history_item
+CREATE TABLE IF NOT EXISTS history_item
 (
     history_id               INTEGER      NOT NULL PRIMARY KEY,
     type                     VARCHAR(10)  NOT NULL,
@@ -105,5 +108,284 @@ CREATE TABLE IF NOT EXISTS spotify_user_history_item
     episode_show_name        TEXT,
     episode_show_description TEXT,
     episode_show_uri         VARCHAR(255),
-    FOREIGN KEY (history_id) REFERENCES spotify_user_history (id)
-);
\ No newline at end of file
+    FOREIGN KEY (history_id) REFERENCES history (id)
+);
+
+CREATE INDEX IF NOT EXISTS history_user_id_timestamp_idx ON history (user_id, timestamp);
+
+CREATE TABLE IF NOT EXISTS spotify_user_history_reconciled
+(
+    history_id INTEGER   NOT NULL PRIMARY KEY,
+    played_at  TIMESTAMP NOT NULL,
+    FOREIGN KEY (history_id) REFERENCES history (id)
+);
+
+CREATE TABLE IF NOT EXISTS spotify_user_history_imported
+(
+    history_id INTEGER   NOT NULL PRIMARY KEY,
+    played_at  TIMESTAMP NOT NULL,
+    ms_played  INT       NOT NULL,
+    FOREIGN KEY (history_id) REFERENCES history (id)
+);
+
+CREATE TABLE IF NOT EXISTS spotify_recently_played_cursor
+(
+    user_id      INT NOT NULL PRIMARY KEY,
+    played_after INT NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES user (id)
+);
+
+
+CREATE TABLE IF NOT EXISTS strava_event
+(
+    id              INTEGER PRIMARY KEY AUTOINCREMENT,
+    object_type     VARCHAR(10) NOT NULL,
+    object_id       INT         NOT NULL,
+    aspect_type     VARCHAR(10) NOT NULL,
+    updates         TEXT        NOT NULL,
+    owner_id        INT         NOT NULL,
+    subscription_id INT         NOT NULL,
+    event_time      INT         NOT NULL,
+    state           VARCHAR(10) NOT NULL DEFAULT 'pending',
+    attempts        INT         NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP   NOT NULL,
+    last_error      TEXT,
+    created_at      TIMESTAMP   NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at      TIMESTAMP   NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS strava_event_state_next_attempt_at_idx ON strava_event (state, next_attempt_at);
+CREATE INDEX IF NOT EXISTS strava_event_object_idx ON strava_event (object_type, object_id, state);
+
+
+CREATE TABLE IF NOT EXISTS description_template
+(
+    user_id    INTEGER   NOT NULL PRIMARY KEY,
+    template   TEXT      NOT NULL,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES user (id)
+);
+
+
+CREATE TABLE IF NOT EXISTS track_metric
+(
+    user_id          INT          NOT NULL,
+    activity_id      INT          NOT NULL,
+    history_id       INT          NOT NULL,
+    track_uri        VARCHAR(255) NOT NULL,
+    track_name       VARCHAR(255) NOT NULL,
+    artists          TEXT         NOT NULL,
+    offset_seconds   INT          NOT NULL,
+    duration_seconds INT          NOT NULL,
+    samples          INT          NOT NULL,
+    heartrate        REAL,
+    speed            REAL,
+    watts            REAL,
+    cadence          REAL,
+    effort           REAL         NOT NULL,
+    PRIMARY KEY (activity_id, history_id),
+    FOREIGN KEY (user_id) REFERENCES user (id),
+    FOREIGN KEY (history_id) REFERENCES history (id)
+);
+
+CREATE INDEX IF NOT EXISTS track_metric_user_id_track_uri_idx ON track_metric (user_id, track_uri);
+
+
+CREATE TABLE IF NOT EXISTS activity_soundtrack
+(
+    activity_id  INTEGER   NOT NULL PRIMARY KEY,
+    user_id      INT       NOT NULL,
+    start_date   TIMESTAMP NOT NULL,
+    elapsed_time INT       NOT NULL,
+    soundtrack   TEXT      NOT NULL,
+    updated_at   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES user (id)
+);
+
+
+CREATE TABLE IF NOT EXISTS activity
+(
+    id                   INTEGER      NOT NULL PRIMARY KEY,
+    user_id              INT          NOT NULL,
+    name                 VARCHAR(255) NOT NULL,
+    type                 VARCHAR(50)  NOT NULL,
+    sport_type           VARCHAR(50)  NOT NULL,
+    start_date           TIMESTAMP    NOT NULL,
+    start_date_local     TIMESTAMP    NOT NULL,
+    timezone             VARCHAR(255) NOT NULL,
+    elapsed_time         INT          NOT NULL,
+    moving_time          INT          NOT NULL,
+    distance             REAL         NOT NULL,
+    total_elevation_gain REAL         NOT NULL,
+    average_speed        REAL         NOT NULL,
+    max_speed            REAL         NOT NULL,
+    average_heartrate    REAL,
+    average_watts        REAL,
+    private              BOOLEAN      NOT NULL,
+    commute              BOOLEAN      NOT NULL,
+    trainer              BOOLEAN      NOT NULL,
+    manual               BOOLEAN      NOT NULL,
+    summary_polyline     TEXT         NOT NULL,
+    updated_at           TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES user (id)
+);
+
+CREATE INDEX IF NOT EXISTS activity_user_id_start_date_idx ON activity (user_id, start_date);
+
+CREATE TABLE IF NOT EXISTS activity_track
+(
+    activity_id      INT NOT NULL,
+    history_id       INT NOT NULL,
+    position         INT NOT NULL,
+    offset_seconds   INT NOT NULL,
+    duration_seconds INT NOT NULL,
+    PRIMARY KEY (activity_id, history_id),
+    FOREIGN KEY (activity_id) REFERENCES activity (id),
+    FOREIGN KEY (history_id) REFERENCES history (id)
+);
+
+-- activity_interval holds the laps and kilometre splits of an activity, kind
+-- is 'lap' or 'split'.
+CREATE TABLE IF NOT EXISTS activity_interval
+(
+    activity_id     INT          NOT NULL,
+    kind            VARCHAR(10)  NOT NULL,
+    position        INT          NOT NULL,
+    name            VARCHAR(255) NOT NULL,
+    distance        REAL         NOT NULL,
+    offset_seconds  INT          NOT NULL,
+    elapsed_seconds INT          NOT NULL,
+    PRIMARY KEY (activity_id, kind, position),
+    FOREIGN KEY (activity_id) REFERENCES activity (id)
+);
+
+-- music_account links a user to a music source that is polled for
+-- scrobbles. played_after is the unix time of the newest play seen.
+CREATE TABLE IF NOT EXISTS music_account
+(
+    user_id      INT          NOT NULL,
+    source       VARCHAR(20)  NOT NULL,
+    username     VARCHAR(255) NOT NULL,
+    token        TEXT,
+    played_after INT          NOT NULL DEFAULT 0,
+    created_at   TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, source),
+    FOREIGN KEY (user_id) REFERENCES user (id)
+);
+
+-- api_token authenticates players that submit listens. Only a hash of the
+-- token is stored, the token itself is shown once when it is created.
+CREATE TABLE IF NOT EXISTS api_token
+(
+    id           INTEGER      PRIMARY KEY AUTOINCREMENT,
+    user_id      INT          NOT NULL,
+    name         VARCHAR(255) NOT NULL,
+    token_hash   VARCHAR(64)  NOT NULL UNIQUE,
+    created_at   TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES user (id)
+);
+
+-- spotify_scope is what the user granted on their last Spotify login, so
+-- features needing newer scopes can ask them to connect again.
+CREATE TABLE IF NOT EXISTS spotify_scope
+(
+    user_id INTEGER PRIMARY KEY NOT NULL,
+    scope   TEXT                NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES user (id)
+);
+
+CREATE TABLE IF NOT EXISTS playlist_settings
+(
+    user_id            INTEGER PRIMARY KEY NOT NULL,
+    auto_create        BOOLEAN             NOT NULL DEFAULT FALSE,
+    add_to_description BOOLEAN             NOT NULL DEFAULT FALSE,
+    FOREIGN KEY (user_id) REFERENCES user (id)
+);
+
+-- activity_playlist is the Spotify playlist created from the soundtrack of
+-- an activity.
+CREATE TABLE IF NOT EXISTS activity_playlist
+(
+    activity_id INTEGER      PRIMARY KEY NOT NULL,
+    user_id     INT          NOT NULL,
+    playlist_id VARCHAR(255) NOT NULL,
+    url         VARCHAR(255) NOT NULL,
+    created_at  TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES user (id)
+);
+
+-- activity_rules decide which activities get a soundtrack. sport_types is a
+-- comma separated list, empty means all.
+CREATE TABLE IF NOT EXISTS activity_rules
+(
+    user_id      INTEGER PRIMARY KEY NOT NULL,
+    sport_types  TEXT                NOT NULL DEFAULT '',
+    skip_private BOOLEAN             NOT NULL DEFAULT FALSE,
+    skip_commute BOOLEAN             NOT NULL DEFAULT FALSE,
+    skip_trainer BOOLEAN             NOT NULL DEFAULT FALSE,
+    skip_manual  BOOLEAN             NOT NULL DEFAULT FALSE,
+    min_duration INT                 NOT NULL DEFAULT 0,
+    opt_out_tag  VARCHAR(50)         NOT NULL DEFAULT '#nomusic',
+    FOREIGN KEY (user_id) REFERENCES user (id)
+);
+
+-- review_settings holds back descriptions until the user approves them.
+-- notify_url, an https url of a public host, receives a POST with a link
+-- to approve each one.
+CREATE TABLE IF NOT EXISTS review_settings
+(
+    user_id    INTEGER PRIMARY KEY NOT NULL,
+    enabled    BOOLEAN             NOT NULL DEFAULT FALSE,
+    notify_url TEXT                NOT NULL DEFAULT '',
+    FOREIGN KEY (user_id) REFERENCES user (id)
+);
+
+-- pending_description is a soundtrack waiting for approval. An empty
+-- soundtrack proposes removing the one written before. Only a hash of the
+-- token in the approval link is stored, the link works for a week after
+-- created_at.
+CREATE TABLE IF NOT EXISTS pending_description
+(
+    activity_id  INTEGER     PRIMARY KEY NOT NULL,
+    user_id      INT         NOT NULL,
+    name         TEXT        NOT NULL,
+    start_date   TIMESTAMP   NOT NULL,
+    soundtrack   TEXT        NOT NULL,
+    token_hash   VARCHAR(64) NOT NULL UNIQUE,
+    created_at   TIMESTAMP   NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES user (id)
+);
+
+-- share_settings decide whether new activities get a public page and
+-- whether its link replaces the footer of the description.
+CREATE TABLE IF NOT EXISTS share_settings
+(
+    user_id            INTEGER PRIMARY KEY NOT NULL,
+    auto_create        BOOLEAN             NOT NULL DEFAULT FALSE,
+    add_to_description BOOLEAN             NOT NULL DEFAULT FALSE,
+    FOREIGN KEY (user_id) REFERENCES user (id)
+);
+
+-- activity_share is the public page of an activity at /s/{token}. Deleting
+-- the row revokes the link.
+CREATE TABLE IF NOT EXISTS activity_share
+(
+    activity_id INTEGER     PRIMARY KEY NOT NULL,
+    user_id     INT         NOT NULL,
+    token       VARCHAR(64) NOT NULL UNIQUE,
+    created_at  TIMESTAMP   NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES user (id)
+);
+
+-- wrapped_share is the public page of the Wrapped of a year at /w/{token}.
+-- Deleting the row revokes the link.
+CREATE TABLE IF NOT EXISTS wrapped_share
+(
+    user_id    INT         NOT NULL,
+    year       INT         NOT NULL,
+    token      VARCHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP   NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, year),
+    FOREIGN KEY (user_id) REFERENCES user (id)
+);
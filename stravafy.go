@@ -47,9 +47,34 @@ func main() {
 	if err != nil {
 		log.Fatalf("som wrong wis se migration: %v", err)
 	}
+	sqlite, err := database.NewSQLite()
+	if err != nil {
+		log.Fatalf("nono database: %v", err)
+	}
+	err = database.Migrate(context.Background(), sqlite.DB)
+	if err != nil {
+		log.Fatalf("som wrong wis se migration: %v", err)
+	}
+	sqlite.DB.Close()
 	queries := database.New(db)
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "backfill":
+			runBackfill(queries, os.Args[2:])
+			return
+		case "import":
+			runImport(queries, os.Args[2:])
+			return
+		}
+	}
+
 	server.Init(queries)
 
+	// strava validates a new subscription against the running server, an
+	// existing one has to be known before events come in
+	subscribed := webhook.LookupSubscription()
+
 	go func() {
 		if err := server.Run(); err != nil {
 			log.Printf("an error accoured: %v\n", err)
@@ -58,7 +83,9 @@ func main() {
 
 	go worker.Start()
 
-	webhook.RegisterWebhook()
+	if !subscribed {
+		webhook.RegisterWebhook()
+	}
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)